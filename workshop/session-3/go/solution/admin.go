@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminAPI lets operators manage the proxy's cache over HTTP, so a
+// dashboard needs neither Redis nor LangCache credentials. Every request
+// must carry Key.
+type adminAPI struct {
+	Proxy *proxyServer
+	Key   string
+}
+
+// Handler routes the admin endpoints, all under /admin/
+func (a *adminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/entries", a.handleEntries)
+	mux.HandleFunc("/admin/entries/", a.handleEntry)
+	mux.HandleFunc("/admin/keys/", a.handleKey)
+	mux.HandleFunc("/admin/invalidate", a.handleInvalidate)
+	mux.HandleFunc("/admin/flush", a.handleFlush)
+	mux.HandleFunc("/admin/stats", a.handleStats)
+	mux.HandleFunc("/admin/settings", a.handleSettings)
+	mux.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		writeDetail(w, http.StatusNotFound, "Not Found")
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(requestKey(r)), []byte(a.Key)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aishe-admin"`)
+			writeDetail(w, http.StatusUnauthorized, "missing or invalid admin key")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods answers 405 unless the request uses one of the methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeDetail(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	return false
+}
+
+// decodeBody reads a JSON request body into v, answering 422 when it is invalid
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		writeDetail(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// adminEntry is a semantic cache entry as the admin API shows it
+type adminEntry struct {
+	ID         string            `json:"id"`
+	Prompt     string            `json:"prompt"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Similarity *float64          `json:"similarity,omitempty"`
+	Answer     string            `json:"answer,omitempty"`
+	Sources    []Source          `json:"sources,omitempty"`
+	Format     string            `json:"format,omitempty"`
+	Error      string            `json:"error,omitempty"` // Why the response could not be decoded
+}
+
+// queryAttributes reads the scope of a request from repeated
+// attr=name=value parameters, defaulting to the proxy's own scope
+func (a *adminAPI) queryAttributes(r *http.Request) (map[string]string, error) {
+	values := r.URL.Query()["attr"]
+	if len(values) == 0 {
+		return a.Proxy.Attributes, nil
+	}
+	attributes := attributeFlag{}
+	for _, value := range values {
+		if err := attributes.Set(value); err != nil {
+			return nil, err
+		}
+	}
+	return attributes, nil
+}
+
+// handleEntries lists semantic entries (GET), searches them (GET ?q=) or
+// removes every cached answer to a question (DELETE ?question=)
+func (a *adminAPI) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	query := r.URL.Query()
+	attributes, err := a.queryAttributes(r)
+	if err != nil {
+		writeDetail(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	threshold := a.Proxy.SimilarityThreshold()
+	if thresholdStr := query.Get("threshold"); thresholdStr != "" {
+		if threshold, err = parseSimilarityThreshold(thresholdStr); err != nil {
+			writeDetail(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		question := strings.TrimSpace(query.Get("question"))
+		if question == "" {
+			writeDetail(w, http.StatusUnprocessableEntity, "question must not be empty")
+			return
+		}
+		removed, err := a.Proxy.Tiered.Forget(r.Context(), question, threshold, attributes)
+		if err != nil {
+			writeDetail(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		log.Printf("admin: removed cached answers to %q (%d semantic entries)", question, removed)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"question": question, "semantic_removed": removed})
+		return
+	}
+
+	limit := 100
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			writeDetail(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid limit %q", limitStr))
+			return
+		}
+	}
+
+	cache := a.Proxy.Tiered.Semantic
+	var entries []adminEntry
+	var total int
+	if question := strings.TrimSpace(query.Get("q")); question != "" {
+		matches, err := cache.Search(r.Context(), question, threshold, attributes)
+		if err != nil {
+			writeDetail(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		total = len(matches)
+		for _, entry := range matches {
+			entries = append(entries, newAdminEntry(entry.ID, entry.Prompt, entry.Response, entry.Attributes, entry.Similarity))
+		}
+	} else {
+		lister, ok := cache.(entryListing)
+		if !ok {
+			writeDetail(w, http.StatusNotImplemented, fmt.Sprintf("%s cannot list its entries; search them with ?q=", semanticCacheName()))
+			return
+		}
+		all, err := lister.Entries(r.Context())
+		if err != nil {
+			writeDetail(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		total = len(all)
+		for _, entry := range all {
+			entries = append(entries, newAdminEntry(entry.ID, entry.Prompt, entry.Response, entry.Attributes, nil))
+		}
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []adminEntry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"backend": semanticCacheName(), "total": total, "entries": entries})
+}
+
+// newAdminEntry decodes a semantic entry for display
+func newAdminEntry(id, prompt, response string, attributes map[string]string, similarity *float64) adminEntry {
+	entry := adminEntry{ID: id, Prompt: prompt, Attributes: attributes, Similarity: similarity}
+	decoded, format, err := decodeCachedResponse(response)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Answer = decoded.Answer
+	entry.Sources = decoded.Sources
+	entry.Format = format
+	return entry
+}
+
+// handleEntry deletes a semantic entry by ID, with the exact-tier copies
+// of its answer
+func (a *adminAPI) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/entries/")
+	if id == "" {
+		writeDetail(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	copies, err := a.Proxy.Tiered.DeleteEntry(r.Context(), id)
+	if err != nil {
+		writeDetail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	log.Printf("admin: deleted semantic entry %s and %d exact copies", id, copies)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id, "exact_removed": copies})
+}
+
+// handleKey deletes an exact-tier key, such as aishe:question:<hash>
+func (a *adminAPI) handleKey(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	tiered := a.Proxy.Tiered
+	if tiered.Exact == nil {
+		writeDetail(w, http.StatusServiceUnavailable, "the exact tier needs Redis (set REDIS_ADDR)")
+		return
+	}
+
+	// Only cache keys, so the endpoint cannot remove the audit log or API keys
+	key := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+	if !strings.HasPrefix(key, "aishe:question:") {
+		writeDetail(w, http.StatusUnprocessableEntity, "only exact cache keys (aishe:question:...) can be deleted")
+		return
+	}
+	deleted, err := tiered.DeleteExact(r.Context(), key)
+	if err != nil {
+		writeDetail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if deleted == 0 {
+		writeDetail(w, http.StatusNotFound, fmt.Sprintf("no such key %s", key))
+		return
+	}
+	log.Printf("admin: deleted exact key %s", key)
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": key})
+}
+
+// handleInvalidate purges every answer citing a source, like the
+// invalidate command
+func (a *adminAPI) handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var request struct {
+		Source string `json:"source"`
+	}
+	if !decodeBody(w, r, &request) {
+		return
+	}
+	if strings.TrimSpace(request.Source) == "" {
+		writeDetail(w, http.StatusUnprocessableEntity, "source must not be empty")
+		return
+	}
+	tiered := a.Proxy.Tiered
+	if tiered.Exact == nil || tiered.Index == nil {
+		writeDetail(w, http.StatusServiceUnavailable, "the source index needs Redis (set REDIS_ADDR)")
+		return
+	}
+
+	count, err := invalidateSource(r.Context(), tiered.Exact.Client, tiered.Semantic, tiered.Index, request.Source)
+	if err != nil {
+		writeDetail(w, http.StatusBadGateway, fmt.Sprintf("invalidated %d answers, then: %v", count, err))
+		return
+	}
+	log.Printf("admin: invalidated %d answers citing %s", count, request.Source)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"source": request.Source, "invalidated": count})
+}
+
+// handleFlush removes every answer cached under a set of attributes: the
+// semantic entries carrying them, and the exact keys stored with exactly
+// that scope
+func (a *adminAPI) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var request struct {
+		Attributes map[string]string `json:"attributes"`
+	}
+	if !decodeBody(w, r, &request) {
+		return
+	}
+	if len(request.Attributes) == 0 {
+		writeDetail(w, http.StatusUnprocessableEntity, "attributes must name the namespace to flush")
+		return
+	}
+
+	tiered := a.Proxy.Tiered
+	semanticRemoved, err := tiered.DeleteByAttributes(r.Context(), request.Attributes)
+	if err != nil {
+		writeDetail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	exactRemoved, err := flushExactScope(r.Context(), tiered, request.Attributes)
+	if err != nil {
+		writeDetail(w, http.StatusBadGateway, fmt.Sprintf("removed %d semantic entries, then: %v", semanticRemoved, err))
+		return
+	}
+
+	log.Printf("admin: flushed %s (%d semantic entries, %d exact keys)", formatAttributes(request.Attributes), semanticRemoved, exactRemoved)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"attributes":       request.Attributes,
+		"semantic_removed": semanticRemoved,
+		"exact_removed":    exactRemoved,
+	})
+}
+
+// flushExactScope deletes the exact-tier keys stored under the attributes.
+// The scope is hashed into the key, so only keys of exactly that scope match.
+func flushExactScope(ctx context.Context, tiered *TieredCache, attributes map[string]string) (int, error) {
+	if tiered.Exact == nil {
+		return 0, nil
+	}
+	hash := sha256.Sum256([]byte(formatAttributes(attributes)))
+	pattern := "aishe:question:*:" + hex.EncodeToString(hash[:8])
+
+	removed := 0
+	iter := tiered.Exact.Client.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		deleted, err := tiered.DeleteExact(ctx, iter.Val())
+		if err != nil {
+			return removed, err
+		}
+		removed += deleted
+	}
+	return removed, iter.Err()
+}
+
+// handleStats returns the tier counters, the per-client usage and the
+// current settings
+func (a *adminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	stats := map[string]interface{}{"settings": a.settings()}
+
+	tiered := a.Proxy.Tiered
+	if tiered.Stats != nil {
+		counters, err := tiered.Stats.Load(r.Context())
+		if err != nil {
+			writeDetail(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		stats["tiers"] = counters
+	}
+	if auth := a.Proxy.Auth; auth != nil && auth.Usage != nil {
+		counters, err := auth.Usage.Load(r.Context())
+		if err != nil {
+			writeDetail(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		stats["usage"] = counters
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// adminSettings are the settings the admin API can change at runtime.
+// Durations are strings like "12h"; "0" keeps entries until the backend
+// expires them.
+type adminSettings struct {
+	SimilarityThreshold *float64 `json:"similarity_threshold,omitempty"`
+	ExactTTL            *string  `json:"exact_ttl,omitempty"`
+	SemanticTTL         *string  `json:"semantic_ttl,omitempty"`
+}
+
+// settings returns the current settings
+func (a *adminAPI) settings() adminSettings {
+	threshold := a.Proxy.SimilarityThreshold()
+	semanticTTL := a.Proxy.Tiered.SemanticTTL().String()
+	settings := adminSettings{SimilarityThreshold: &threshold, SemanticTTL: &semanticTTL}
+	if exact := a.Proxy.Tiered.Exact; exact != nil {
+		exactTTL := exact.currentTTL().String()
+		settings.ExactTTL = &exactTTL
+	}
+	return settings
+}
+
+// handleSettings shows (GET) or changes (PATCH) the settings. Changes
+// apply to this proxy until it restarts.
+func (a *adminAPI) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, a.settings())
+		return
+	}
+
+	var request adminSettings
+	if !decodeBody(w, r, &request) {
+		return
+	}
+
+	// Validate everything before changing anything
+	parseTTL := func(name string, value *string) (time.Duration, error) {
+		if value == nil {
+			return 0, nil
+		}
+		ttl, err := time.ParseDuration(*value)
+		if err != nil || ttl < 0 {
+			return 0, fmt.Errorf("invalid %s %q (expected a duration like 24h)", name, *value)
+		}
+		return ttl, nil
+	}
+	exactTTL, err := parseTTL("exact_ttl", request.ExactTTL)
+	if err != nil {
+		writeDetail(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	semanticTTL, err := parseTTL("semantic_ttl", request.SemanticTTL)
+	if err != nil {
+		writeDetail(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if request.SimilarityThreshold != nil {
+		if t := *request.SimilarityThreshold; t < 0 || t > 1 {
+			writeDetail(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid similarity_threshold %v (expected a number between 0 and 1)", t))
+			return
+		}
+	}
+	if request.ExactTTL != nil && a.Proxy.Tiered.Exact == nil {
+		writeDetail(w, http.StatusServiceUnavailable, "the exact tier needs Redis (set REDIS_ADDR)")
+		return
+	}
+
+	if request.SimilarityThreshold != nil {
+		a.Proxy.SetSimilarityThreshold(*request.SimilarityThreshold)
+		log.Printf("admin: similarity threshold set to %.2f", *request.SimilarityThreshold)
+	}
+	if request.ExactTTL != nil {
+		a.Proxy.Tiered.Exact.SetTTL(exactTTL)
+		log.Printf("admin: exact cache TTL set to %s", exactTTL)
+	}
+	if request.SemanticTTL != nil {
+		a.Proxy.Tiered.SetSemanticTTL(semanticTTL)
+		log.Printf("admin: semantic cache TTL set to %s", semanticTTL)
+	}
+	writeJSON(w, http.StatusOK, a.settings())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestAdmin starts a proxy with the admin API enabled under the key
+// "admin-key". Its exact tier points at a Redis that is not running, which
+// is enough for the requests rejected before reaching Redis.
+func newTestAdmin(t *testing.T) (*httptest.Server, *proxyServer) {
+	t.Helper()
+
+	proxy := newTestProxyServer(t, "http://localhost:1")
+	proxy.AdminKey = "admin-key"
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:1", MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	proxy.Tiered.Exact = &ExactCache{Client: rdb, TTL: 24 * time.Hour}
+
+	server := httptest.NewServer(proxy.Handler())
+	t.Cleanup(server.Close)
+	return server, proxy
+}
+
+// adminRequest sends a request to the admin API with the given key and
+// returns the response and its decoded JSON body
+func adminRequest(t *testing.T, server *httptest.Server, method, path, key, body string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if key != "" {
+		request.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var decoded map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp, decoded
+}
+
+func TestAdminKey(t *testing.T) {
+	server, _ := newTestAdmin(t)
+
+	for _, key := range []string{"", "admin-ke", "admin-key2", "wrong"} {
+		resp, _ := adminRequest(t, server, http.MethodGet, "/admin/settings", key, "")
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("key %q: %d, want 401 with a challenge", key, resp.StatusCode)
+		}
+	}
+	// Unknown paths are not revealed without the key either
+	if resp, _ := adminRequest(t, server, http.MethodGet, "/admin/nothing", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unknown path without key: %d, want 401", resp.StatusCode)
+	}
+
+	if resp, _ := adminRequest(t, server, http.MethodGet, "/admin/settings", "admin-key", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid key: %d, want 200", resp.StatusCode)
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/settings", nil)
+	request.Header.Set("X-API-Key", "admin-key")
+	if resp, err := http.DefaultClient.Do(request); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("valid X-API-Key: %v, %v; want 200", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	if resp, _ := adminRequest(t, server, http.MethodGet, "/admin/nothing", "admin-key", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path: %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAdminMethods(t *testing.T) {
+	server, _ := newTestAdmin(t)
+
+	tests := []struct {
+		method, path string
+		allow        string
+	}{
+		{http.MethodPost, "/admin/entries", "GET, DELETE"},
+		{http.MethodGet, "/admin/entries/entry-1", "DELETE"},
+		{http.MethodGet, "/admin/keys/aishe:question:abc", "DELETE"},
+		{http.MethodGet, "/admin/invalidate", "POST"},
+		{http.MethodDelete, "/admin/flush", "POST"},
+		{http.MethodPost, "/admin/stats", "GET"},
+		{http.MethodPost, "/admin/settings", "GET, PATCH"},
+		{http.MethodPut, "/admin/settings", "GET, PATCH"},
+	}
+	for _, tt := range tests {
+		resp, _ := adminRequest(t, server, tt.method, tt.path, "admin-key", "{}")
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tt.allow {
+			t.Errorf("%s %s: %d with Allow %q, want 405 with %q", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"), tt.allow)
+		}
+	}
+}
+
+func TestAdminSettings(t *testing.T) {
+	server, proxy := newTestAdmin(t)
+
+	invalid := []string{
+		`{"exact_ttl": "soon"}`,
+		`{"exact_ttl": "-1h"}`,
+		`{"semantic_ttl": "12"}`,
+		`{"semantic_ttl": "-5m"}`,
+		`{"similarity_threshold": 1.5}`,
+		`{"similarity_threshold": -0.1}`,
+		`{"similarity_threshold": "high"}`,
+		`{"similarity_threshold": 0.9, "semantic_ttl": "never"}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		resp, decoded := adminRequest(t, server, http.MethodPatch, "/admin/settings", "admin-key", body)
+		if resp.StatusCode != http.StatusUnprocessableEntity || decoded["detail"] == nil {
+			t.Errorf("PATCH %s: %d %v, want 422 with a detail", body, resp.StatusCode, decoded)
+		}
+	}
+	// A rejected request changes nothing, not even its valid settings
+	if proxy.SimilarityThreshold() != 0.8 || proxy.Tiered.SemanticTTL() != 0 || proxy.Tiered.Exact.currentTTL() != 24*time.Hour {
+		t.Errorf("rejected requests changed the settings to %+v", proxy.Tiered)
+	}
+
+	resp, decoded := adminRequest(t, server, http.MethodPatch, "/admin/settings", "admin-key",
+		`{"similarity_threshold": 0.9, "exact_ttl": "1h", "semantic_ttl": "0"}`)
+	if resp.StatusCode != http.StatusOK || decoded["similarity_threshold"] != 0.9 || decoded["exact_ttl"] != "1h0m0s" || decoded["semantic_ttl"] != "0s" {
+		t.Errorf("valid PATCH: %d %v", resp.StatusCode, decoded)
+	}
+	if proxy.SimilarityThreshold() != 0.9 || proxy.Tiered.Exact.currentTTL() != time.Hour {
+		t.Errorf("valid PATCH: threshold %v, exact TTL %s; want 0.9 and 1h", proxy.SimilarityThreshold(), proxy.Tiered.Exact.currentTTL())
+	}
+
+	// The exact TTL needs the exact tier
+	proxy.Tiered.Exact = nil
+	if resp, _ := adminRequest(t, server, http.MethodPatch, "/admin/settings", "admin-key", `{"exact_ttl": "2h"}`); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("exact_ttl without Redis: %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestAdminKeyPrefix(t *testing.T) {
+	server, proxy := newTestAdmin(t)
+
+	// Keys outside the exact cache are refused before Redis is asked
+	for _, key := range []string{"aishe:audit", "aishe:proxy:keys", "aishe:question", "other:aishe:question:abc", ""} {
+		resp, _ := adminRequest(t, server, http.MethodDelete, "/admin/keys/"+key, "admin-key", "")
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("DELETE /admin/keys/%s: %d, want 422", key, resp.StatusCode)
+		}
+	}
+
+	// Cache keys get through to Redis, which is not running here
+	resp, _ := adminRequest(t, server, http.MethodDelete, "/admin/keys/aishe:question:abc", "admin-key", "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("DELETE of a cache key: %d, want 502 from the missing Redis", resp.StatusCode)
+	}
+
+	proxy.Tiered.Exact = nil
+	resp, _ = adminRequest(t, server, http.MethodDelete, "/admin/keys/aishe:question:abc", "admin-key", "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("DELETE without an exact tier: %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestAdminDeletesForgetIndex(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	id := testID(t)
+	url := "https://example.com/" + id
+
+	proxy := newTestProxyServer(t, "http://localhost:1")
+	proxy.AdminKey = "admin-key"
+	tiered := proxy.Tiered
+	tiered.Exact = &ExactCache{Client: rdb, TTL: time.Hour}
+	tiered.Index = NewSourceIndex(rdb)
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	scope := map[string]string{"tenant": id}
+	response := &Response{Answer: "Paris", Sources: []Source{{Number: 1, URL: url}}}
+	stored, asked := "What is the capital of France?", "Which city is the capital of France?"
+	tiered.Save(stored, scope, response)
+	entries, err := tiered.Semantic.Search(ctx, stored, 0.99, scope)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Search after Save = %+v, %v; want one entry", entries, err)
+	}
+	tiered.Promote(asked, scope, &CachedResponse{Response: response, EntryID: entries[0].ID, Prompt: stored})
+
+	// Deleting the entry takes both exact copies and their index records
+	resp, decoded := adminRequest(t, server, http.MethodDelete, "/admin/entries/"+entries[0].ID, "admin-key", "")
+	if resp.StatusCode != http.StatusOK || decoded["exact_removed"] != 2.0 {
+		t.Errorf("DELETE entry: %d %v, want 200 with 2 exact copies removed", resp.StatusCode, decoded)
+	}
+	if members := sortedMembers(t, tiered.Index, url); len(members) != 0 {
+		t.Errorf("source index still lists %q", members)
+	}
+
+	// A deleted key leaves the index too
+	tiered.Save(stored, scope, response)
+	key := exactCacheKey(stored, scope)
+	if resp, _ := adminRequest(t, server, http.MethodDelete, "/admin/keys/"+key, "admin-key", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE key: %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := adminRequest(t, server, http.MethodDelete, "/admin/keys/"+key, "admin-key", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE key: %d, want 404", resp.StatusCode)
+	}
+	if members := sortedMembers(t, tiered.Index, url); len(members) != 1 || members[0] == exactMember(key) {
+		t.Errorf("source index lists %q, want only the semantic entry", members)
+	}
+
+	// A flush forgets what it removes from both tiers. The save replaces
+	// the semantic entry, whose exact copy then goes with it.
+	tiered.Save(stored, scope, response)
+	resp, decoded = adminRequest(t, server, http.MethodPost, "/admin/flush", "admin-key", `{"attributes": {"tenant": "`+id+`"}}`)
+	if resp.StatusCode != http.StatusOK || decoded["semantic_removed"] != 1.0 {
+		t.Errorf("flush: %d %v, want 200 with the semantic entry removed", resp.StatusCode, decoded)
+	}
+	if members := sortedMembers(t, tiered.Index, url); len(members) != 0 {
+		t.Errorf("source index lists %q after the flush", members)
+	}
+	if rdb.Exists(ctx, key).Val() != 0 {
+		t.Error("the flush left the exact key")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reasons a request is shed instead of being forwarded to AISHE
+var (
+	errQueueFull    = errors.New("upstream queue is full")
+	errQueueTimeout = errors.New("timed out waiting for an upstream slot")
+)
+
+// Admission caps the asks forwarded to AISHE at once. Requests beyond the
+// cap wait in a bounded FIFO queue for at most QueueTimeout; a freed slot
+// goes to the longest waiting request, and newcomers only get one directly
+// when no one is waiting. Requests that find the queue full are rejected
+// at once so an overloaded AISHE server is not buried under asks that
+// would time out anyway. A nil Admission admits everything.
+type Admission struct {
+	MaxConcurrent int
+	MaxQueue      int
+	QueueTimeout  time.Duration
+	Metrics       *Metrics // nil records nothing
+
+	mu      sync.Mutex
+	inUse   int           // Slots held
+	queue   *list.List    // Channels of the waiting asks, closed to hand them a slot
+	average time.Duration // Moving average of the time an ask holds a slot
+}
+
+// NewAdmission creates an admission gate allowing maxConcurrent asks at
+// once and maxQueue waiting ones. It returns nil when maxConcurrent is 0.
+func NewAdmission(maxConcurrent, maxQueue int, queueTimeout time.Duration, metrics *Metrics) *Admission {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &Admission{
+		MaxConcurrent: maxConcurrent,
+		MaxQueue:      maxQueue,
+		QueueTimeout:  queueTimeout,
+		Metrics:       metrics,
+		queue:         list.New(),
+	}
+}
+
+// loadAdmissionLimits reads the admission limits from PROXY_MAX_CONCURRENT,
+// PROXY_MAX_QUEUE and PROXY_QUEUE_TIMEOUT (defaults: 4 asks, 16 waiting,
+// 30s). A concurrency of 0 disables admission control.
+func loadAdmissionLimits() (int, int, time.Duration, error) {
+	maxConcurrent, maxQueue := 4, 16
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{{"PROXY_MAX_CONCURRENT", &maxConcurrent}, {"PROXY_MAX_QUEUE", &maxQueue}} {
+		if valueStr := os.Getenv(setting.name); valueStr != "" {
+			parsed, err := strconv.Atoi(valueStr)
+			if err != nil || parsed < 0 {
+				return 0, 0, 0, fmt.Errorf("invalid %s %q (expected a non-negative integer)", setting.name, valueStr)
+			}
+			*setting.value = parsed
+		}
+	}
+
+	queueTimeout := 30 * time.Second
+	if timeoutStr := os.Getenv("PROXY_QUEUE_TIMEOUT"); timeoutStr != "" {
+		parsed, err := time.ParseDuration(timeoutStr)
+		if err != nil || parsed <= 0 {
+			return 0, 0, 0, fmt.Errorf("invalid PROXY_QUEUE_TIMEOUT %q (expected a duration like 30s)", timeoutStr)
+		}
+		queueTimeout = parsed
+	}
+	return maxConcurrent, maxQueue, queueTimeout, nil
+}
+
+// Acquire waits for an upstream slot. It returns errQueueFull when the
+// queue is full, errQueueTimeout when no slot freed up in time, or the
+// context's error when the client went away. The returned function frees
+// the slot.
+func (a *Admission) Acquire(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	a.mu.Lock()
+	if a.inUse < a.MaxConcurrent && a.queue.Len() == 0 {
+		a.inUse++
+		a.mu.Unlock()
+		return a.admit(0), nil
+	}
+	if a.queue.Len() >= a.MaxQueue {
+		a.mu.Unlock()
+		a.Metrics.ObserveShed(errQueueFull)
+		return nil, errQueueFull
+	}
+	ready := make(chan struct{})
+	waiter := a.queue.PushBack(ready)
+	a.Metrics.SetQueueDepth(a.queue.Len())
+	a.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(a.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return a.admit(time.Since(start)), nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	select {
+	case <-ready:
+		// The slot was handed over while giving up, so pass it on
+		a.releaseLocked()
+	default:
+		a.queue.Remove(waiter)
+		a.Metrics.SetQueueDepth(a.queue.Len())
+	}
+	a.mu.Unlock()
+	a.Metrics.ObserveShed(err)
+	return nil, err
+}
+
+// releaseLocked hands a freed slot to the longest waiting ask, or returns
+// it to the pool when no one is waiting. Callers must hold a.mu.
+func (a *Admission) releaseLocked() {
+	front := a.queue.Front()
+	if front == nil {
+		a.inUse--
+		return
+	}
+	a.queue.Remove(front)
+	a.Metrics.SetQueueDepth(a.queue.Len())
+	close(front.Value.(chan struct{}))
+}
+
+// admit records an ask that got a slot after waiting and returns the
+// function releasing it
+func (a *Admission) admit(waited time.Duration) func() {
+	a.Metrics.ObserveQueueWait(waited)
+	a.Metrics.AddUpstreamInFlight(1)
+	start := time.Now()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			held := time.Since(start)
+			a.Metrics.AddUpstreamInFlight(-1)
+
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.average == 0 {
+				a.average = held
+			} else {
+				a.average = (a.average*4 + held) / 5
+			}
+			a.releaseLocked()
+		})
+	}
+}
+
+// RetryAfter estimates when a shed request is worth retrying: the time
+// the queue ahead of it needs to drain at the recent pace, at least a second
+func (a *Admission) RetryAfter() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	estimate := a.average * time.Duration(a.queue.Len()+1) / time.Duration(a.MaxConcurrent)
+	seconds := math.Max(1, math.Ceil(estimate.Seconds()))
+	return time.Duration(seconds) * time.Second
+}
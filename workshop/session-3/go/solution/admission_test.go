@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForQueue waits until n asks are queued
+func waitForQueue(t *testing.T, a *Admission, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		a.mu.Lock()
+		waiting := a.queue.Len()
+		a.mu.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("queue never reached %d waiting asks", n)
+}
+
+// acquireAsync acquires a slot in the background and returns the channel
+// its result arrives on
+func acquireAsync(ctx context.Context, a *Admission) chan error {
+	result := make(chan error, 1)
+	go func() {
+		release, err := a.Acquire(ctx)
+		if err == nil {
+			release()
+		}
+		result <- err
+	}()
+	return result
+}
+
+func TestAdmissionQueueFull(t *testing.T) {
+	a := NewAdmission(1, 1, time.Minute, nil)
+	release, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	queued := acquireAsync(context.Background(), a)
+	waitForQueue(t, a, 1)
+
+	if _, err := a.Acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Errorf("Acquire with a full queue: err = %v, want errQueueFull", err)
+	}
+	if retryAfter := a.RetryAfter(); retryAfter < time.Second {
+		t.Errorf("RetryAfter = %s, want at least 1s", retryAfter)
+	}
+
+	// Freeing the slot admits the queued ask
+	release()
+	release() // Releasing twice frees the slot once
+	if err := <-queued; err != nil {
+		t.Errorf("queued Acquire: %v", err)
+	}
+	if a.inUse != 0 {
+		t.Errorf("%d slots held after every ask finished, want 0", a.inUse)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	a := NewAdmission(1, 4, 20*time.Millisecond, nil)
+	release, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer release()
+
+	start := time.Now()
+	if _, err := a.Acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("Acquire: err = %v, want errQueueTimeout", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Acquire gave up after %s, want the 20ms queue timeout", waited)
+	}
+	waitForQueue(t, a, 0)
+}
+
+func TestAdmissionClientGone(t *testing.T) {
+	a := NewAdmission(1, 4, time.Minute, nil)
+	release, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := acquireAsync(ctx, a)
+	waitForQueue(t, a, 1)
+	cancel()
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled Acquire: err = %v, want context.Canceled", err)
+	}
+
+	// The canceled ask left the queue without taking the slot
+	waitForQueue(t, a, 0)
+	release()
+	release, err = a.Acquire(context.Background())
+	if err != nil || a.inUse != 1 {
+		t.Fatalf("Acquire after the cancel = %v with %d slots held, want the free slot", err, a.inUse)
+	}
+	release()
+}
+
+func TestAdmissionFIFO(t *testing.T) {
+	a := NewAdmission(1, 4, time.Minute, nil)
+	release, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// Each queued ask reports its turn and holds the slot until let go
+	admitted := make(chan string, 2)
+	letGo := make(chan struct{})
+	for i, name := range []string{"first", "second"} {
+		go func(name string) {
+			release, err := a.Acquire(context.Background())
+			if err != nil {
+				admitted <- err.Error()
+				return
+			}
+			admitted <- name
+			<-letGo
+			release()
+		}(name)
+		waitForQueue(t, a, i+1)
+	}
+
+	// The freed slot goes to the first waiter, not to a newcomer
+	release()
+	if name := <-admitted; name != "first" {
+		t.Errorf("first admitted: %s, want first", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("newcomer Acquire: err = %v, want it to wait behind the queue", err)
+	}
+	close(letGo)
+	if name := <-admitted; name != "second" {
+		t.Errorf("second admitted: %s, want second", name)
+	}
+}
+
+// newBlockingAISHE starts an AISHE server holding every ask until release
+// is closed. It signals each ask on arrived and each ask the proxy gave up
+// on on canceled.
+func newBlockingAISHE(t *testing.T, release chan struct{}) (*httptest.Server, chan struct{}, chan struct{}) {
+	t.Helper()
+
+	arrived, canceled := make(chan struct{}, 8), make(chan struct{}, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // So the server notices the proxy hanging up
+		arrived <- struct{}{}
+		select {
+		case <-release:
+			writeJSON(w, http.StatusOK, stubAnswer)
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return server, arrived, canceled
+}
+
+// askProxy posts a question to the proxy's ask endpoint
+func askProxy(ctx context.Context, proxyURL, question string) (*http.Response, error) {
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxyURL+"/api/v1/ask",
+		strings.NewReader(`{"question": "`+question+`"}`))
+	return http.DefaultClient.Do(request)
+}
+
+func TestProxyShedsWhenQueueFull(t *testing.T) {
+	upstream, arrived, _ := newBlockingAISHE(t, make(chan struct{}))
+	proxy := newTestProxyServer(t, upstream.URL)
+	proxy.Admission = NewAdmission(1, 0, time.Minute, nil)
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go askProxy(ctx, server.URL, "What is the capital of France?")
+	<-arrived
+
+	resp, err := askProxy(context.Background(), server.URL, "How do volcanoes form?")
+	if err != nil {
+		t.Fatalf("asking proxy: %v", err)
+	}
+	resp.Body.Close()
+	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if resp.StatusCode != http.StatusServiceUnavailable || retryAfter < 1 {
+		t.Errorf("ask with a full queue = %d with Retry-After %q, want 503 with at least 1",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestProxyClientGone(t *testing.T) {
+	upstream, arrived, canceled := newBlockingAISHE(t, make(chan struct{}))
+	proxy := newTestProxyServer(t, upstream.URL)
+	proxy.Admission = NewAdmission(1, 1, time.Minute, nil)
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	// The first ask holds the slot and the second waits for it
+	forwarded, cancelForwarded := context.WithCancel(context.Background())
+	defer cancelForwarded()
+	go askProxy(forwarded, server.URL, "What is the capital of France?")
+	<-arrived
+	queued, cancelQueued := context.WithCancel(context.Background())
+	go askProxy(queued, server.URL, "How do volcanoes form?")
+	waitForQueue(t, proxy.Admission, 1)
+
+	// A client leaving the queue frees its place
+	cancelQueued()
+	waitForQueue(t, proxy.Admission, 0)
+
+	// A client leaving while its ask is forwarded cancels the upstream
+	// request and frees the slot
+	cancelForwarded()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not canceled")
+	}
+	release, err := proxy.Admission.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire after both clients left: %v", err)
+	}
+	release()
+}
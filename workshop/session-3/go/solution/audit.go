@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Audit outcomes recorded for every ask
+const (
+	OutcomeExactHit    = "exact_hit"
+	OutcomeSemanticHit = "semantic_hit"
+	OutcomeAPI         = "api"
+	OutcomeError       = "error"
+)
+
+// AuditEntry represents a single ask recorded in the audit stream
+type AuditEntry struct {
+	ID           string
+	Timestamp    time.Time
+	Question     string
+	Key          string
+	Outcome      string
+	Similarity   *float64
+	CacheLatency time.Duration
+	APILatency   time.Duration
+	TotalLatency time.Duration
+	Sources      []string
+	Error        string
+	Client       string // Proxy client that asked, if authenticated
+}
+
+// AuditLog appends ask outcomes to a capped Redis Stream
+type AuditLog struct {
+	Client *redis.Client
+	Stream string
+	MaxLen int64
+}
+
+// NewAuditLog creates an audit log using AUDIT_STREAM and AUDIT_MAXLEN
+// from the environment (defaults: aishe:audit, 10000 entries)
+func NewAuditLog(client *redis.Client) (*AuditLog, error) {
+	stream := os.Getenv("AUDIT_STREAM")
+	if stream == "" {
+		stream = "aishe:audit"
+	}
+
+	maxLen := int64(10000)
+	if maxLenStr := os.Getenv("AUDIT_MAXLEN"); maxLenStr != "" {
+		parsed, err := strconv.ParseInt(maxLenStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid AUDIT_MAXLEN %q (expected a positive integer)", maxLenStr)
+		}
+		maxLen = parsed
+	}
+
+	return &AuditLog{
+		Client: client,
+		Stream: stream,
+		MaxLen: maxLen,
+	}, nil
+}
+
+// Record appends an entry to the stream. Failures are reported as warnings
+// because auditing must never break an ask. A nil log records nothing.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+
+	sources, _ := json.Marshal(entry.Sources)
+	values := map[string]interface{}{
+		"timestamp":        entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		"question":         entry.Question,
+		"key":              entry.Key,
+		"outcome":          entry.Outcome,
+		"cache_latency_ms": entry.CacheLatency.Milliseconds(),
+		"api_latency_ms":   entry.APILatency.Milliseconds(),
+		"total_latency_ms": entry.TotalLatency.Milliseconds(),
+		"sources":          string(sources),
+	}
+	if entry.Similarity != nil {
+		values["similarity"] = strconv.FormatFloat(*entry.Similarity, 'f', 4, 64)
+	}
+	if entry.Error != "" {
+		values["error"] = entry.Error
+	}
+	if entry.Client != "" {
+		values["client"] = entry.Client
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := a.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: a.Stream,
+		MaxLen: a.MaxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+	if err != nil {
+		fmt.Printf("Warning: Error writing audit log: %v\n", err)
+	}
+}
+
+// Query returns entries between since and until, optionally filtered by outcome
+func (a *AuditLog) Query(ctx context.Context, since, until time.Time, outcome string, limit int64) ([]AuditEntry, error) {
+	start, end := "-", "+"
+	if !since.IsZero() {
+		start = strconv.FormatInt(since.UnixMilli(), 10)
+	}
+	if !until.IsZero() {
+		end = strconv.FormatInt(until.UnixMilli(), 10)
+	}
+
+	messages, err := a.Client.XRange(ctx, a.Stream, start, end).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	for _, message := range messages {
+		entry := parseAuditMessage(message)
+		if outcome != "" && entry.Outcome != outcome {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	// Keep only the most recent entries when a limit is set
+	if limit > 0 && int64(len(entries)) > limit {
+		entries = entries[int64(len(entries))-limit:]
+	}
+
+	return entries, nil
+}
+
+// Tail follows the stream and calls fn for each new entry until ctx is done
+func (a *AuditLog) Tail(ctx context.Context, fn func(AuditEntry)) error {
+	lastID := "$"
+	for {
+		streams, err := a.Client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{a.Stream, lastID},
+			Block:   5 * time.Second,
+		}).Result()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				fn(parseAuditMessage(message))
+				lastID = message.ID
+			}
+		}
+	}
+}
+
+// parseAuditMessage converts a stream message back into an AuditEntry
+func parseAuditMessage(message redis.XMessage) AuditEntry {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+	millis := func(name string) time.Duration {
+		ms, _ := strconv.ParseInt(field(name), 10, 64)
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	entry := AuditEntry{
+		ID:           message.ID,
+		Question:     field("question"),
+		Key:          field("key"),
+		Outcome:      field("outcome"),
+		CacheLatency: millis("cache_latency_ms"),
+		APILatency:   millis("api_latency_ms"),
+		TotalLatency: millis("total_latency_ms"),
+		Error:        field("error"),
+		Client:       field("client"),
+	}
+	entry.Timestamp, _ = time.Parse(time.RFC3339Nano, field("timestamp"))
+	if similarity, err := strconv.ParseFloat(field("similarity"), 64); err == nil {
+		entry.Similarity = &similarity
+	}
+	_ = json.Unmarshal([]byte(field("sources")), &entry.Sources)
+
+	return entry
+}
+
+// printAuditEntry prints a single audit entry on one line
+func printAuditEntry(entry AuditEntry) {
+	outcome := entry.Outcome
+	if entry.Similarity != nil {
+		outcome = fmt.Sprintf("%s (%.4f)", outcome, *entry.Similarity)
+	}
+
+	fmt.Printf("%s  %-22s cache=%dms api=%dms total=%dms  %s\n",
+		entry.Timestamp.Local().Format("2006-01-02 15:04:05"),
+		outcome,
+		entry.CacheLatency.Milliseconds(),
+		entry.APILatency.Milliseconds(),
+		entry.TotalLatency.Milliseconds(),
+		entry.Question,
+	)
+	if entry.Client != "" {
+		fmt.Printf("    client: %s\n", entry.Client)
+	}
+	if len(entry.Sources) > 0 {
+		fmt.Printf("    sources: %s\n", strings.Join(entry.Sources, "; "))
+	}
+	if entry.Error != "" {
+		fmt.Printf("    error: %s\n", entry.Error)
+	}
+}
+
+// parseAuditTime accepts either a duration relative to now (e.g. 1h) or an RFC3339 timestamp
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runAudit implements the "audit tail" and "audit query" commands
+func runAudit(args []string) {
+	if len(args) < 1 || (args[0] != "tail" && args[0] != "query") {
+		fmt.Println("Usage: go run . audit tail")
+		fmt.Println("       go run . audit query [--since 1h] [--until 2006-01-02T15:04:05Z] [--outcome api] [--limit 50]")
+		os.Exit(1)
+	}
+
+	rdb := newRedisClient()
+	if rdb == nil {
+		fmt.Println("Error: Could not connect to Redis (set REDIS_ADDR)")
+		os.Exit(1)
+	}
+	defer rdb.Close()
+	audit, err := NewAuditLog(rdb)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "tail":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		fmt.Printf("Following %s (Ctrl+C to stop)...\n", audit.Stream)
+		if err := audit.Tail(ctx, printAuditEntry); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "query":
+		fs := flag.NewFlagSet("audit query", flag.ExitOnError)
+		sinceStr := fs.String("since", "", "start of the range (duration like 1h or RFC3339 time)")
+		untilStr := fs.String("until", "", "end of the range (duration like 10m or RFC3339 time)")
+		outcome := fs.String("outcome", "", "only show this outcome (exact_hit, semantic_hit, api, error)")
+		limit := fs.Int64("limit", 0, "show at most this many of the most recent entries")
+		fs.Parse(args[1:])
+
+		since, err := parseAuditTime(*sinceStr)
+		if err != nil {
+			fmt.Printf("Error: invalid --since: %v\n", err)
+			os.Exit(1)
+		}
+		until, err := parseAuditTime(*untilStr)
+		if err != nil {
+			fmt.Printf("Error: invalid --until: %v\n", err)
+			os.Exit(1)
+		}
+
+		entries, err := audit.Query(context.Background(), since, until, *outcome, *limit)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			printAuditEntry(entry)
+		}
+		fmt.Printf("\n%d entries\n", len(entries))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNewAuditLog(t *testing.T) {
+	tests := []struct {
+		maxLen string
+		want   int64
+		err    bool
+	}{
+		{"", 10000, false},
+		{"500", 500, false},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUDIT_MAXLEN", tt.maxLen)
+		audit, err := NewAuditLog(nil)
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), "AUDIT_MAXLEN") {
+				t.Errorf("AUDIT_MAXLEN=%q: err = %v, want it rejected", tt.maxLen, err)
+			}
+			continue
+		}
+		if err != nil || audit.MaxLen != tt.want || audit.Stream != "aishe:audit" {
+			t.Errorf("AUDIT_MAXLEN=%q: NewAuditLog = %+v, %v; want MaxLen %d", tt.maxLen, audit, err, tt.want)
+		}
+	}
+}
+
+func TestParseAuditMessage(t *testing.T) {
+	// Missing or malformed fields are left empty
+	entry := parseAuditMessage(redis.XMessage{
+		ID: "1-0",
+		Values: map[string]interface{}{
+			"question":         "What is the capital of France?",
+			"outcome":          OutcomeAPI,
+			"timestamp":        "yesterday",
+			"total_latency_ms": "slow",
+			"similarity":       "",
+			"sources":          "not json",
+		},
+	})
+	want := AuditEntry{ID: "1-0", Question: "What is the capital of France?", Outcome: OutcomeAPI}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("parseAuditMessage = %+v, want %+v", entry, want)
+	}
+}
+
+func TestAuditRoundTrip(t *testing.T) {
+	rdb := newTestRedis(t)
+	audit := &AuditLog{Client: rdb, Stream: "aishe:test:audit:" + testID(t), MaxLen: 100}
+	t.Cleanup(func() { rdb.Del(context.Background(), audit.Stream) })
+
+	similarity := 0.9123
+	recorded := AuditEntry{
+		Timestamp:    time.Date(2026, 10, 18, 9, 30, 0, 123000000, time.UTC),
+		Question:     "What is the capital of France?",
+		Key:          getCacheKey("What is the capital of France?"),
+		Outcome:      OutcomeSemanticHit,
+		Similarity:   &similarity,
+		CacheLatency: 12 * time.Millisecond,
+		APILatency:   0,
+		TotalLatency: 15 * time.Millisecond,
+		Sources:      []string{"Paris", "France"},
+		Error:        "",
+		Client:       "alice",
+	}
+	audit.Record(recorded)
+
+	entries, err := audit.Query(context.Background(), time.Time{}, time.Time{}, "", 0)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Query = %d entries, %v; want 1", len(entries), err)
+	}
+	got := entries[0]
+	if got.ID == "" {
+		t.Error("entry read back without its stream ID")
+	}
+	recorded.ID = got.ID
+	if !got.Timestamp.Equal(recorded.Timestamp) {
+		t.Errorf("timestamp read back as %s, want %s", got.Timestamp, recorded.Timestamp)
+	}
+	got.Timestamp = recorded.Timestamp
+	if !reflect.DeepEqual(got, recorded) {
+		t.Errorf("entry read back as %+v, want %+v", got, recorded)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	rdb := newTestRedis(t)
+	audit := &AuditLog{Client: rdb, Stream: "aishe:test:audit:" + testID(t), MaxLen: 100}
+	t.Cleanup(func() { rdb.Del(context.Background(), audit.Stream) })
+	ctx := context.Background()
+
+	// The range applies to the stream IDs, the time each ask was recorded
+	record := func(question, outcome string) {
+		audit.Record(AuditEntry{Timestamp: time.Now(), Question: question, Outcome: outcome})
+		time.Sleep(5 * time.Millisecond)
+	}
+	record("first", OutcomeAPI)
+	record("second", OutcomeExactHit)
+	middle := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	record("third", OutcomeAPI)
+	record("fourth", OutcomeError)
+
+	tests := []struct {
+		name         string
+		since, until time.Time
+		outcome      string
+		limit        int64
+		want         string
+	}{
+		{"everything", time.Time{}, time.Time{}, "", 0, "first second third fourth"},
+		{"since", middle, time.Time{}, "", 0, "third fourth"},
+		{"until", time.Time{}, middle, "", 0, "first second"},
+		{"outcome", time.Time{}, time.Time{}, OutcomeAPI, 0, "first third"},
+		{"limit keeps the most recent", time.Time{}, time.Time{}, "", 3, "second third fourth"},
+		{"limit after the filter", time.Time{}, time.Time{}, OutcomeAPI, 1, "third"},
+		{"limit above the count", middle, time.Time{}, "", 10, "third fourth"},
+		{"no match", time.Time{}, time.Time{}, OutcomeSemanticHit, 0, ""},
+	}
+	for _, tt := range tests {
+		entries, err := audit.Query(ctx, tt.since, tt.until, tt.outcome, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tt.name, err)
+		}
+		var questions []string
+		for _, entry := range entries {
+			questions = append(questions, entry.Question)
+		}
+		if got := strings.Join(questions, " "); got != tt.want {
+			t.Errorf("%s: Query = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAuditTime(t *testing.T) {
+	if got, err := parseAuditTime(""); err != nil || !got.IsZero() {
+		t.Errorf("parseAuditTime(\"\") = %s, %v; want the zero time", got, err)
+	}
+
+	// Durations count back from now
+	before := time.Now()
+	got, err := parseAuditTime("90m")
+	if err != nil || got.Before(before.Add(-90*time.Minute)) || got.After(time.Now().Add(-90*time.Minute)) {
+		t.Errorf("parseAuditTime(90m) = %s, %v; want 90 minutes ago", got, err)
+	}
+
+	want := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	if got, err := parseAuditTime("2026-10-18T11:30:00+02:00"); err != nil || !got.Equal(want) {
+		t.Errorf("parseAuditTime(RFC3339) = %s, %v; want %s", got, err, want)
+	}
+
+	for _, value := range []string{"yesterday", "2026-10-18", "10"} {
+		if _, err := parseAuditTime(value); err == nil {
+			t.Errorf("parseAuditTime(%q) succeeded, want an error", value)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimit is a token bucket: Burst requests at once, refilled at
+// Requests per Per
+type rateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// String formats the limit the way parseRateLimit reads it
+func (l rateLimit) String() string {
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[l.Per]
+	return fmt.Sprintf("%d/%s, burst %d", l.Requests, unit, l.Burst)
+}
+
+// parseRateLimit parses a limit like "60/m" (per second, minute or hour).
+// The burst defaults to the number of requests.
+func parseRateLimit(value string) (rateLimit, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(value), "/")
+	requests, err := strconv.Atoi(count)
+	if !ok || err != nil || requests <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q (expected requests per s, m or h, like 60/m)", value)
+	}
+
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q (expected requests per s, m or h, like 60/m)", value)
+	}
+	return rateLimit{Requests: requests, Per: per, Burst: requests}, nil
+}
+
+// proxyClient is a client of the proxy identified by its API key
+type proxyClient struct {
+	Name  string
+	Limit *rateLimit // nil uses the default limit
+}
+
+// parseClient parses the description of a key: "name [rate [burst]]"
+func parseClient(value string) (proxyClient, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 3 {
+		return proxyClient{}, fmt.Errorf("expected \"name [rate [burst]]\", got %q", value)
+	}
+
+	client := proxyClient{Name: fields[0]}
+	if len(fields) > 1 {
+		limit, err := parseRateLimit(fields[1])
+		if err != nil {
+			return proxyClient{}, err
+		}
+		if len(fields) > 2 {
+			limit.Burst, err = strconv.Atoi(fields[2])
+			if err != nil || limit.Burst <= 0 {
+				return proxyClient{}, fmt.Errorf("invalid burst %q (expected a positive integer)", fields[2])
+			}
+		}
+		client.Limit = &limit
+	}
+	return client, nil
+}
+
+// KeyStore finds the client an API key belongs to
+type KeyStore interface {
+	// Lookup returns nil when the key is unknown
+	Lookup(ctx context.Context, key string) (*proxyClient, error)
+}
+
+// fileKeyStore holds the keys read from a file at startup
+type fileKeyStore map[string]proxyClient
+
+// loadKeyFile reads one key per line as "key name [rate [burst]]".
+// Blank lines and lines starting with # are ignored.
+func loadKeyFile(path string) (fileKeyStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(fileKeyStore)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		client, err := parseClient(strings.Join(fields[1:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		keys[fields[0]] = client
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no API keys", path)
+	}
+	return keys, nil
+}
+
+func (s fileKeyStore) Lookup(ctx context.Context, key string) (*proxyClient, error) {
+	client, ok := s[key]
+	if !ok {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+// redisKeyStore looks keys up in a Redis hash mapping each key to
+// "name [rate [burst]]", so keys can be added and revoked while the
+// proxies run
+type redisKeyStore struct {
+	Client *redis.Client
+	Key    string
+}
+
+func (s redisKeyStore) Lookup(ctx context.Context, key string) (*proxyClient, error) {
+	value, err := s.Client.HGet(ctx, s.Key, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := parseClient(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API key entry in %s: %w", s.Key, err)
+	}
+	return &client, nil
+}
+
+// tokenBucketScript takes a token from the bucket of a client, refilling
+// it for the time since the last request. Redis' clock is used so replicas
+// with skewed clocks share the same buckets. It returns whether the
+// request is allowed, how many milliseconds to wait otherwise, and the
+// tokens left.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, wait, math.floor(tokens)}
+`)
+
+// Limiter applies per-client rate limits
+type Limiter interface {
+	// Allow takes a token from the client's bucket and returns the tokens
+	// left. When none is left it returns false and how long until the next one.
+	Allow(ctx context.Context, client string, limit rateLimit) (bool, time.Duration, int, error)
+}
+
+// RateLimiter keeps a token bucket per client in Redis, so the limits hold
+// across proxy replicas
+type RateLimiter struct {
+	Client *redis.Client
+	Prefix string
+}
+
+// Allow takes a token from the client's bucket in Redis
+func (l *RateLimiter) Allow(ctx context.Context, client string, limit rateLimit) (bool, time.Duration, int, error) {
+	perMillisecond := float64(limit.Requests) / float64(limit.Per.Milliseconds())
+	result, err := tokenBucketScript.Run(ctx, l.Client, []string{l.Prefix + client},
+		strconv.FormatFloat(perMillisecond, 'g', -1, 64), limit.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if len(result) != 3 {
+		return false, 0, 0, fmt.Errorf("unexpected token bucket reply %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, int(result[2]), nil
+}
+
+// ProxyAuth authenticates proxy requests by API key, applies each
+// client's rate limit and counts usage per client
+type ProxyAuth struct {
+	Keys    KeyStore
+	Limiter Limiter    // nil disables rate limiting
+	Limit   rateLimit  // Of clients without a limit of their own
+	Usage   *TierStats // nil counts nothing
+	Metrics *Metrics   // nil records nothing
+}
+
+// Counters kept per client in the usage hash, besides the audit outcomes
+const (
+	usageRequests    = "requests"
+	usageRateLimited = "rate_limited"
+)
+
+// CountUsage adds one to a client's counter. A nil ProxyAuth counts nothing.
+func (a *ProxyAuth) CountUsage(client, counter string) {
+	if a == nil || client == "" {
+		return
+	}
+	a.Usage.Incr(client + ":" + counter)
+}
+
+// loadProxyAuth sets up authentication as selected by PROXY_AUTH: "none"
+// (default), "file" for the keys in PROXY_KEYS_FILE (default:
+// proxy-keys.txt), or "redis" for the hash PROXY_KEYS_KEY (default:
+// aishe:proxy:keys). Clients are limited to PROXY_RATE_LIMIT (default:
+// 60/m, "off" disables) with bursts of PROXY_RATE_BURST (default: the rate's
+// request count); limits and usage counters are kept in rdb. It returns
+// nil when authentication is off.
+func loadProxyAuth(rdb *redis.Client, metrics *Metrics) (*ProxyAuth, error) {
+	auth := &ProxyAuth{Metrics: metrics}
+	switch mode := os.Getenv("PROXY_AUTH"); mode {
+	case "", "none":
+		return nil, nil
+	case "file":
+		keys, err := loadKeyFile(getEnvDefault("PROXY_KEYS_FILE", "proxy-keys.txt"))
+		if err != nil {
+			return nil, fmt.Errorf("loading API keys: %w", err)
+		}
+		auth.Keys = keys
+	case "redis":
+		if rdb == nil {
+			return nil, fmt.Errorf("PROXY_AUTH=redis needs Redis (set REDIS_ADDR)")
+		}
+		auth.Keys = redisKeyStore{Client: rdb, Key: getEnvDefault("PROXY_KEYS_KEY", "aishe:proxy:keys")}
+	default:
+		return nil, fmt.Errorf("unknown PROXY_AUTH %q (expected none, file or redis)", mode)
+	}
+
+	if rdb != nil {
+		auth.Usage = &TierStats{Client: rdb, Key: getEnvDefault("PROXY_USAGE_KEY", "aishe:proxy:usage")}
+	}
+
+	rate := getEnvDefault("PROXY_RATE_LIMIT", "60/m")
+	if rate == "off" {
+		return auth, nil
+	}
+	limit, err := parseRateLimit(rate)
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_RATE_LIMIT: %w", err)
+	}
+	if burstStr := os.Getenv("PROXY_RATE_BURST"); burstStr != "" {
+		limit.Burst, err = strconv.Atoi(burstStr)
+		if err != nil || limit.Burst <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_RATE_BURST %q (expected a positive integer)", burstStr)
+		}
+	}
+	if rdb == nil {
+		return nil, fmt.Errorf("rate limits are kept in Redis (set REDIS_ADDR, or PROXY_RATE_LIMIT=off)")
+	}
+	auth.Limiter = &RateLimiter{Client: rdb, Prefix: "aishe:proxy:bucket:"}
+	auth.Limit = limit
+	return auth, nil
+}
+
+// requestKey returns the API key sent as "Authorization: Bearer <key>" or
+// in the X-API-Key header
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// clientContextKey is the context key of the authenticated client's name
+type clientContextKey struct{}
+
+// requestClient returns the name of the client that sent the request, or
+// "" when authentication is off
+func requestClient(r *http.Request) string {
+	client, _ := r.Context().Value(clientContextKey{}).(string)
+	return client
+}
+
+// Wrap rejects requests without a valid API key with 401 and requests over
+// the client's rate limit with 429. A nil ProxyAuth lets every request
+// through.
+func (a *ProxyAuth) Wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aishe"`)
+			writeDetail(w, http.StatusUnauthorized, "missing API key (send Authorization: Bearer <key>)")
+			return
+		}
+		client, err := a.Keys.Lookup(r.Context(), key)
+		if err != nil {
+			a.Metrics.BackendError("redis", "auth", err)
+			log.Printf("API key lookup error: %v", err)
+			writeDetail(w, http.StatusServiceUnavailable, "API keys are unavailable")
+			return
+		}
+		if client == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aishe", error="invalid_token"`)
+			writeDetail(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		a.CountUsage(client.Name, usageRequests)
+
+		if a.Limiter != nil {
+			limit := a.Limit
+			if client.Limit != nil {
+				limit = *client.Limit
+			}
+			allowed, wait, remaining, err := a.Limiter.Allow(r.Context(), client.Name, limit)
+			switch {
+			case err != nil:
+				// Better to serve unlimited than to fail every request
+				a.Metrics.BackendError("redis", "rate_limit", err)
+				log.Printf("rate limit check failed, allowing request: %v", err)
+			case !allowed:
+				a.CountUsage(client.Name, usageRateLimited)
+				a.Metrics.ObserveClient(client.Name, usageRateLimited)
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				writeDetail(w, http.StatusTooManyRequests,
+					fmt.Sprintf("rate limit of %s exceeded for %s, retry in %ds", limit, client.Name, retryAfter))
+				return
+			default:
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			}
+		}
+
+		a.Metrics.ObserveClient(client.Name, "allowed")
+		ctx := context.WithValue(r.Context(), clientContextKey{}, client.Name)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// printClientUsage prints the usage counters of each proxy client
+func printClientUsage(key string, counters map[string]int64) {
+	usage := make(map[string]map[string]int64)
+	var clients []string
+	for name, value := range counters {
+		// Client names may contain colons, counter names do not
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			continue
+		}
+		client, counter := name[:i], name[i+1:]
+		if usage[client] == nil {
+			usage[client] = make(map[string]int64)
+			clients = append(clients, client)
+		}
+		usage[client][counter] = value
+	}
+	sort.Strings(clients)
+
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("PROXY CLIENTS (%s)\n", key)
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("%-20s %9s %8s %8s %8s %8s %6s\n", "Client", "Requests", "Limited", "Exact", "Semantic", "API", "Errors")
+	for _, client := range clients {
+		c := usage[client]
+		fmt.Printf("%-20s %9d %8d %8d %8d %8d %6d\n", client, c[usageRequests], c[usageRateLimited],
+			c[OutcomeExactHit], c[OutcomeSemanticHit], c[OutcomeAPI], c[OutcomeError])
+	}
+	fmt.Println(strings.Repeat("=", 70))
+}
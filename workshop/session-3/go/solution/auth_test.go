@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := map[string]rateLimit{
+		"60/m":   {Requests: 60, Per: time.Minute, Burst: 60},
+		" 5/s ":  {Requests: 5, Per: time.Second, Burst: 5},
+		"1000/h": {Requests: 1000, Per: time.Hour, Burst: 1000},
+	}
+	for value, want := range tests {
+		if got, err := parseRateLimit(value); err != nil || got != want {
+			t.Errorf("parseRateLimit(%q) = %+v, %v; want %+v", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "60", "60/", "60/d", "0/m", "-1/m", "many/m", "60/min"} {
+		if _, err := parseRateLimit(value); err == nil {
+			t.Errorf("parseRateLimit(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	client, err := parseClient("alice")
+	if err != nil || client.Name != "alice" || client.Limit != nil {
+		t.Errorf("parseClient(alice) = %+v, %v; want the default limit", client, err)
+	}
+
+	client, err = parseClient("  bob\t10/s  ")
+	if err != nil || client.Name != "bob" || client.Limit == nil || *client.Limit != (rateLimit{10, time.Second, 10}) {
+		t.Errorf("parseClient(bob 10/s) = %+v, %v", client, err)
+	}
+
+	client, err = parseClient("carol 10/s 50")
+	if err != nil || client.Limit == nil || client.Limit.Burst != 50 {
+		t.Errorf("parseClient(carol 10/s 50) = %+v, %v; want burst 50", client, err)
+	}
+
+	for _, value := range []string{"", "   ", "dave 10/x", "dave 10/s 0", "dave 10/s lots", "dave 10/s 5 extra"} {
+		if _, err := parseClient(value); err == nil {
+			t.Errorf("parseClient(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+// writeKeyFile writes a key file into a temporary directory
+func writeKeyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy-keys.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing key file: %v", err)
+	}
+	return path
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	path := writeKeyFile(t, `# key name [rate [burst]]
+
+key-alice alice
+key-bob	bob   10/s
+  key-carol  carol 10/s 50
+`)
+	keys, err := loadKeyFile(path)
+	if err != nil {
+		t.Fatalf("loadKeyFile: %v", err)
+	}
+	if len(keys) != 3 || keys["key-alice"].Name != "alice" || keys["key-bob"].Name != "bob" || keys["key-carol"].Limit.Burst != 50 {
+		t.Errorf("loadKeyFile = %+v", keys)
+	}
+
+	if _, err := loadKeyFile(writeKeyFile(t, "key-alice alice\nkey-bob bob 10/x\n")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("invalid line: err = %v, want it to name line 2", err)
+	}
+	if _, err := loadKeyFile(writeKeyFile(t, "key-without-name\n")); err == nil {
+		t.Error("key without a name was accepted")
+	}
+	if _, err := loadKeyFile(writeKeyFile(t, "# no keys yet\n")); err == nil {
+		t.Error("file without keys was accepted")
+	}
+	if _, err := loadKeyFile(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want not exist", err)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          string
+	}{
+		{"Authorization", "Bearer secret", "secret"},
+		{"Authorization", "bearer  secret ", "secret"},
+		{"Authorization", "Basic c2VjcmV0", ""},
+		{"Authorization", "Bearer", ""},
+		{"X-API-Key", "secret", "secret"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/ask", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := requestKey(r); got != tt.want {
+			t.Errorf("requestKey(%s: %q) = %q, want %q", tt.header, tt.value, got, tt.want)
+		}
+	}
+
+	// X-API-Key wins over Authorization
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/ask", nil)
+	r.Header.Set("Authorization", "Bearer other")
+	r.Header.Set("X-API-Key", "secret")
+	if got := requestKey(r); got != "secret" {
+		t.Errorf("requestKey with both headers = %q, want secret", got)
+	}
+}
+
+// fakeLimiter allows each client a fixed number of requests and records
+// the limits it was asked to apply
+type fakeLimiter struct {
+	allowed map[string]int
+	wait    time.Duration
+	err     error
+	limits  []rateLimit
+}
+
+func (l *fakeLimiter) Allow(ctx context.Context, client string, limit rateLimit) (bool, time.Duration, int, error) {
+	l.limits = append(l.limits, limit)
+	if l.err != nil {
+		return false, 0, 0, l.err
+	}
+	if l.allowed[client] == 0 {
+		return false, l.wait, 0, nil
+	}
+	l.allowed[client]--
+	return true, 0, l.allowed[client], nil
+}
+
+// failingKeyStore fails every lookup
+type failingKeyStore struct{}
+
+func (failingKeyStore) Lookup(ctx context.Context, key string) (*proxyClient, error) {
+	return nil, errors.New("connection refused")
+}
+
+// serveAuth sends a request with the given API key through auth and
+// returns the response and the client the wrapped handler saw
+func serveAuth(auth *ProxyAuth, key string) (*httptest.ResponseRecorder, string) {
+	client := ""
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = requestClient(r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/ask", nil)
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w, client
+}
+
+func TestWrap(t *testing.T) {
+	carolLimit := rateLimit{Requests: 10, Per: time.Second, Burst: 50}
+	limiter := &fakeLimiter{allowed: map[string]int{"alice": 2, "carol": 1}, wait: 1200 * time.Millisecond}
+	auth := &ProxyAuth{
+		Keys: fileKeyStore{
+			"key-alice": {Name: "alice"},
+			"key-carol": {Name: "carol", Limit: &carolLimit},
+		},
+		Limiter: limiter,
+		Limit:   rateLimit{Requests: 60, Per: time.Minute, Burst: 60},
+	}
+
+	w, _ := serveAuth(auth, "")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="aishe"` {
+		t.Errorf("no key: %d %q, want 401 with a challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	w, _ = serveAuth(auth, "key-mallory")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("unknown key: %d %q, want 401 invalid_token", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if len(limiter.limits) != 0 {
+		t.Errorf("requests without a valid key were rate limited")
+	}
+
+	w, client := serveAuth(auth, "key-alice")
+	if w.Code != http.StatusNoContent || client != "alice" {
+		t.Errorf("valid key: %d as %q, want 204 as alice", w.Code, client)
+	}
+	if w.Header().Get("X-RateLimit-Limit") != "60" || w.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("valid key: X-RateLimit-Limit %q, Remaining %q; want 60 and 1",
+			w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"))
+	}
+	serveAuth(auth, "key-alice")
+
+	w, client = serveAuth(auth, "key-alice")
+	if w.Code != http.StatusTooManyRequests || client != "" {
+		t.Errorf("over the limit: %d, handler reached as %q; want 429", w.Code, client)
+	}
+	if w.Header().Get("Retry-After") != "2" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("over the limit: Retry-After %q, Remaining %q; want 2 and 0",
+			w.Header().Get("Retry-After"), w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// A client's own limit replaces the default
+	limiter.limits = nil
+	if w, _ = serveAuth(auth, "key-carol"); w.Code != http.StatusNoContent || w.Header().Get("X-RateLimit-Limit") != "50" {
+		t.Errorf("own limit: %d with X-RateLimit-Limit %q, want 204 and 50", w.Code, w.Header().Get("X-RateLimit-Limit"))
+	}
+	if len(limiter.limits) != 1 || limiter.limits[0] != carolLimit {
+		t.Errorf("own limit: limiter applied %+v, want %+v", limiter.limits, carolLimit)
+	}
+
+	// Requests are let through when the limiter fails, but not when the keys are unavailable
+	limiter.err = errors.New("connection refused")
+	if w, client = serveAuth(auth, "key-alice"); w.Code != http.StatusNoContent || client != "alice" {
+		t.Errorf("limiter error: %d as %q, want 204 as alice", w.Code, client)
+	}
+	auth.Keys = failingKeyStore{}
+	if w, _ = serveAuth(auth, "key-alice"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("key store error: %d, want 503", w.Code)
+	}
+
+	// Without a limiter and without auth every request goes through
+	auth = &ProxyAuth{Keys: fileKeyStore{"key-alice": {Name: "alice"}}}
+	if w, _ = serveAuth(auth, "key-alice"); w.Code != http.StatusNoContent || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("no limiter: %d with X-RateLimit-Limit %q, want 204 and none", w.Code, w.Header().Get("X-RateLimit-Limit"))
+	}
+	if w, client = serveAuth(nil, ""); w.Code != http.StatusNoContent || client != "" {
+		t.Errorf("auth off: %d as %q, want 204 anonymously", w.Code, client)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"session3/langcache"
+	"session3/rediscache"
+	"session3/semcache"
+)
+
+// SemanticCache is a store of answers searchable by question similarity.
+// Scores range from 0 to 1 and an entry is returned when its score is at
+// least the threshold, most similar first.
+type SemanticCache interface {
+	Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error)
+	Set(ctx context.Context, prompt, response string, attributes map[string]string, ttl time.Duration) (string, error)
+	Get(ctx context.Context, entryID string) (*langcache.Entry, error)
+	Delete(ctx context.Context, entryID string) error
+	DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error)
+}
+
+// langCacheBackend adapts the LangCache SDK client to SemanticCache
+type langCacheBackend struct {
+	client *langcache.Client
+}
+
+func (b langCacheBackend) Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	resp, err := b.client.Search(ctx, prompt,
+		langcache.WithSimilarityThreshold(threshold),
+		langcache.WithSearchAttributes(attributes),
+	)
+	if err != nil {
+		return nil, langCacheHint(err, true)
+	}
+	return resp.Data, nil
+}
+
+func (b langCacheBackend) Set(ctx context.Context, prompt, response string, attributes map[string]string, ttl time.Duration) (string, error) {
+	opts := []langcache.SetOption{langcache.WithAttributes(attributes)}
+	if ttl > 0 {
+		opts = append(opts, langcache.WithTTL(ttl))
+	}
+	entryID, err := b.client.Set(ctx, prompt, response, opts...)
+	return entryID, langCacheHint(err, true)
+}
+
+func (b langCacheBackend) Get(ctx context.Context, entryID string) (*langcache.Entry, error) {
+	entry, err := b.client.GetEntry(ctx, entryID)
+	return entry, langCacheHint(err, false)
+}
+
+func (b langCacheBackend) Delete(ctx context.Context, entryID string) error {
+	// A 404 here usually means the entry is gone, not that the cache is
+	return langCacheHint(b.client.DeleteEntry(ctx, entryID), false)
+}
+
+func (b langCacheBackend) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	count, err := b.client.DeleteByAttributes(ctx, attributes)
+	return count, langCacheHint(err, true)
+}
+
+// langCacheHint adds the likely cause to LangCache errors that come from
+// bad credentials, a wrong cache ID or rate limiting. cacheWide tells
+// whether a 404 can only mean the cache itself does not exist.
+func langCacheHint(err error, cacheWide bool) error {
+	var apiErr *langcache.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, langcache.ErrUnauthorized), errors.Is(err, langcache.ErrForbidden):
+		return fmt.Errorf("%w (check API_KEY: it is wrong, expired or has no access to this cache)", err)
+	case errors.Is(err, langcache.ErrNotFound) && cacheWide:
+		return fmt.Errorf("%w (check CACHE_ID and SERVER_URL: no such cache)", err)
+	case errors.Is(err, langcache.ErrRateLimited):
+		if apiErr.RetryAfter > 0 {
+			return fmt.Errorf("%w (rate limited: LangCache asked to retry after %s)", err, apiErr.RetryAfter)
+		}
+		return fmt.Errorf("%w (rate limited: gave up after LANGCACHE_RETRIES retries)", err)
+	default:
+		return err
+	}
+}
+
+// isNotFound reports whether a backend error means the entry does not exist
+func isNotFound(err error) bool {
+	return langcache.IsNotFound(err) || errors.Is(err, semcache.ErrNotFound) || errors.Is(err, rediscache.ErrNotFound)
+}
+
+// loadEmbedder creates the embedder selected by LOCAL_EMBEDDER (default: ngram)
+func loadEmbedder() (semcache.Embedder, error) {
+	switch name := os.Getenv("LOCAL_EMBEDDER"); name {
+	case "", "ngram":
+		return semcache.NewNGramEmbedder(0), nil
+	case "ollama":
+		var opts []semcache.OllamaOption
+		if timeoutStr := os.Getenv("OLLAMA_EMBED_TIMEOUT"); timeoutStr != "" {
+			timeout, err := time.ParseDuration(timeoutStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid OLLAMA_EMBED_TIMEOUT %q: %w", timeoutStr, err)
+			}
+			opts = append(opts, semcache.WithRequestTimeout(timeout))
+		}
+		return semcache.NewOllamaEmbedder(os.Getenv("OLLAMA_HOST"), os.Getenv("OLLAMA_EMBED_MODEL"), opts...), nil
+	default:
+		return nil, fmt.Errorf("unknown LOCAL_EMBEDDER %q (expected ngram or ollama)", name)
+	}
+}
+
+// localCache is the self-hosted backend. When it is backed by an HNSW
+// index, the graph is saved next to the cache file whenever the cache
+// rewrites its snapshot and on Close, so the next start does not rebuild
+// it, unless the stored vectors were re-embedded.
+type localCache struct {
+	*semcache.Cache
+	hnsw         *semcache.HNSW
+	snapshotPath string
+}
+
+// Close saves the HNSW snapshot, if any
+func (c localCache) Close() error {
+	if c.hnsw == nil {
+		return nil
+	}
+	return c.hnsw.SaveFile(c.snapshotPath)
+}
+
+// envInt reads a positive integer from an environment variable
+func envInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q (expected a positive integer)", name, value)
+	}
+	return n, nil
+}
+
+// loadHNSW restores the HNSW snapshot at path, or creates an empty index
+// when there is none or it was built with different HNSW_M or
+// HNSW_EF_CONSTRUCTION values. HNSW_EF_SEARCH always applies.
+func loadHNSW(path string) (*semcache.HNSW, error) {
+	cfg := semcache.DefaultHNSWConfig()
+	var err error
+	if cfg.M, err = envInt("HNSW_M", cfg.M); err != nil {
+		return nil, err
+	}
+	if cfg.EfConstruction, err = envInt("HNSW_EF_CONSTRUCTION", cfg.EfConstruction); err != nil {
+		return nil, err
+	}
+	if cfg.EfSearch, err = envInt("HNSW_EF_SEARCH", cfg.EfSearch); err != nil {
+		return nil, err
+	}
+
+	index, err := semcache.LoadHNSWFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Warning: Ignoring HNSW snapshot %s: %v\n", path, err)
+		}
+		return semcache.NewHNSW(cfg), nil
+	}
+	if saved := index.Config(); saved.M != cfg.M || saved.EfConstruction != cfg.EfConstruction {
+		return semcache.NewHNSW(cfg), nil
+	}
+	index.SetEfSearch(cfg.EfSearch)
+	return index, nil
+}
+
+// closeSemanticCache releases a backend that holds resources, such as the
+// local cache's HNSW snapshot or the Redis Stack client
+func closeSemanticCache(cache SemanticCache) {
+	if closer, ok := cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Printf("Warning: Error closing semantic cache: %v\n", err)
+		}
+	}
+}
+
+// semanticCacheName returns a display name for the backend selected by CACHE_BACKEND
+func semanticCacheName() string {
+	switch os.Getenv("CACHE_BACKEND") {
+	case "local":
+		return "Local"
+	case "redis":
+		return "Redis Stack"
+	default:
+		return "LangCache"
+	}
+}
+
+// loadSemanticCache creates the backend selected by CACHE_BACKEND:
+// "langcache" (default), "redis" for vector search in the Redis Stack at
+// REDIS_STACK_ADDR (default: REDIS_ADDR), or "local" for the self-hosted
+// cache stored in LOCAL_CACHE_FILE (default: semantic-cache.json). The
+// local cache is searched with the index selected by LOCAL_INDEX: "flat"
+// (default, exact) or "hnsw" (approximate, snapshot in LOCAL_CACHE_FILE.hnsw).
+func loadSemanticCache() SemanticCache {
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "langcache":
+		return langCacheBackend{client: loadLangCacheClient()}
+
+	case "redis":
+		addr := os.Getenv("REDIS_STACK_ADDR")
+		if addr == "" {
+			addr = os.Getenv("REDIS_ADDR")
+		}
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+
+		embedder, err := loadEmbedder()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		// FT.SEARCH replies are only decoded over RESP2
+		rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			fmt.Printf("Error: Could not connect to Redis Stack at %s: %v\n", addr, err)
+			os.Exit(1)
+		}
+		return rediscache.New(rdb, embedder)
+
+	case "local":
+		path := os.Getenv("LOCAL_CACHE_FILE")
+		if path == "" {
+			path = "semantic-cache.json"
+		}
+
+		embedder, err := loadEmbedder()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		local := localCache{snapshotPath: path + ".hnsw"}
+		var opts []semcache.Option
+		switch index := os.Getenv("LOCAL_INDEX"); index {
+		case "", "flat":
+		case "hnsw":
+			local.hnsw, err = loadHNSW(local.snapshotPath)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			opts = append(opts, semcache.WithIndex(local.hnsw), semcache.WithIndexFile(local.snapshotPath))
+		default:
+			fmt.Printf("Error: unknown LOCAL_INDEX %q (expected flat or hnsw)\n", index)
+			os.Exit(1)
+		}
+
+		local.Cache, err = semcache.Open(context.Background(), path, embedder, opts...)
+		if err != nil {
+			fmt.Printf("Error: Could not open local semantic cache %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		return local
+
+	default:
+		fmt.Printf("Error: unknown CACHE_BACKEND %q (expected langcache, redis or local)\n", backend)
+		os.Exit(1)
+		return nil
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"session3/langcache"
+	"session3/semcache"
+)
+
+// stubSemanticCache is an in-memory SemanticCache that matches questions by
+// their normalized text, so every match has similarity 1. Entry IDs start
+// with prefix, and deleting an entry listed in failDelete fails.
+type stubSemanticCache struct {
+	prefix     string
+	entries    []langcache.Entry
+	failDelete map[string]bool
+	searches   int
+	saved      int
+}
+
+func (c *stubSemanticCache) Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	c.searches++
+	var results []langcache.Entry
+	for _, entry := range c.entries {
+		if getCacheKey(entry.Prompt) != getCacheKey(prompt) || !hasAttributes(entry.Attributes, attributes) {
+			continue
+		}
+		similarity := 1.0
+		entry.Similarity = &similarity
+		results = append(results, entry)
+	}
+	return results, nil
+}
+
+func (c *stubSemanticCache) Set(ctx context.Context, prompt, response string, attributes map[string]string, ttl time.Duration) (string, error) {
+	c.saved++
+	entry := langcache.Entry{
+		ID:         c.prefix + "entry-" + strconv.Itoa(c.saved),
+		Prompt:     prompt,
+		Response:   response,
+		Attributes: attributes,
+	}
+	c.entries = append(c.entries, entry)
+	return entry.ID, nil
+}
+
+func (c *stubSemanticCache) Get(ctx context.Context, entryID string) (*langcache.Entry, error) {
+	for _, entry := range c.entries {
+		if entry.ID == entryID {
+			return &entry, nil
+		}
+	}
+	return nil, semcache.ErrNotFound
+}
+
+func (c *stubSemanticCache) Delete(ctx context.Context, entryID string) error {
+	if c.failDelete[entryID] {
+		return errors.New("connection refused")
+	}
+	for i, entry := range c.entries {
+		if entry.ID == entryID {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return nil
+		}
+	}
+	return semcache.ErrNotFound
+}
+
+func (c *stubSemanticCache) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	var kept []langcache.Entry
+	for _, entry := range c.entries {
+		if !hasAttributes(entry.Attributes, attributes) {
+			kept = append(kept, entry)
+		}
+	}
+	deleted := len(c.entries) - len(kept)
+	c.entries = kept
+	return deleted, nil
+}
+
+// newTestRedis connects to the Redis at REDIS_STACK_ADDR (default:
+// localhost:6379), as the rediscache tests do. The test is skipped when no
+// server is reachable unless REDIS_STACK_REQUIRED is set, as in CI, where
+// it fails instead. Tests share the server, so they must use keys of their
+// own, e.g. by putting testID in their questions, sources and entry IDs.
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_STACK_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	unavailable := t.Skipf
+	if os.Getenv("REDIS_STACK_REQUIRED") != "" {
+		unavailable = t.Fatalf
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		unavailable("Redis not available at %s: %v", addr, err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+	return rdb
+}
+
+// testID returns a string unique to this run of the test
+func testID(t *testing.T) string {
+	return t.Name() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// openLocalHNSW opens the local backend with an HNSW index, as configured
+// in the environment
+func openLocalHNSW(t *testing.T) localCache {
+	t.Helper()
+
+	local, ok := loadSemanticCache().(localCache)
+	if !ok || local.hnsw == nil {
+		t.Fatalf("loadSemanticCache did not open a local cache with an HNSW index")
+	}
+	return local
+}
+
+func TestLocalHNSWReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	t.Setenv("CACHE_BACKEND", "local")
+	t.Setenv("LOCAL_CACHE_FILE", path)
+	t.Setenv("LOCAL_INDEX", "hnsw")
+	t.Setenv("LOCAL_EMBEDDER", "ngram")
+	ctx := context.Background()
+
+	local := openLocalHNSW(t)
+	for i := 0; i < 50; i++ {
+		question := fmt.Sprintf("What is the population of city number %d?", i)
+		if _, err := local.Set(ctx, question, `{"answer": "A lot"}`, nil, 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	closeSemanticCache(local)
+
+	// The first reopen fits the n-gram weights on the stored questions, which
+	// changes every vector and so rebuilds the graph. The rebuilt graph is
+	// saved right away, so a crash before Close cannot leave the old one.
+	refitted := openLocalHNSW(t)
+	var rebuilt bytes.Buffer
+	if err := refitted.hnsw.Save(&rebuilt); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if saved, err := os.ReadFile(path + ".hnsw"); err != nil || !bytes.Equal(saved, rebuilt.Bytes()) {
+		t.Errorf("the HNSW snapshot was not saved with the re-embedded vectors (%v)", err)
+	}
+	closeSemanticCache(refitted)
+	saved, err := os.ReadFile(path + ".hnsw")
+	if err != nil {
+		t.Fatalf("reading snapshot: %v", err)
+	}
+
+	// From then on the graph is restored as saved
+	local = openLocalHNSW(t)
+	var restored bytes.Buffer
+	if err := local.hnsw.Save(&restored); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), saved) {
+		t.Errorf("the HNSW graph was rebuilt on reopen")
+	}
+
+	results, err := local.Search(ctx, "What is the population of city number 7?", 0.99, nil)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Search after reopen = %+v, %v; want the stored question", results, err)
+	}
+	closeSemanticCache(local)
+}
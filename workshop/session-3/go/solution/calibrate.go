@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalibrationPair is one labeled line of a calibration file
+type CalibrationPair struct {
+	Stored string `json:"stored"` // Question stored in the cache
+	Query  string `json:"query"`  // Question searched for
+	Match  bool   `json:"match"`  // Whether the query should be answered by the stored question
+}
+
+// CalibrationResult holds precision and recall at one threshold
+type CalibrationResult struct {
+	Threshold      float64
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	Precision      float64
+	Recall         float64
+	F1             float64
+}
+
+// loadCalibrationPairs reads a JSON Lines file of labeled question pairs
+func loadCalibrationPairs(path string) ([]CalibrationPair, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pairs []CalibrationPair
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pair CalibrationPair
+		if err := json.Unmarshal([]byte(line), &pair); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		if pair.Stored == "" || pair.Query == "" {
+			return nil, fmt.Errorf("%s:%d: both \"stored\" and \"query\" are required", path, lineNumber)
+		}
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, scanner.Err()
+}
+
+// parseThresholdRange parses "from:to:step" into the list of thresholds to evaluate
+func parseThresholdRange(value string) ([]float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid threshold range %q: expected from:to:step", value)
+	}
+
+	from, err := parseSimilarityThreshold(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseSimilarityThreshold(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	step, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || step <= 0 {
+		return nil, fmt.Errorf("invalid threshold step %q: must be a positive number", parts[2])
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid threshold range %q: from must not exceed to", value)
+	}
+
+	var thresholds []float64
+	for i := 0; ; i++ {
+		// Round to avoid accumulating floating point error in the labels
+		threshold := float64(int((from+float64(i)*step)*10000+0.5)) / 10000
+		if threshold > to+1e-9 {
+			break
+		}
+		thresholds = append(thresholds, threshold)
+	}
+
+	return thresholds, nil
+}
+
+// measureSimilarities stores each pair's question in its own attribute scope
+// and searches for the paired query with no threshold, so the returned score
+// is exactly the similarity between the two. A nil entry means the cache
+// returned no score for that pair.
+func measureSimilarities(ctx context.Context, cache SemanticCache, pairs []CalibrationPair, runID string) ([]*float64, error) {
+	similarities := make([]*float64, len(pairs))
+	for i, pair := range pairs {
+		attributes := map[string]string{
+			"calibration_run":  runID,
+			"calibration_pair": strconv.Itoa(i),
+		}
+
+		if _, err := cache.Set(ctx, pair.Stored, "{}", attributes, time.Hour); err != nil {
+			return nil, fmt.Errorf("storing pair %d: %w", i+1, err)
+		}
+
+		entries, err := cache.Search(ctx, pair.Query, 0, attributes)
+		if err != nil {
+			return nil, fmt.Errorf("searching pair %d: %w", i+1, err)
+		}
+		if len(entries) > 0 && entries[0].Similarity != nil {
+			similarities[i] = entries[0].Similarity
+		}
+
+		fmt.Printf("\r  Measured %d/%d pairs", i+1, len(pairs))
+	}
+	fmt.Println()
+
+	return similarities, nil
+}
+
+// evaluateThresholds computes precision, recall and F1 for each threshold
+func evaluateThresholds(pairs []CalibrationPair, similarities []*float64, thresholds []float64) []CalibrationResult {
+	results := make([]CalibrationResult, 0, len(thresholds))
+	for _, threshold := range thresholds {
+		result := CalibrationResult{Threshold: threshold}
+		for i, pair := range pairs {
+			predicted := similarities[i] != nil && *similarities[i] >= threshold
+			switch {
+			case predicted && pair.Match:
+				result.TruePositives++
+			case predicted && !pair.Match:
+				result.FalsePositives++
+			case !predicted && pair.Match:
+				result.FalseNegatives++
+			}
+		}
+
+		if predicted := result.TruePositives + result.FalsePositives; predicted > 0 {
+			result.Precision = float64(result.TruePositives) / float64(predicted)
+		} else {
+			// No hits at all means no wrong answers were served
+			result.Precision = 1
+		}
+		if actual := result.TruePositives + result.FalseNegatives; actual > 0 {
+			result.Recall = float64(result.TruePositives) / float64(actual)
+		}
+		if result.Precision+result.Recall > 0 {
+			result.F1 = 2 * result.Precision * result.Recall / (result.Precision + result.Recall)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// recommendThreshold picks the threshold with the best F1 score, preferring
+// the higher threshold on ties since a wrong cached answer costs more than
+// an extra API call
+func recommendThreshold(results []CalibrationResult) CalibrationResult {
+	best := results[0]
+	for _, result := range results[1:] {
+		if result.F1 >= best.F1 {
+			best = result
+		}
+	}
+	return best
+}
+
+// runCalibrate implements the "calibrate" command
+func runCalibrate(args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	file := fs.String("file", "", "JSON Lines file of labeled pairs: {\"stored\": ..., \"query\": ..., \"match\": true}")
+	thresholdRange := fs.String("thresholds", "0.50:0.99:0.01", "thresholds to evaluate as from:to:step")
+	fs.Parse(args)
+
+	if *file == "" {
+		fmt.Println("Usage: go run . calibrate --file pairs.jsonl [--thresholds 0.50:0.99:0.01]")
+		os.Exit(1)
+	}
+
+	pairs, err := loadCalibrationPairs(*file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(pairs) == 0 {
+		fmt.Printf("Error: %s contains no pairs\n", *file)
+		os.Exit(1)
+	}
+	thresholds, err := parseThresholdRange(*thresholdRange)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	semanticCache := loadSemanticCache()
+	defer closeSemanticCache(semanticCache)
+	ctx := context.Background()
+
+	// Calibration entries live in their own attribute scope and are removed afterwards
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	removeEntries := func() {
+		if _, err := semanticCache.DeleteByAttributes(ctx, map[string]string{"calibration_run": runID}); err != nil {
+			fmt.Printf("Warning: Error removing calibration entries: %v\n", err)
+		}
+	}
+	defer removeEntries()
+
+	fmt.Printf("Calibrating with %d labeled pairs...\n", len(pairs))
+	similarities, err := measureSimilarities(ctx, semanticCache, pairs, runID)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		// os.Exit skips the deferred cleanup, so run it first
+		removeEntries()
+		closeSemanticCache(semanticCache)
+		os.Exit(1)
+	}
+
+	results := evaluateThresholds(pairs, similarities, thresholds)
+
+	fmt.Println()
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("%-10s %10s %10s %10s %6s %6s %6s\n", "Threshold", "Precision", "Recall", "F1", "TP", "FP", "FN")
+	fmt.Println(strings.Repeat("=", 70))
+	for _, result := range results {
+		fmt.Printf("%-10.2f %10.3f %10.3f %10.3f %6d %6d %6d\n",
+			result.Threshold, result.Precision, result.Recall, result.F1,
+			result.TruePositives, result.FalsePositives, result.FalseNegatives)
+	}
+	fmt.Println(strings.Repeat("=", 70))
+
+	best := recommendThreshold(results)
+	fmt.Printf("Recommended SIMILARITY_THRESHOLD=%.2f (precision %.3f, recall %.3f, F1 %.3f)\n",
+		best.Threshold, best.Precision, best.Recall, best.F1)
+}
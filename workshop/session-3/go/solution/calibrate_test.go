@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseThresholdRange(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // Thresholds, or part of the error
+	}{
+		{"0.7:0.9:0.05", "[0.7 0.75 0.8 0.85 0.9]"},
+		{"0.8:0.8:0.1", "[0.8]"},
+		{"0.1:0.3:0.1", "[0.1 0.2 0.3]"},
+		{"0:1:0.5", "[0 0.5 1]"},
+		{"0.7:0.8:0.3", "[0.7]"},
+		{"0.7:0.9", "expected from:to:step"},
+		{"0.9:0.7:0.05", "must not exceed"},
+		{"0.7:0.9:0", "must be a positive number"},
+		{"0.7:0.9:-0.1", "must be a positive number"},
+		{"0.7:0.9:x", "must be a positive number"},
+		{"0.7:1.5:0.1", "between 0 and 1"},
+		{"low:0.9:0.1", "must be a number"},
+	}
+	for _, tt := range tests {
+		thresholds, err := parseThresholdRange(tt.value)
+		got := fmt.Sprint(thresholds)
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, tt.want) || (err == nil && got != tt.want) {
+			t.Errorf("parseThresholdRange(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCalibrationPairs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int    // Pairs loaded
+		err     string // Part of the error
+	}{
+		{"pairs", "{\"stored\": \"a\", \"query\": \"b\", \"match\": true}\n{\"stored\": \"c\", \"query\": \"d\"}\n", 2, ""},
+		{"comments and blank lines", "# labeled by hand\n\n  {\"stored\": \"a\", \"query\": \"b\"}  \n", 1, ""},
+		{"invalid JSON", "{\"stored\": \"a\", \"query\": \"b\"}\n{oops}\n", 0, "pairs.jsonl:2:"},
+		{"missing query", "# header\n{\"stored\": \"a\"}\n", 0, "pairs.jsonl:2: both"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "pairs.jsonl")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		pairs, err := loadCalibrationPairs(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(pairs) != tt.want {
+			t.Errorf("%s: loaded %d pairs, %v; want %d", tt.name, len(pairs), err, tt.want)
+		}
+	}
+
+	if _, err := loadCalibrationPairs(filepath.Join(t.TempDir(), "missing.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("missing file: err = %v, want not exist", err)
+	}
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	score := func(s float64) *float64 { return &s }
+	pairs := []CalibrationPair{
+		{Match: true},  // 0.95
+		{Match: true},  // 0.85
+		{Match: true},  // no score
+		{Match: false}, // 0.90
+		{Match: false}, // 0.50
+	}
+	similarities := []*float64{score(0.95), score(0.85), nil, score(0.90), score(0.50)}
+
+	tests := []struct {
+		threshold  float64
+		tp, fp, fn int
+		precision  float64
+		recall     float64
+		f1         float64
+	}{
+		// Everything scored is a hit; the unscored match is still missed
+		{0, 2, 2, 1, 0.5, 2.0 / 3, 4.0 / 7},
+		// A score equal to the threshold is a hit
+		{0.85, 2, 1, 1, 2.0 / 3, 2.0 / 3, 2.0 / 3},
+		{0.92, 1, 0, 2, 1, 1.0 / 3, 0.5},
+		// No hits: nothing wrong served, but nothing recalled either
+		{0.99, 0, 0, 3, 1, 0, 0},
+	}
+	thresholds := make([]float64, len(tests))
+	for i, tt := range tests {
+		thresholds[i] = tt.threshold
+	}
+	results := evaluateThresholds(pairs, similarities, thresholds)
+	if len(results) != len(tests) {
+		t.Fatalf("evaluateThresholds returned %d results, want %d", len(results), len(tests))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for i, tt := range tests {
+		got := results[i]
+		if got.Threshold != tt.threshold || got.TruePositives != tt.tp || got.FalsePositives != tt.fp || got.FalseNegatives != tt.fn ||
+			!near(got.Precision, tt.precision) || !near(got.Recall, tt.recall) || !near(got.F1, tt.f1) {
+			t.Errorf("threshold %v: %+v, want TP %d FP %d FN %d, precision %.4f recall %.4f F1 %.4f",
+				tt.threshold, got, tt.tp, tt.fp, tt.fn, tt.precision, tt.recall, tt.f1)
+		}
+	}
+
+	// Without any matching pair, recall and F1 stay 0 instead of NaN
+	results = evaluateThresholds([]CalibrationPair{{Match: false}}, []*float64{score(0.9)}, []float64{0.5})
+	if got := results[0]; got.Precision != 0 || got.Recall != 0 || got.F1 != 0 {
+		t.Errorf("only non-matching pairs: %+v, want all zero", got)
+	}
+}
+
+func TestRecommendThreshold(t *testing.T) {
+	results := []CalibrationResult{
+		{Threshold: 0.7, F1: 0.6},
+		{Threshold: 0.75, F1: 0.8},
+		{Threshold: 0.8, F1: 0.8},
+		{Threshold: 0.85, F1: 0.7},
+	}
+	// Ties go to the higher threshold
+	if got := recommendThreshold(results); got.Threshold != 0.8 {
+		t.Errorf("recommendThreshold = %v, want 0.8", got.Threshold)
+	}
+	if got := recommendThreshold(results[:1]); got.Threshold != 0.7 {
+		t.Errorf("recommendThreshold of one result = %v, want 0.7", got.Threshold)
+	}
+}
+
+func TestMeasureSimilarities(t *testing.T) {
+	cache := &stubSemanticCache{}
+	pairs := []CalibrationPair{
+		{Stored: "What is the capital of France?", Query: "what is the capital of france?", Match: true},
+		{Stored: "How do volcanoes form?", Query: "What is the capital of France?"},
+	}
+
+	// Each pair is searched in its own scope, so the first pair's entry
+	// does not answer the second pair's query
+	similarities, err := measureSimilarities(context.Background(), cache, pairs, "run-1")
+	if err != nil {
+		t.Fatalf("measureSimilarities: %v", err)
+	}
+	if len(similarities) != 2 || similarities[0] == nil || *similarities[0] != 1 || similarities[1] != nil {
+		t.Errorf("similarities = %v, want [1 <nil>]", similarities)
+	}
+	for _, entry := range cache.entries {
+		if entry.Attributes["calibration_run"] != "run-1" {
+			t.Errorf("pair stored without the run scope: %+v", entry)
+		}
+	}
+}
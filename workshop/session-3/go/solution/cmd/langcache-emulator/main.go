@@ -0,0 +1,86 @@
+// Command langcache-emulator runs a local LangCache-compatible server so the
+// Session 3 client can be used without a Redis Cloud account.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"session3/emulator"
+)
+
+// getEnv returns the value of an environment variable or a default
+func getEnv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	addr := flag.String("addr", getEnv("EMULATOR_ADDR", "localhost:8081"), "address to listen on")
+	apiKey := flag.String("api-key", getEnv("EMULATOR_API_KEY", "dev-key"), "bearer token clients must send (empty disables auth)")
+	dataFile := flag.String("data", getEnv("EMULATOR_DATA", "langcache-emulator.json"), "file the cache is persisted to (empty keeps it in memory)")
+	flag.Parse()
+
+	store, err := emulator.NewStore(*dataFile)
+	if err != nil {
+		log.Fatalf("Error loading %s: %v", *dataFile, err)
+	}
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: emulator.NewServer(store, *apiKey),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Drop expired entries periodically so the data file does not grow forever
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.PurgeExpired(); err != nil {
+					log.Printf("Error purging expired entries: %v", err)
+				}
+			}
+		}
+	}()
+
+	// Let the running requests finish before the process exits
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}()
+
+	fmt.Printf("LangCache emulator listening on http://%s\n", *addr)
+	if *dataFile != "" {
+		fmt.Printf("Persisting entries to %s\n", *dataFile)
+	}
+	fmt.Println("Point the client at it with:")
+	fmt.Printf("  SERVER_URL=http://%s CACHE_ID=local API_KEY=%s\n", *addr, *apiKey)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// ListenAndServe returns as soon as Shutdown starts
+	<-done
+}
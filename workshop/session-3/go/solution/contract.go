@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// The cache contract shared with the Python, TypeScript, JavaScript and
+// Java clients is written down in workshop/contract/README.md. Its golden
+// fixtures are checked by contract_test.go.
+
+// normalizeQuestion lowercases and trims a question before it is hashed
+// into a key. Python's str.lower, JavaScript's toLowerCase and Java's
+// toLowerCase apply Unicode's full lowercase mapping, which Go's
+// strings.ToLower does not implement for "İ" and a word-final "Σ".
+func normalizeQuestion(question string) string {
+	runes := []rune(strings.TrimSpace(question))
+
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case r == 'İ':
+			b.WriteString("i̇")
+		case r == 'Σ' && isFinalSigma(runes, i):
+			b.WriteRune('ς')
+		default:
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// isFinalSigma reports whether the capital sigma at runes[i] ends a word:
+// it follows a letter and no letter follows it, ignoring combining marks
+func isFinalSigma(runes []rune, i int) bool {
+	cased := func(r rune) bool { return unicode.IsLetter(r) }
+	ignorable := func(r rune) bool { return unicode.Is(unicode.Mn, r) || r == '\'' || r == '’' }
+
+	before := false
+	for j := i - 1; j >= 0; j-- {
+		if !ignorable(runes[j]) {
+			before = cased(runes[j])
+			break
+		}
+	}
+	for j := i + 1; j < len(runes); j++ {
+		if !ignorable(runes[j]) {
+			return before && !cased(runes[j])
+		}
+	}
+	return before
+}
+
+// encodeCachedResponse encodes a response as every client stores it: a
+// JSON object with answer, sources and processing_time. Sources are always
+// an array, since other clients iterate them without a null check.
+func encodeCachedResponse(response *Response) (string, error) {
+	encoded := *response
+	if encoded.Sources == nil {
+		encoded.Sources = []Source{}
+	}
+
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"session3/langcache"
+)
+
+// contractFixtures holds the golden fixtures shared by all language clients
+const contractFixtures = "../../../contract/fixtures"
+
+// loadFixture decodes a fixture file into v
+func loadFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(contractFixtures, name))
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding fixture %s: %v", name, err)
+	}
+}
+
+// sameResponse compares responses, treating nil and empty sources as equal
+func sameResponse(a, b *Response) bool {
+	if a.Answer != b.Answer || a.ProcessingTime != b.ProcessingTime || len(a.Sources) != len(b.Sources) {
+		return false
+	}
+	return len(a.Sources) == 0 || reflect.DeepEqual(a.Sources, b.Sources)
+}
+
+func TestContractKeys(t *testing.T) {
+	var fixtures []struct {
+		Name       string            `json:"name"`
+		Question   string            `json:"question"`
+		Normalized *string           `json:"normalized"`
+		Attributes map[string]string `json:"attributes"`
+		Key        string            `json:"key"`
+	}
+	loadFixture(t, "keys.json", &fixtures)
+
+	for _, f := range fixtures {
+		if f.Normalized != nil {
+			if got := normalizeQuestion(f.Question); got != *f.Normalized {
+				t.Errorf("%s: normalizeQuestion(%q) = %q, want %q", f.Name, f.Question, got, *f.Normalized)
+			}
+		}
+		if got := exactCacheKey(f.Question, f.Attributes); got != f.Key {
+			t.Errorf("%s: exactCacheKey(%q, %v) = %s, want %s", f.Name, f.Question, f.Attributes, got, f.Key)
+		}
+	}
+}
+
+// valueFixture is a cached value as written by one client
+type valueFixture struct {
+	Name     string   `json:"name"`
+	Writer   string   `json:"writer"`
+	Stored   string   `json:"stored"`
+	Format   string   `json:"format"`
+	Expected Response `json:"expected"`
+}
+
+func TestContractDecode(t *testing.T) {
+	var fixtures []valueFixture
+	loadFixture(t, "values.json", &fixtures)
+
+	for _, f := range fixtures {
+		response, format, err := decodeCachedResponse(f.Stored)
+		if err != nil {
+			t.Errorf("%s: decodeCachedResponse: %v", f.Name, err)
+			continue
+		}
+		if !sameResponse(response, &f.Expected) {
+			t.Errorf("%s: decoded %+v, want %+v", f.Name, *response, f.Expected)
+		}
+		if format != f.Format {
+			t.Errorf("%s: format = %s, want %s", f.Name, format, f.Format)
+		}
+	}
+}
+
+func TestContractEncode(t *testing.T) {
+	var fixtures []valueFixture
+	loadFixture(t, "values.json", &fixtures)
+
+	for _, f := range fixtures {
+		if f.Writer != "go" {
+			continue
+		}
+
+		encoded, err := encodeCachedResponse(&f.Expected)
+		if err != nil {
+			t.Fatalf("%s: encodeCachedResponse: %v", f.Name, err)
+		}
+		if encoded != f.Stored {
+			t.Errorf("%s: encoded\n  %s\nwant\n  %s", f.Name, encoded, f.Stored)
+		}
+	}
+
+	// Other clients read the fields directly, so sources must never be null
+	encoded, err := encodeCachedResponse(&Response{Answer: "Paris"})
+	if err != nil {
+		t.Fatalf("encodeCachedResponse: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(encoded), &fields); err != nil {
+		t.Fatalf("encoded value is not JSON: %v", err)
+	}
+	if _, ok := fields["sources"].([]interface{}); !ok {
+		t.Errorf("sources = %v, want an array", fields["sources"])
+	}
+	if _, ok := fields["processing_time"].(float64); !ok {
+		t.Errorf("processing_time = %v, want a number", fields["processing_time"])
+	}
+}
+
+func TestContractCorrupt(t *testing.T) {
+	var fixtures []struct {
+		Name   string `json:"name"`
+		Stored string `json:"stored"`
+	}
+	loadFixture(t, "corrupt.json", &fixtures)
+
+	for _, f := range fixtures {
+		if response, format, err := decodeCachedResponse(f.Stored); err == nil {
+			t.Errorf("%s: decoded %q as %+v (%s), want an error", f.Name, f.Stored, *response, format)
+		}
+	}
+}
+
+func TestContractLangCacheSearch(t *testing.T) {
+	var fixture struct {
+		Response langcache.SearchResponse `json:"response"`
+		Expected []struct {
+			ID         string  `json:"id"`
+			Answer     string  `json:"answer"`
+			Similarity float64 `json:"similarity"`
+		} `json:"expected"`
+	}
+	loadFixture(t, "langcache-search.json", &fixture)
+
+	entries := fixture.Response.Data
+	if len(entries) != len(fixture.Expected) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(fixture.Expected))
+	}
+	for i, want := range fixture.Expected {
+		entry := entries[i]
+		if entry.ID != want.ID {
+			t.Errorf("entry %d: ID = %s, want %s", i, entry.ID, want.ID)
+		}
+		if entry.Similarity == nil || *entry.Similarity != want.Similarity {
+			t.Errorf("entry %s: similarity = %v, want %v", want.ID, entry.Similarity, want.Similarity)
+		}
+
+		response, _, err := decodeCachedResponse(entry.Response)
+		if err != nil {
+			t.Errorf("entry %s: decodeCachedResponse: %v", want.ID, err)
+			continue
+		}
+		if response.Answer != want.Answer {
+			t.Errorf("entry %s: answer = %q, want %q", want.ID, response.Answer, want.Answer)
+		}
+	}
+}
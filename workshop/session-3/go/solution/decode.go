@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Cached response formats recognized by decodeCachedResponse
+const (
+	FormatNative    = "native"    // Response as written by this client
+	FormatEnvelope  = "envelope"  // Response nested under response/data/result/payload
+	FormatVariant   = "variant"   // Other field names, e.g. text/content or camelCase
+	FormatPlainText = "plaintext" // Not JSON: the whole value is the answer
+)
+
+// envelopeKeys are the fields other clients nest the actual response under
+var envelopeKeys = []string{"response", "data", "result", "payload", "value"}
+
+// answerKeys are the fields other clients store the answer text under, in order of preference
+var answerKeys = []string{"answer", "text", "content", "output", "response", "message"}
+
+// decodeCachedResponse parses a response stored in the semantic cache,
+// tolerating shapes written by other clients. It returns an error only for
+// corrupt values: empty, invalid JSON, or JSON without any answer.
+func decodeCachedResponse(raw string) (*Response, string, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return nil, "", errors.New("empty response")
+	}
+	// A client encoding a missing response, e.g. json.dumps(None)
+	if trimmed == "null" {
+		return nil, "", errors.New("null response")
+	}
+
+	// Anything that does not look like JSON is a plain-text answer
+	if trimmed[0] != '{' && trimmed[0] != '[' && trimmed[0] != '"' {
+		return &Response{Answer: trimmed}, FormatPlainText, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(trimmed), &value); err != nil {
+		// Answers may start with a quote or a citation like "[1]"; only a
+		// broken object is corrupt
+		if trimmed[0] != '{' {
+			return &Response{Answer: trimmed}, FormatPlainText, nil
+		}
+		return nil, "", fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	// Some clients JSON-encode the already encoded response a second time
+	if s, ok := value.(string); ok {
+		response, format, err := decodeCachedResponse(s)
+		if err != nil {
+			return nil, "", err
+		}
+		if format == FormatNative {
+			format = FormatVariant
+		}
+		return response, format, nil
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, "", fmt.Errorf("expected a JSON object, got %s", jsonKind(value))
+	}
+	return decodeResponseObject(object, 0)
+}
+
+// decodeResponseObject extracts a Response from a decoded JSON object,
+// unwrapping up to two levels of envelopes
+func decodeResponseObject(object map[string]interface{}, depth int) (*Response, string, error) {
+	// The native shape: a string answer plus optional sources and processing time
+	if answer, ok := object["answer"].(string); ok {
+		response := &Response{Answer: answer}
+		format := FormatNative
+		if !decodeSources(object["sources"], &response.Sources) {
+			format = FormatVariant
+		}
+		if !decodeProcessingTime(object, &response.ProcessingTime) {
+			format = FormatVariant
+		}
+		return response, format, nil
+	}
+
+	if depth < 2 {
+		for _, key := range envelopeKeys {
+			if nested, ok := object[key].(map[string]interface{}); ok {
+				response, _, err := decodeResponseObject(nested, depth+1)
+				if err == nil {
+					return response, FormatEnvelope, nil
+				}
+			}
+		}
+	}
+
+	for _, key := range answerKeys {
+		if answer, ok := object[key].(string); ok && strings.TrimSpace(answer) != "" {
+			response := &Response{Answer: answer}
+			decodeSources(firstOf(object, "sources", "citations", "references"), &response.Sources)
+			decodeProcessingTime(object, &response.ProcessingTime)
+			return response, FormatVariant, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("no answer field in object with keys %s", strings.Join(objectKeys(object), ", "))
+}
+
+// decodeSources fills sources from a JSON value. Sources may be native
+// objects, objects with link/href/name fields, or plain URL or title
+// strings. It reports whether the value was absent or in the native shape.
+func decodeSources(value interface{}, sources *[]Source) bool {
+	list, ok := value.([]interface{})
+	if !ok {
+		return value == nil
+	}
+
+	native := true
+	for i, item := range list {
+		source := Source{Number: i + 1}
+		switch item := item.(type) {
+		case string:
+			native = false
+			if strings.HasPrefix(item, "http://") || strings.HasPrefix(item, "https://") {
+				source.URL = item
+			} else {
+				source.Title = item
+			}
+		case map[string]interface{}:
+			if n, ok := item["number"].(float64); ok {
+				source.Number = int(n)
+			} else {
+				native = false
+			}
+			source.Title, _ = firstOf(item, "title", "name").(string)
+			source.URL, _ = firstOf(item, "url", "link", "href", "source").(string)
+			if _, ok := item["title"]; !ok {
+				native = false
+			}
+		default:
+			native = false
+			continue
+		}
+		*sources = append(*sources, source)
+	}
+	return native
+}
+
+// decodeProcessingTime reads processing_time or one of its variants and
+// reports whether the value was absent or in the native shape
+func decodeProcessingTime(object map[string]interface{}, seconds *float64) bool {
+	if t, ok := object["processing_time"].(float64); ok {
+		*seconds = t
+		return true
+	}
+	for _, key := range []string{"processingTime", "processing_time_seconds", "duration"} {
+		if t, ok := object[key].(float64); ok {
+			*seconds = t
+			return false
+		}
+	}
+	return true
+}
+
+// firstOf returns the first of the given fields present in object
+func firstOf(object map[string]interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		if value, ok := object[key]; ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// objectKeys lists the keys of an object for error messages
+func objectKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return []string{"(none)"}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonKind names the type of a decoded JSON value
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case []interface{}:
+		return "an array"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"session3/langcache"
+)
+
+// idempotencyAttribute is the entry attribute holding the idempotency key
+// of the question it answers
+const idempotencyAttribute = "idempotency_key"
+
+// upsertThreshold is the similarity used to find the entries a save
+// replaces. Phrasings of the same normalized question differ only in case
+// and surrounding whitespace, so they are far above it with any embedder.
+const upsertThreshold = 0.5
+
+// idempotencyKey identifies a question for upserts: the hash of its
+// normalized form, the same hash getCacheKey uses
+func idempotencyKey(question string) string {
+	hash := sha256.Sum256([]byte(normalizeQuestion(question)))
+	return hex.EncodeToString(hash[:])
+}
+
+// saveLocks serializes saves of the same question and scope within this
+// process, so concurrent upserts cannot each miss the other's new entry
+var saveLocks = &keyLocks{locks: make(map[string]*keyLock)}
+
+// keyLocks hands out one mutex per key and drops it once unused
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	holders int
+}
+
+// Lock locks the mutex of key and returns the function unlocking it
+func (k *keyLocks) Lock(key string) func() {
+	k.mu.Lock()
+	lock := k.locks[key]
+	if lock == nil {
+		lock = &keyLock{}
+		k.locks[key] = lock
+	}
+	lock.holders++
+	k.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// entryIdempotencyKey returns the idempotency key of a cached entry.
+// Entries saved before upserts, or by other clients, have no key
+// attribute, so it is derived from their prompt.
+func entryIdempotencyKey(entry langcache.Entry) string {
+	if key := entry.Attributes[idempotencyAttribute]; key != "" {
+		return key
+	}
+	return idempotencyKey(entry.Prompt)
+}
+
+// entryAttributes returns the attributes of an entry without its
+// idempotency key, i.e. the scope it was saved in
+func entryAttributes(entry langcache.Entry) map[string]string {
+	scope := make(map[string]string, len(entry.Attributes))
+	for name, value := range entry.Attributes {
+		if name != idempotencyAttribute {
+			scope[name] = value
+		}
+	}
+	return scope
+}
+
+// entryScope returns the attributes of an entry without its idempotency key
+func entryScope(entry langcache.Entry) string {
+	return formatAttributes(entryAttributes(entry))
+}
+
+// entryListing is implemented by backends that can enumerate their entries.
+// LangCache cannot.
+type entryListing interface {
+	Entries(ctx context.Context) ([]langcache.Entry, error)
+}
+
+// duplicateGroup is a set of entries answering the same question in the same scope
+type duplicateGroup struct {
+	Keep    langcache.Entry
+	Remove  []langcache.Entry
+	Scope   string
+	Example string
+}
+
+// findDuplicates groups entries by idempotency key and scope and returns
+// the groups holding more than one entry. Within a group the first entry
+// carrying a key attribute is kept, or else the first entry.
+func findDuplicates(entries []langcache.Entry) []duplicateGroup {
+	var order []string
+	groups := make(map[string][]langcache.Entry)
+	for _, entry := range entries {
+		id := entryIdempotencyKey(entry) + "\x00" + entryScope(entry)
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], entry)
+	}
+
+	var duplicates []duplicateGroup
+	for _, id := range order {
+		members := groups[id]
+		if len(members) < 2 {
+			continue
+		}
+
+		keep := 0
+		for i, entry := range members {
+			if entry.Attributes[idempotencyAttribute] != "" {
+				keep = i
+				break
+			}
+		}
+		group := duplicateGroup{Keep: members[keep], Scope: entryScope(members[keep]), Example: members[keep].Prompt}
+		for i, entry := range members {
+			if i != keep {
+				group.Remove = append(group.Remove, entry)
+			}
+		}
+		duplicates = append(duplicates, group)
+	}
+	return duplicates
+}
+
+// dedupeCandidates returns the entries to check for duplicates: every
+// entry when the backend can list them, otherwise the matches of each
+// question, which default to the questions in the audit log
+func dedupeCandidates(ctx context.Context, cache SemanticCache, questions []string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	if lister, ok := cache.(entryListing); ok && len(questions) == 0 {
+		return lister.Entries(ctx)
+	}
+
+	if len(questions) == 0 {
+		rdb := newRedisClient()
+		if rdb == nil {
+			return nil, fmt.Errorf("%s cannot list its entries; pass questions or set REDIS_ADDR to read them from the audit log", semanticCacheName())
+		}
+		defer rdb.Close()
+
+		audit, err := NewAuditLog(rdb)
+		if err != nil {
+			return nil, err
+		}
+		asked, err := audit.Query(ctx, time.Time{}, time.Time{}, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, entry := range asked {
+			if key := idempotencyKey(entry.Question); !seen[key] {
+				seen[key] = true
+				questions = append(questions, entry.Question)
+			}
+		}
+	}
+
+	// The same entry can match several questions
+	var entries []langcache.Entry
+	seen := make(map[string]bool)
+	for _, question := range questions {
+		matches, err := cache.Search(ctx, question, threshold, attributes)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range matches {
+			if !seen[entry.ID] {
+				seen[entry.ID] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// runDedupe implements the "dedupe" command: it removes entries stored more
+// than once for the same normalized question and attributes
+func runDedupe(args []string) {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list duplicates without deleting them")
+	scope := fs.String("scope", "", "comma-separated attributes that scope searched entries (default: CACHE_SCOPE)")
+	attrs := attributeFlag{}
+	fs.Var(attrs, "attr", "set a cache attribute as key=value (repeatable)")
+	fs.Parse(args)
+
+	semanticCache := loadSemanticCache()
+	defer closeSemanticCache(semanticCache)
+
+	// Removed entries are dropped from the source index when Redis is there
+	var index *SourceIndex
+	if rdb := newRedisClient(); rdb != nil {
+		defer rdb.Close()
+		index = NewSourceIndex(rdb)
+	}
+
+	// Scope and threshold only apply when searching for the questions' entries
+	attributes, err := loadCacheAttributes(getAISHEURL(), *scope, attrs)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	threshold, err := loadSimilarityThreshold()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	entries, err := dedupeCandidates(ctx, semanticCache, fs.Args(), threshold, attributes)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	groups := findDuplicates(entries)
+
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("DUPLICATES (%s, %d entries checked)\n", semanticCacheName(), len(entries))
+	fmt.Println(strings.Repeat("=", 70))
+	removed := 0
+	for _, group := range groups {
+		scope := group.Scope
+		if scope == "" {
+			scope = "unscoped"
+		}
+		fmt.Printf("%s [%s]\n", group.Example, scope)
+		fmt.Printf("  keep   %s\n", group.Keep.ID)
+		for _, entry := range group.Remove {
+			if *dryRun {
+				fmt.Printf("  remove %s (dry run)\n", entry.ID)
+				continue
+			}
+			if err := deleteFromCache(ctx, semanticCache, entry.ID); err != nil {
+				fmt.Printf("  Warning: Error removing %s: %v\n", entry.ID, err)
+				continue
+			}
+			if err := index.Forget(ctx, semanticMember(entry.ID)); err != nil {
+				fmt.Printf("  Warning: Error removing %s from the source index: %v\n", entry.ID, err)
+			}
+			fmt.Printf("  ✓ removed %s\n", entry.ID)
+			removed++
+		}
+	}
+	fmt.Println(strings.Repeat("=", 70))
+
+	if *dryRun {
+		count := 0
+		for _, group := range groups {
+			count += len(group.Remove)
+		}
+		fmt.Printf("%d duplicate entries in %d groups (dry run, nothing removed)\n", count, len(groups))
+		return
+	}
+	fmt.Printf("%d duplicate entries removed from %d groups\n", removed, len(groups))
+}
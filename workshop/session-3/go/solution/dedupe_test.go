@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"session3/langcache"
+	"session3/semcache"
+)
+
+// keyed returns an entry saved with an idempotency key and attributes
+func keyed(id, prompt string, attributes map[string]string) langcache.Entry {
+	stored := map[string]string{idempotencyAttribute: idempotencyKey(prompt)}
+	for name, value := range attributes {
+		stored[name] = value
+	}
+	return langcache.Entry{ID: id, Prompt: prompt, Attributes: stored}
+}
+
+// legacy returns an entry saved before upserts, without a key
+func legacy(id, prompt string, attributes map[string]string) langcache.Entry {
+	return langcache.Entry{ID: id, Prompt: prompt, Attributes: attributes}
+}
+
+func TestEntryIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry langcache.Entry
+		want  string
+	}{
+		{"key attribute", langcache.Entry{Prompt: "Other question", Attributes: map[string]string{idempotencyAttribute: "abc"}}, "abc"},
+		{"legacy entry", legacy("1", "What is the capital of France?", nil), idempotencyKey("what is the capital of france?")},
+		{"legacy phrasing", legacy("1", "  WHAT is the capital of France?\n", map[string]string{"lang": "en"}), idempotencyKey("What is the capital of France?")},
+		{"empty key attribute", langcache.Entry{Prompt: "Q", Attributes: map[string]string{idempotencyAttribute: ""}}, idempotencyKey("Q")},
+	}
+	for _, tt := range tests {
+		if got := entryIdempotencyKey(tt.entry); got != tt.want {
+			t.Errorf("%s: entryIdempotencyKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntryScope(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry langcache.Entry
+		want  string
+	}{
+		{"no attributes", legacy("1", "Q", nil), ""},
+		{"only the key", keyed("1", "Q", nil), ""},
+		{"key and scope", keyed("1", "Q", map[string]string{"model": "llama3.2:3b", "lang": "en"}), "lang=en, model=llama3.2:3b"},
+		{"legacy scope", legacy("1", "Q", map[string]string{"lang": "en"}), "lang=en"},
+	}
+	for _, tt := range tests {
+		if got := entryScope(tt.entry); got != tt.want {
+			t.Errorf("%s: entryScope = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	en, fr := map[string]string{"lang": "en"}, map[string]string{"lang": "fr"}
+	tests := []struct {
+		name    string
+		entries []langcache.Entry
+		want    []string // "keep:remove,remove" per group
+	}{
+		{
+			name:    "no duplicates",
+			entries: []langcache.Entry{keyed("1", "What is the capital of France?", nil), keyed("2", "How do volcanoes form?", nil)},
+		},
+		{
+			name: "first keyed entry kept",
+			entries: []langcache.Entry{
+				legacy("1", "What is the capital of France?", nil),
+				keyed("2", "what is the capital of france?", nil),
+				keyed("3", "WHAT IS THE CAPITAL OF FRANCE?", nil),
+			},
+			want: []string{"2:1,3"},
+		},
+		{
+			name: "first entry kept without keys",
+			entries: []langcache.Entry{
+				legacy("1", "What is the capital of France?", nil),
+				legacy("2", " What is the capital of France? ", nil),
+			},
+			want: []string{"1:2"},
+		},
+		{
+			name: "scopes kept apart",
+			entries: []langcache.Entry{
+				keyed("1", "What is the capital of France?", en),
+				keyed("2", "What is the capital of France?", fr),
+				keyed("3", "What is the capital of France?", nil),
+				legacy("4", "What is the capital of France?", fr),
+			},
+			want: []string{"2:4"},
+		},
+		{
+			name: "groups in order of first entry",
+			entries: []langcache.Entry{
+				keyed("1", "How do volcanoes form?", nil),
+				keyed("2", "What is the capital of France?", nil),
+				keyed("3", "What is the capital of France?", nil),
+				keyed("4", "How do volcanoes form?", nil),
+			},
+			want: []string{"1:4", "2:3"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, group := range findDuplicates(tt.entries) {
+			var removed []string
+			for _, entry := range group.Remove {
+				removed = append(removed, entry.ID)
+			}
+			got = append(got, group.Keep.ID+":"+strings.Join(removed, ","))
+			if group.Scope != entryScope(group.Keep) || group.Example != group.Keep.Prompt {
+				t.Errorf("%s: group %+v does not describe the kept entry", tt.name, group)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: findDuplicates = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSaveToCacheUpserts(t *testing.T) {
+	cache := &stubSemanticCache{}
+	ctx := context.Background()
+	response := &Response{Answer: "Paris"}
+	question := "What is the capital of France?"
+
+	// An entry saved before upserts, without a key, is replaced too
+	cache.entries = append(cache.entries, legacy("legacy", question, nil))
+	if err := saveToCache(ctx, cache, nil, question, response, nil, 0); err != nil {
+		t.Fatalf("saveToCache: %v", err)
+	}
+	if err := saveToCache(ctx, cache, nil, "  WHAT is the capital of France? ", response, nil, 0); err != nil {
+		t.Fatalf("saveToCache: %v", err)
+	}
+	if len(cache.entries) != 1 || cache.entries[0].ID != "entry-2" || cache.entries[0].Attributes[idempotencyAttribute] != idempotencyKey(question) {
+		t.Errorf("entries after two saves = %+v, want only entry-2 with its key", cache.entries)
+	}
+
+	// Entries in another scope stay
+	if err := saveToCache(ctx, cache, nil, question, response, map[string]string{"lang": "en"}, 0); err != nil {
+		t.Fatalf("saveToCache: %v", err)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("a scoped save replaced the unscoped entry: %+v", cache.entries)
+	}
+
+	// A failed delete fails the save
+	cache.failDelete = map[string]bool{"entry-2": true}
+	if err := saveToCache(ctx, cache, nil, question, response, nil, 0); err == nil || !strings.Contains(err.Error(), "entry-2") {
+		t.Errorf("saveToCache with a failing delete: err = %v, want it to name entry-2", err)
+	}
+}
+
+func TestSaveToCacheConcurrent(t *testing.T) {
+	cache, err := semcache.Open(context.Background(), filepath.Join(t.TempDir(), "cache.json"), semcache.NewNGramEmbedder(0))
+	if err != nil {
+		t.Fatalf("opening cache: %v", err)
+	}
+
+	// Saves of one question in one process never leave a duplicate
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := saveToCache(context.Background(), cache, nil, "What is the capital of France?", &Response{Answer: "Paris"}, nil, 0); err != nil {
+				t.Errorf("saveToCache: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := cache.Entries(context.Background())
+	if err != nil || len(entries) != 1 {
+		t.Errorf("entries after concurrent saves = %d, %v; want 1", len(entries), err)
+	}
+	if len(saveLocks.locks) != 0 {
+		t.Errorf("%d save locks left after every save finished", len(saveLocks.locks))
+	}
+}
@@ -0,0 +1,209 @@
+// Package emulator implements a local, LangCache-compatible HTTP server for
+// offline development and CI. Entries are embedded with the deterministic
+// semcache.NGramEmbedder, searched by cosine similarity and persisted to disk.
+package emulator
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"session3/langcache"
+)
+
+// DefaultSimilarityThreshold is used when a search does not specify one
+const DefaultSimilarityThreshold = 0.8
+
+// Server serves the LangCache entries API from a Store
+type Server struct {
+	Store  *Store
+	APIKey string // Required bearer token; empty disables authentication
+}
+
+// NewServer creates a server backed by store that requires apiKey
+func NewServer(store *Store, apiKey string) *Server {
+	return &Server{Store: store, APIKey: apiKey}
+}
+
+// searchRequest accepts both the snake_case and camelCase threshold fields
+type searchRequest struct {
+	langcache.SearchRequest
+	SimilarityThresholdCamel *float64 `json:"similarityThreshold,omitempty"`
+}
+
+// errorResponse is the JSON body of every error
+type errorResponse struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// ServeHTTP routes /v1/caches/{cacheId}/entries[...] and /v1/caches/{cacheId}/flush
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "caches" || parts[2] == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	cacheID, resource, rest := parts[2], parts[3], parts[4:]
+
+	switch {
+	case resource == "flush" && len(rest) == 0 && r.Method == http.MethodPost:
+		s.handleFlush(w, cacheID)
+	case resource != "entries":
+		writeError(w, http.StatusNotFound, "not found")
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		s.handleSet(w, r, cacheID)
+	case len(rest) == 0 && r.Method == http.MethodDelete:
+		s.handleDeleteByAttributes(w, r, cacheID)
+	case len(rest) == 1 && rest[0] == "search" && r.Method == http.MethodPost:
+		s.handleSearch(w, r, cacheID)
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		s.handleGet(w, cacheID, rest[0])
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		s.handleDelete(w, cacheID, rest[0])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.APIKey == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.APIKey)) == 1
+}
+
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request, cacheID string) {
+	var req langcache.SetRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Prompt == "" || req.Response == "" {
+		writeError(w, http.StatusBadRequest, "prompt and response are required")
+		return
+	}
+
+	entryID, err := s.Store.Set(cacheID, req)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, langcache.SetResponse{EntryID: entryID})
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, cacheID string) {
+	var req searchRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Prompt == "" {
+		writeError(w, http.StatusBadRequest, "prompt is required")
+		return
+	}
+
+	threshold := DefaultSimilarityThreshold
+	if req.SimilarityThreshold != nil {
+		threshold = *req.SimilarityThreshold
+	} else if req.SimilarityThresholdCamel != nil {
+		threshold = *req.SimilarityThresholdCamel
+	}
+	if threshold < 0 || threshold > 1 {
+		writeError(w, http.StatusBadRequest, "similarity threshold must be between 0 and 1")
+		return
+	}
+
+	data := s.Store.Search(cacheID, req.Prompt, threshold, req.Attributes)
+	if data == nil {
+		data = []langcache.Entry{}
+	}
+	writeJSON(w, http.StatusOK, langcache.SearchResponse{Data: data})
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, cacheID, entryID string) {
+	entry, ok := s.Store.Get(cacheID, entryID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("entry %s not found", entryID))
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, cacheID, entryID string) {
+	found, err := s.Store.Delete(cacheID, entryID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("entry %s not found", entryID))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDeleteByAttributes(w http.ResponseWriter, r *http.Request, cacheID string) {
+	var req langcache.DeleteQueryRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.Attributes) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one attribute is required")
+		return
+	}
+
+	count, err := s.Store.DeleteByAttributes(cacheID, req.Attributes)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, langcache.DeleteQueryResponse{DeletedEntriesCount: count})
+}
+
+func (s *Server) handleFlush(w http.ResponseWriter, cacheID string) {
+	if err := s.Store.Flush(cacheID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeBody decodes a JSON request body, writing a 400 on failure
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, errorResponse{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Printf("emulator: %v", err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
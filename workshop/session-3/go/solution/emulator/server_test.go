@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"session3/langcache"
+)
+
+// newTestEmulator starts an emulator persisting to a temporary file and
+// returns a LangCache client for it
+func newTestEmulator(t *testing.T, path string) *langcache.Client {
+	t.Helper()
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	server := httptest.NewServer(NewServer(store, "test-key"))
+	t.Cleanup(server.Close)
+
+	return langcache.New(server.URL, "cache", "test-key")
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emulator.json")
+	client := newTestEmulator(t, path)
+	ctx := context.Background()
+
+	english := map[string]string{"language": "en"}
+	id, err := client.Set(ctx, "What is the capital of France?", "Paris", langcache.WithAttributes(english))
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := client.Set(ctx, "What is the capital of France?", "Paris (fr)", langcache.WithAttributes(map[string]string{"language": "fr"})); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	resp, err := client.Search(ctx, "what is the capital of france", langcache.WithSearchAttributes(english))
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].ID != id || resp.Data[0].Response != "Paris" || *resp.Data[0].Similarity < DefaultSimilarityThreshold {
+		t.Errorf("Search = %+v, want only entry %s", resp.Data, id)
+	}
+
+	resp, err = client.Search(ctx, "How do volcanoes form?")
+	if err != nil || len(resp.Data) != 0 {
+		t.Errorf("unrelated Search = %+v, %v; want no entries", resp, err)
+	}
+
+	// Entries survive a restart
+	entry, err := newTestEmulator(t, path).GetEntry(ctx, id)
+	if err != nil || entry.Prompt != "What is the capital of France?" || entry.Attributes["language"] != "en" {
+		t.Errorf("GetEntry after reload = %+v, %v", entry, err)
+	}
+
+	if err := client.DeleteEntry(ctx, id); err != nil {
+		t.Fatalf("DeleteEntry: %v", err)
+	}
+	if _, err := client.GetEntry(ctx, id); !langcache.IsNotFound(err) {
+		t.Errorf("GetEntry after delete: err = %v, want not found", err)
+	}
+	if err := client.DeleteEntry(ctx, id); !langcache.IsNotFound(err) {
+		t.Errorf("second DeleteEntry: err = %v, want not found", err)
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	client := newTestEmulator(t, "")
+	ctx := context.Background()
+
+	expiring, err := client.Set(ctx, "What is Redis?", "A database.", langcache.WithTTL(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	lasting, err := client.Set(ctx, "What is Redis Stack?", "Redis with modules.")
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if _, err := client.GetEntry(ctx, expiring); err != nil {
+		t.Fatalf("GetEntry before expiry: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := client.GetEntry(ctx, expiring); !langcache.IsNotFound(err) {
+		t.Errorf("GetEntry after expiry: err = %v, want not found", err)
+	}
+	resp, err := client.Search(ctx, "What is Redis?", langcache.WithSimilarityThreshold(0.1))
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	for _, entry := range resp.Data {
+		if entry.ID == expiring {
+			t.Errorf("Search returned the expired entry")
+		}
+	}
+	if _, err := client.GetEntry(ctx, lasting); err != nil {
+		t.Errorf("GetEntry of the entry without TTL: %v", err)
+	}
+}
+
+func TestDeleteByAttributes(t *testing.T) {
+	client := newTestEmulator(t, "")
+	ctx := context.Background()
+
+	for _, tenant := range []string{"acme", "acme", "globex"} {
+		if _, err := client.Set(ctx, "What is Redis?", "A database.", langcache.WithAttributes(map[string]string{"tenant": tenant})); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	count, err := client.DeleteByAttributes(ctx, map[string]string{"tenant": "acme"})
+	if err != nil || count != 2 {
+		t.Errorf("DeleteByAttributes = %d, %v; want 2", count, err)
+	}
+	resp, err := client.Search(ctx, "What is Redis?")
+	if err != nil || len(resp.Data) != 1 || resp.Data[0].Attributes["tenant"] != "globex" {
+		t.Errorf("Search after delete = %+v, %v; want only the globex entry", resp, err)
+	}
+
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if resp, _ := client.Search(ctx, "What is Redis?"); len(resp.Data) != 0 {
+		t.Errorf("Search after flush = %+v, want no entries", resp.Data)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	store, _ := NewStore("")
+	server := httptest.NewServer(NewServer(store, "test-key"))
+	defer server.Close()
+	ctx := context.Background()
+
+	for _, key := range []string{"", "wrong-key"} {
+		_, err := langcache.New(server.URL, "cache", key).Search(ctx, "What is Redis?")
+		if !errors.Is(err, langcache.ErrUnauthorized) {
+			t.Errorf("key %q: err = %v, want unauthorized", key, err)
+		}
+	}
+	if _, err := langcache.New(server.URL, "cache", "test-key").Search(ctx, "What is Redis?"); err != nil {
+		t.Errorf("valid key: %v", err)
+	}
+
+	// An empty API key disables authentication
+	open := httptest.NewServer(NewServer(store, ""))
+	defer open.Close()
+	if _, err := langcache.New(open.URL, "cache", "anything").Search(ctx, "What is Redis?"); err != nil {
+		t.Errorf("open server: %v", err)
+	}
+}
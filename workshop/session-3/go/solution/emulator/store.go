@@ -0,0 +1,272 @@
+package emulator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"session3/langcache"
+	"session3/semcache"
+)
+
+// storedEntry is a cache entry as kept in memory and on disk
+type storedEntry struct {
+	ID         string            `json:"id"`
+	Prompt     string            `json:"prompt"`
+	Response   string            `json:"response"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+
+	vector []float32 // Recomputed on load, never persisted
+}
+
+func (e *storedEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+func (e *storedEntry) matches(attributes map[string]string) bool {
+	for name, value := range attributes {
+		if e.Attributes[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *storedEntry) toEntry(similarity *float64) langcache.Entry {
+	return langcache.Entry{
+		ID:         e.ID,
+		Prompt:     e.Prompt,
+		Response:   e.Response,
+		Attributes: e.Attributes,
+		Similarity: similarity,
+	}
+}
+
+// Store holds the entries of every cache, keyed by cache ID and entry ID.
+// When a path is set, the whole store is rewritten to it after each change.
+type Store struct {
+	mu       sync.RWMutex
+	path     string
+	embedder *semcache.NGramEmbedder
+	caches   map[string]map[string]*storedEntry
+}
+
+// NewStore creates a store persisted to path, loading any existing data.
+// An empty path keeps everything in memory.
+func NewStore(path string) (*Store, error) {
+	// The embedder is never fitted, so scores do not drift as entries are added
+	s := &Store{
+		path:     path,
+		embedder: semcache.NewNGramEmbedder(0),
+		caches:   make(map[string]map[string]*storedEntry),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.caches); err != nil {
+		return nil, err
+	}
+	for _, entries := range s.caches {
+		for _, entry := range entries {
+			entry.vector = s.embed(entry.Prompt)
+		}
+	}
+
+	return s, nil
+}
+
+// embed returns the deterministic n-gram vector of text
+func (s *Store) embed(text string) []float32 {
+	vectors, _ := s.embedder.Embed(context.Background(), []string{text})
+	return vectors[0]
+}
+
+// Set stores a new entry and returns its ID
+func (s *Store) Set(cacheID string, req langcache.SetRequest) (string, error) {
+	id, err := newEntryID()
+	if err != nil {
+		return "", err
+	}
+
+	entry := &storedEntry{
+		ID:         id,
+		Prompt:     req.Prompt,
+		Response:   req.Response,
+		Attributes: req.Attributes,
+		CreatedAt:  time.Now().UTC(),
+		vector:     s.embed(req.Prompt),
+	}
+	if req.TTLMillis > 0 {
+		expiresAt := entry.CreatedAt.Add(time.Duration(req.TTLMillis) * time.Millisecond)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.caches[cacheID] == nil {
+		s.caches[cacheID] = make(map[string]*storedEntry)
+	}
+	s.caches[cacheID][id] = entry
+
+	return id, s.saveLocked()
+}
+
+// Search returns entries at least threshold similar to the prompt and
+// carrying all of the given attributes, most similar first
+func (s *Store) Search(cacheID, prompt string, threshold float64, attributes map[string]string) []langcache.Entry {
+	query := s.embed(prompt)
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []langcache.Entry
+	for _, entry := range s.caches[cacheID] {
+		if entry.expired(now) || !entry.matches(attributes) {
+			continue
+		}
+		similarity := semcache.Cosine(query, entry.vector)
+		if similarity < threshold {
+			continue
+		}
+		results = append(results, entry.toEntry(&similarity))
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return *results[i].Similarity > *results[j].Similarity
+	})
+
+	return results
+}
+
+// Get returns a single entry, or false if it does not exist or has expired
+func (s *Store) Get(cacheID, entryID string) (langcache.Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.caches[cacheID][entryID]
+	if !ok || entry.expired(time.Now()) {
+		return langcache.Entry{}, false
+	}
+	return entry.toEntry(nil), true
+}
+
+// Delete removes a single entry and reports whether it existed
+func (s *Store) Delete(cacheID, entryID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.caches[cacheID][entryID]; !ok {
+		return false, nil
+	}
+	delete(s.caches[cacheID], entryID)
+
+	return true, s.saveLocked()
+}
+
+// DeleteByAttributes removes every entry carrying all of the given
+// attributes and returns how many were removed
+func (s *Store) DeleteByAttributes(cacheID string, attributes map[string]string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for id, entry := range s.caches[cacheID] {
+		if entry.matches(attributes) {
+			delete(s.caches[cacheID], id)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	return count, s.saveLocked()
+}
+
+// Flush removes every entry of a cache
+func (s *Store) Flush(cacheID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.caches, cacheID)
+	return s.saveLocked()
+}
+
+// PurgeExpired drops expired entries from every cache
+func (s *Store) PurgeExpired() error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := false
+	for _, entries := range s.caches {
+		for id, entry := range entries {
+			if entry.expired(now) {
+				delete(entries, id)
+				purged = true
+			}
+		}
+	}
+	if !purged {
+		return nil
+	}
+
+	return s.saveLocked()
+}
+
+// saveLocked writes the store to disk atomically. Callers must hold s.mu.
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.caches)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// newEntryID returns a random 128-bit hex ID
+func newEntryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// statFlagged counts flagged answers in the tier stats
+const statFlagged = "flagged"
+
+// FlagEntry records a user reporting a wrong cached answer
+type FlagEntry struct {
+	Timestamp time.Time
+	Question  string            // The question as asked
+	Prompt    string            // The stored question whose answer was served
+	EntryID   string            // Semantic cache entry, empty for exact-tier answers
+	Scope     map[string]string // Cache attributes the answer was served under
+	By        string
+	Reason    string
+}
+
+// FeedbackLog records flags in a Redis Stream and counts them per stored
+// question and scope. Questions flagged Threshold times or more are no
+// longer served from the cache in that scope.
+type FeedbackLog struct {
+	Client    *redis.Client
+	Stream    string
+	CountsKey string
+	Threshold int64
+}
+
+// NewFeedbackLog creates a feedback log using FLAG_STREAM and
+// FLAG_THRESHOLD from the environment (defaults: aishe:flags, 3 flags)
+func NewFeedbackLog(client *redis.Client) *FeedbackLog {
+	stream := os.Getenv("FLAG_STREAM")
+	if stream == "" {
+		stream = "aishe:flags"
+	}
+
+	threshold := int64(3)
+	if thresholdStr := os.Getenv("FLAG_THRESHOLD"); thresholdStr != "" {
+		if parsed, err := strconv.ParseInt(thresholdStr, 10, 64); err == nil && parsed > 0 {
+			threshold = parsed
+		}
+	}
+
+	return &FeedbackLog{
+		Client:    client,
+		Stream:    stream,
+		CountsKey: stream + ":counts",
+		Threshold: threshold,
+	}
+}
+
+// Record appends a flag to the stream and bumps the flag count of both the
+// stored and the asked question in the entry's scope. It returns the stored
+// question's new count.
+func (f *FeedbackLog) Record(ctx context.Context, entry FlagEntry) (int64, error) {
+	pipe := f.Client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: f.Stream,
+		Values: map[string]interface{}{
+			"timestamp": entry.Timestamp.UTC().Format(time.RFC3339Nano),
+			"question":  entry.Question,
+			"prompt":    entry.Prompt,
+			"entry_id":  entry.EntryID,
+			"scope":     formatAttributes(entry.Scope),
+			"by":        entry.By,
+			"reason":    entry.Reason,
+		},
+	})
+	prompt, question := exactCacheKey(entry.Prompt, entry.Scope), exactCacheKey(entry.Question, entry.Scope)
+	count := pipe.HIncrBy(ctx, f.CountsKey, prompt, 1)
+	if question != prompt {
+		pipe.HIncrBy(ctx, f.CountsKey, question, 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// Count returns how many times a question has been flagged in a scope.
+// Counts are keyed like exact-tier entries, so unscoped counts keep the
+// bare question key.
+func (f *FeedbackLog) Count(ctx context.Context, question string, attributes map[string]string) (int64, error) {
+	count, err := f.Client.HGet(ctx, f.CountsKey, exactCacheKey(question, attributes)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+// Blocked reports whether a question has been flagged too often to be
+// served from the cache in a scope. Lookup failures count as not blocked
+// because feedback must never break an ask. A nil log blocks nothing.
+func (f *FeedbackLog) Blocked(question string, attributes map[string]string) bool {
+	if f == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	count, err := f.Count(ctx, question, attributes)
+	if err != nil {
+		fmt.Printf("Warning: Error reading flags: %v\n", err)
+		return false
+	}
+	return count >= f.Threshold
+}
+
+// Filter drops candidates whose stored question is blocked in the scope
+// searched. A nil log keeps every candidate.
+func (f *FeedbackLog) Filter(candidates []*CachedResponse, attributes map[string]string) []*CachedResponse {
+	if f == nil {
+		return candidates
+	}
+
+	var kept []*CachedResponse
+	for _, candidate := range candidates {
+		if !f.Blocked(candidate.Prompt, attributes) {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+// runFlag implements the "flag" command: it removes the cached answer that
+// would be served for a question and records who flagged it and why
+func runFlag(args []string) {
+	fs := flag.NewFlagSet("flag", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the cached answer is wrong")
+	by := fs.String("by", os.Getenv("USER"), "who is flagging the answer")
+	entryID := fs.String("entry", "", "flag this semantic cache entry instead of the best match")
+	scope := fs.String("scope", "", "comma-separated attributes that scope cache entries (default: CACHE_SCOPE)")
+	attrs := attributeFlag{}
+	fs.Var(attrs, "attr", "set a cache attribute as key=value (repeatable)")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || *reason == "" {
+		fmt.Println("Usage: go run . flag --reason <why> [--by name] [--entry id] [--scope ...] [--attr key=value] <question>")
+		os.Exit(1)
+	}
+	question := strings.Join(fs.Args(), " ")
+
+	attributes, err := loadCacheAttributes(getAISHEURL(), *scope, attrs)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	threshold, err := loadSimilarityThreshold()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	rdb := newRedisClient()
+	if rdb == nil {
+		fmt.Println("Error: Could not connect to Redis (set REDIS_ADDR)")
+		os.Exit(1)
+	}
+	defer rdb.Close()
+
+	semanticCache := loadSemanticCache()
+	defer closeSemanticCache(semanticCache)
+
+	exactCache, err := NewExactCache(rdb)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	feedback := NewFeedbackLog(rdb)
+	tiered := &TieredCache{
+		Exact:    exactCache,
+		Semantic: semanticCache,
+		Index:    NewSourceIndex(rdb),
+		Guard:    NewHitGuard(nil, false),
+		Feedback: feedback,
+	}
+	ctx := context.Background()
+
+	entry := FlagEntry{
+		Timestamp: time.Now(),
+		Question:  question,
+		Prompt:    question,
+		EntryID:   *entryID,
+		Scope:     attributes,
+		By:        *by,
+		Reason:    *reason,
+	}
+	fmt.Printf("Flagging cached answer for: %s\n", question)
+
+	// Drop the exact-tier copy of the question as asked, which may have been
+	// promoted from the semantic match
+	deleted, err := tiered.DeleteExact(ctx, exactCacheKey(question, attributes))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if deleted > 0 {
+		fmt.Println("  ✓ Removed exact cache entry")
+	}
+
+	// Find the semantic entry that would be served, unless one was named
+	if entry.EntryID != "" {
+		named, err := semanticCache.Get(ctx, entry.EntryID)
+		if err != nil {
+			fmt.Printf("Error: Could not read semantic cache entry %s: %v\n", entry.EntryID, err)
+			os.Exit(1)
+		}
+		entry.Prompt = named.Prompt
+		entry.Scope = entryAttributes(*named)
+	} else {
+		candidates, err := tiered.Candidates(ctx, question, threshold, attributes, guardCandidates)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(candidates) > 0 {
+			entry.EntryID = candidates[0].EntryID
+			entry.Prompt = candidates[0].Prompt
+		}
+	}
+	if entry.EntryID != "" {
+		copies, err := tiered.DeleteEntry(ctx, entry.EntryID)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("  ✓ Removed semantic cache entry %s (%s)\n", entry.EntryID, entry.Prompt)
+		if copies > 0 {
+			fmt.Printf("  ✓ Removed %d exact cache copies of it\n", copies)
+		}
+	}
+	if deleted == 0 && entry.EntryID == "" {
+		fmt.Println("  No cached answer found; recording the flag anyway")
+	}
+
+	count, err := feedback.Record(ctx, entry)
+	if err != nil {
+		fmt.Printf("Error: Could not record flag: %v\n", err)
+		os.Exit(1)
+	}
+	NewTierStats(rdb).Incr(statFlagged)
+
+	fmt.Printf("\nFlag recorded by %s: %s\n", entry.By, entry.Reason)
+	if count >= feedback.Threshold {
+		fmt.Printf("%q has been flagged %d times and will no longer be served from the cache\n", entry.Prompt, count)
+	} else {
+		fmt.Printf("%q has been flagged %d of %d times before it stops being served\n", entry.Prompt, count, feedback.Threshold)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestFeedbackLog(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	stream := "aishe:test:flags:" + testID(t)
+	feedback := &FeedbackLog{Client: rdb, Stream: stream, CountsKey: stream + ":counts", Threshold: 2}
+	t.Cleanup(func() { rdb.Del(context.Background(), feedback.Stream, feedback.CountsKey) })
+
+	scope := map[string]string{"lang": "fr"}
+	entry := FlagEntry{
+		Timestamp: time.Now(),
+		Question:  "How many people live in Paris?",
+		Prompt:    "What is the population of Paris?",
+		EntryID:   "entry-1",
+		Scope:     scope,
+		By:        "alice",
+		Reason:    "outdated",
+	}
+	if count, err := feedback.Record(ctx, entry); err != nil || count != 1 {
+		t.Fatalf("Record = %d, %v; want 1", count, err)
+	}
+	if feedback.Blocked(entry.Prompt, scope) {
+		t.Error("blocked after one flag, want two")
+	}
+	if count, err := feedback.Record(ctx, entry); err != nil || count != 2 {
+		t.Fatalf("second Record = %d, %v; want 2", count, err)
+	}
+
+	// Both the stored and the asked question are blocked, in any phrasing,
+	// but only in the scope they were flagged in
+	for _, question := range []string{entry.Prompt, entry.Question, "  what is the POPULATION of paris? "} {
+		if !feedback.Blocked(question, scope) {
+			t.Errorf("Blocked(%q) = false after two flags", question)
+		}
+	}
+	for _, other := range []map[string]string{nil, {"lang": "en"}, {"lang": "fr", "user": "bob"}} {
+		if feedback.Blocked(entry.Prompt, other) {
+			t.Errorf("flags in %v blocked the question in %v", scope, other)
+		}
+	}
+
+	candidates := []*CachedResponse{
+		{EntryID: "entry-1", Prompt: entry.Prompt},
+		{EntryID: "entry-2", Prompt: "What is the capital of France?"},
+	}
+	if kept := feedback.Filter(candidates, scope); len(kept) != 1 || kept[0].EntryID != "entry-2" {
+		t.Errorf("Filter kept %+v, want only entry-2", kept)
+	}
+	if kept := feedback.Filter(candidates, nil); len(kept) != 2 {
+		t.Errorf("Filter in another scope kept %d candidates, want 2", len(kept))
+	}
+
+	messages, err := rdb.XRange(ctx, feedback.Stream, "-", "+").Result()
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("XRange = %d messages, %v; want 2", len(messages), err)
+	}
+	if values := messages[0].Values; values["prompt"] != entry.Prompt || values["scope"] != "lang=fr" || values["by"] != "alice" {
+		t.Errorf("stream message = %v", values)
+	}
+}
+
+func TestFeedbackLogUnavailable(t *testing.T) {
+	// Feedback never breaks an ask: without Redis, or without a log,
+	// nothing is blocked
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:1", MaxRetries: -1})
+	defer rdb.Close()
+	feedback := &FeedbackLog{Client: rdb, Stream: "aishe:flags", CountsKey: "aishe:flags:counts", Threshold: 1}
+	if feedback.Blocked("What is the capital of France?", nil) {
+		t.Error("Blocked without Redis = true, want false")
+	}
+
+	var none *FeedbackLog
+	candidates := []*CachedResponse{{EntryID: "entry-1"}}
+	if none.Blocked("What is the capital of France?", nil) || len(none.Filter(candidates, nil)) != 1 {
+		t.Error("a nil log blocked something")
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Counters kept by TierStats for the false-positive guard
+const (
+	statGuardAccepted = "guard_accepted"
+	statGuardRejected = "guard_rejected"
+)
+
+// guardCandidates is how many semantic candidates are verified before
+// giving up and asking AISHE
+const guardCandidates = 5
+
+var (
+	numberPattern = regexp.MustCompile(`\d+(?:[.,]\d+)*`)
+	wordPattern   = regexp.MustCompile(`[\p{L}\p{N}']+`)
+	quotedPattern = regexp.MustCompile(`"([^"]+)"|“([^”]+)”`)
+)
+
+// numberWords maps spelled-out numbers to digits so "three" and "3", or
+// "Second World War" and "World War II", agree ("one" and "first" are left
+// out because they are mostly used as a pronoun and an adverb)
+var numberWords = map[string]string{
+	"zero": "0", "two": "2", "three": "3", "four": "4", "five": "5", "six": "6",
+	"seven": "7", "eight": "8", "nine": "9", "ten": "10", "eleven": "11", "twelve": "12",
+	"twenty": "20",
+	"second": "2", "third": "3", "fourth": "4", "fifth": "5", "sixth": "6",
+	"seventh": "7", "eighth": "8", "ninth": "9", "tenth": "10",
+}
+
+// romanNumerals are the symbols of Roman numerals, largest first, with the
+// subtractive pairs
+var romanNumerals = []struct {
+	symbol string
+	value  int
+}{
+	{"M", 1000}, {"CM", 900}, {"D", 500}, {"CD", 400}, {"C", 100}, {"XC", 90},
+	{"L", 50}, {"XL", 40}, {"X", 10}, {"IX", 9}, {"V", 5}, {"IV", 4}, {"I", 1},
+}
+
+// romanNumber returns the value of a well-formed uppercase Roman numeral
+// as digits, or "" when word is not one. Only I, V and X are read, which
+// covers regnal and war numbers without taking "DC" or "MD" for numbers.
+func romanNumber(word string) string {
+	if strings.Trim(word, "IVX") != "" {
+		return ""
+	}
+	rest, value := word, 0
+	for _, numeral := range romanNumerals {
+		for strings.HasPrefix(rest, numeral.symbol) {
+			rest = rest[len(numeral.symbol):]
+			value += numeral.value
+		}
+	}
+	if word == "" || rest != "" || toRoman(value) != word {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// toRoman writes a number as a Roman numeral
+func toRoman(value int) string {
+	var b strings.Builder
+	for _, numeral := range romanNumerals {
+		for value >= numeral.value {
+			b.WriteString(numeral.symbol)
+			value -= numeral.value
+		}
+	}
+	return b.String()
+}
+
+// negationWords flip the meaning of a question
+var negationWords = map[string]bool{
+	"not": true, "no": true, "never": true, "none": true, "nobody": true, "nothing": true,
+	"neither": true, "nor": true, "without": true, "cannot": true, "isn't": true,
+	"aren't": true, "wasn't": true, "weren't": true, "don't": true, "doesn't": true,
+	"didn't": true, "can't": true, "won't": true, "wouldn't": true, "shouldn't": true,
+	"couldn't": true, "hasn't": true, "haven't": true, "hadn't": true,
+}
+
+// questionWords are capitalized at the start of questions without being entities
+var questionWords = map[string]bool{
+	"what": true, "who": true, "whom": true, "whose": true, "which": true, "when": true,
+	"where": true, "why": true, "how": true, "is": true, "are": true, "was": true,
+	"were": true, "do": true, "does": true, "did": true, "can": true, "could": true,
+	"should": true, "would": true, "will": true, "tell": true, "explain": true,
+	"describe": true, "list": true, "name": true, "give": true, "i": true, "the": true,
+	"a": true, "an": true, "in": true, "on": true, "please": true,
+}
+
+// questionFeatures are the parts of a question a semantic match must agree on
+type questionFeatures struct {
+	Entities  []string // Lowercased proper nouns, acronyms and quoted phrases
+	Numbers   []string
+	Years     []string
+	Negations int
+}
+
+// extractFeatures pulls entities, numbers, years and negations out of a question
+func extractFeatures(text string) questionFeatures {
+	var f questionFeatures
+
+	for _, m := range quotedPattern.FindAllStringSubmatch(text, -1) {
+		f.Entities = append(f.Entities, strings.ToLower(m[1]+m[2]))
+	}
+
+	for _, raw := range numberPattern.FindAllString(text, -1) {
+		number := strings.ReplaceAll(raw, ",", "")
+		if len(number) == 4 && (number[0] == '1' || number[0] == '2') && !strings.Contains(number, ".") {
+			f.Years = append(f.Years, number)
+		} else {
+			f.Numbers = append(f.Numbers, number)
+		}
+	}
+
+	// Proper nouns are capitalized words that do not start a sentence;
+	// consecutive ones form a single entity ("New York")
+	sentenceStart := true
+	var entity []string
+	flush := func() {
+		if len(entity) > 0 {
+			f.Entities = append(f.Entities, strings.ToLower(strings.Join(entity, " ")))
+			entity = nil
+		}
+	}
+	for _, field := range strings.Fields(text) {
+		word := strings.TrimFunc(field, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' })
+		word = strings.TrimSuffix(strings.TrimSuffix(word, "'s"), "'")
+		lower := strings.ToLower(word)
+
+		switch {
+		case word == "":
+		case negationWords[lower] || strings.HasSuffix(lower, "n't"):
+			f.Negations++
+			flush()
+		case numberWords[lower] != "":
+			f.Numbers = append(f.Numbers, numberWords[lower])
+			flush()
+		case len(entity) > 0 && romanNumber(word) != "":
+			// A numeral right after a name is a number: "World War II", "Henry VIII"
+			f.Numbers = append(f.Numbers, romanNumber(word))
+			flush()
+		case isEntityWord(word, sentenceStart):
+			// Digits of an acronym are already counted as a number: "WW2"
+			if trimmed := strings.TrimRightFunc(word, unicode.IsDigit); trimmed != "" && isAcronym(word) {
+				word = trimmed
+			}
+			entity = append(entity, word)
+		default:
+			flush()
+		}
+
+		sentenceStart = strings.ContainsAny(field[len(field)-1:], ".?!:")
+		if sentenceStart {
+			flush()
+		}
+	}
+	flush()
+
+	return f
+}
+
+// isEntityWord reports whether a word looks like part of a proper noun
+func isEntityWord(word string, sentenceStart bool) bool {
+	if !unicode.IsUpper([]rune(word)[0]) {
+		return false
+	}
+	// Acronyms count even at the start of a sentence
+	if isAcronym(word) {
+		return true
+	}
+	return !sentenceStart && !questionWords[strings.ToLower(word)]
+}
+
+// isAcronym reports whether a word is written in capitals, like "NASA" or "WW2"
+func isAcronym(word string) bool {
+	return len([]rune(word)) > 1 && strings.ToUpper(word) == word
+}
+
+// entityForms returns the ways an entity can be written: itself and, for
+// names of several words, their initials ("world war" and "ww")
+func entityForms(entity string) []string {
+	words := strings.Fields(entity)
+	if len(words) < 2 {
+		return []string{entity}
+	}
+	var initials strings.Builder
+	for _, word := range words {
+		initials.WriteRune([]rune(word)[0])
+	}
+	return []string{entity, initials.String()}
+}
+
+// entityFound reports whether an entity appears in a question, either in
+// its text or as another form of one of its entities
+func entityFound(entity, text string, entities []string) bool {
+	if containsWords(text, entity) {
+		return true
+	}
+	for _, form := range entityForms(entity) {
+		for _, other := range entities {
+			for _, otherForm := range entityForms(other) {
+				if form == otherForm {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containsWords reports whether text contains phrase on word boundaries,
+// ignoring case
+func containsWords(text, phrase string) bool {
+	words := guardWords(text)
+	target := guardWords(phrase)
+	if len(target) == 0 {
+		return true
+	}
+	for i := 0; i+len(target) <= len(words); i++ {
+		match := true
+		for j := range target {
+			if words[i+j] != target[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// guardWords splits text into lowercase words without possessive suffixes
+func guardWords(text string) []string {
+	words := wordPattern.FindAllString(strings.ToLower(text), -1)
+	for i, word := range words {
+		words[i] = strings.TrimSuffix(strings.TrimSuffix(word, "'s"), "'")
+	}
+	return words
+}
+
+// sameSet reports whether two lists hold the same distinct values
+func sameSet(a, b []string) bool {
+	set := func(values []string) string {
+		seen := make(map[string]bool)
+		var distinct []string
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				distinct = append(distinct, v)
+			}
+		}
+		sort.Strings(distinct)
+		return strings.Join(distinct, "\x00")
+	}
+	return set(a) == set(b)
+}
+
+// HitGuard verifies semantic cache hits. Embeddings place "capital of
+// France" and "capital of Germany" close together, so a hit is rejected
+// when the two questions disagree on entities, numbers, years or negation.
+type HitGuard struct {
+	Stats   *TierStats
+	Verbose bool
+}
+
+// NewHitGuard creates a guard unless SEMANTIC_GUARD is "off"
+func NewHitGuard(stats *TierStats, verbose bool) *HitGuard {
+	if v := strings.ToLower(os.Getenv("SEMANTIC_GUARD")); v == "off" || v == "false" || v == "0" {
+		return nil
+	}
+	return &HitGuard{Stats: stats, Verbose: verbose}
+}
+
+// conflict returns why question and matched cannot share an answer, or ""
+func conflict(question, matched string) string {
+	q, m := extractFeatures(question), extractFeatures(matched)
+
+	if !sameSet(q.Years, m.Years) {
+		return fmt.Sprintf("years differ (%s vs %s)", formatList(q.Years), formatList(m.Years))
+	}
+	if !sameSet(q.Numbers, m.Numbers) {
+		return fmt.Sprintf("numbers differ (%s vs %s)", formatList(q.Numbers), formatList(m.Numbers))
+	}
+	if (q.Negations%2 == 1) != (m.Negations%2 == 1) {
+		return "negation differs"
+	}
+
+	// Entities are compared against the other question's text as well as
+	// its entities, so a lowercase "france" still matches "France" and
+	// "WW2" matches "World War II"
+	for _, entity := range q.Entities {
+		if !entityFound(entity, matched, m.Entities) {
+			return fmt.Sprintf("entity %q missing from matched question", entity)
+		}
+	}
+	for _, entity := range m.Entities {
+		if !entityFound(entity, question, q.Entities) {
+			return fmt.Sprintf("entity %q missing from question", entity)
+		}
+	}
+
+	return ""
+}
+
+// formatList renders a feature list for guard messages
+func formatList(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+// Filter returns the candidates whose question agrees with the asked one,
+// keeping their order. Each decision is counted and, in verbose mode,
+// printed with its reason. A nil guard accepts everything.
+func (g *HitGuard) Filter(question string, candidates []*CachedResponse) []*CachedResponse {
+	if g == nil {
+		return candidates
+	}
+
+	var accepted []*CachedResponse
+	for _, candidate := range candidates {
+		reason := conflict(question, candidate.Prompt)
+		if reason != "" {
+			g.Stats.Incr(statGuardRejected)
+			if g.Verbose {
+				fmt.Printf("  ✗ Guard rejected %q: %s\n", candidate.Prompt, reason)
+			}
+			continue
+		}
+
+		g.Stats.Incr(statGuardAccepted)
+		if g.Verbose {
+			fmt.Printf("  ✓ Guard accepted %q\n", candidate.Prompt)
+		}
+		accepted = append(accepted, candidate)
+	}
+	return accepted
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConflict(t *testing.T) {
+	tests := []struct {
+		question, matched string
+		conflict          string // Part of the expected reason, "" when they agree
+	}{
+		// Paraphrases the guard must let through
+		{"What's the capital city of France?", "What is the capital of France?", ""},
+		{"capital of france?", "What is the capital of France?", ""},
+		{"Which playwright is the author of Hamlet?", "Who wrote Hamlet?", ""},
+		{"In what year did WW2 finish?", "When did World War II end?", ""},
+		{"When did the Second World War end?", "When did World War II end?", ""},
+		{"When did World War 2 end?", "When did WW2 end?", ""},
+		{"What is the population of NY?", "What is the population of New York?", ""},
+		{"Who was Henry VIII's third wife?", "Who was the 3rd wife of Henry VIII?", ""},
+		{"What are three facts about Mars?", "Tell me 3 facts about Mars", ""},
+		{"Is 1,000 grams a kilogram?", "Is 1000 grams a kilogram?", ""},
+		{"What happened in 1969? Tell me", "What happened in 1969?", ""},
+		{"Can I visit Washington DC in winter?", "Can I visit Washington DC in winter?", ""},
+
+		// Different questions the guard must reject
+		{"What is the capital of Germany?", "What is the capital of France?", `entity "germany"`},
+		{"Who wrote Macbeth?", "Who wrote Hamlet?", `entity "macbeth"`},
+		{"When did World War I end?", "When did World War II end?", "numbers differ (1 vs 2)"},
+		{"When did WW1 end?", "When did World War II end?", "numbers differ (1 vs 2)"},
+		{"Who was the second president?", "Who was the first president?", "numbers differ"},
+		{"What happened in 1968?", "What happened in 1969?", "years differ (1968 vs 1969)"},
+		{"Name four moons of Jupiter", "Name three moons of Jupiter", "numbers differ (4 vs 3)"},
+		{"Is Pluto not a planet?", "Is Pluto a planet?", "negation differs"},
+		{"Why isn't Pluto a planet?", "Why is Pluto a planet?", "negation differs"},
+		{"What does ESA do?", "What does NASA do?", `entity "esa"`},
+		{"What is the population of New Jersey?", "What is the population of NY?", `entity "new jersey"`},
+		{`What does "to be or not" mean?`, "What does to be mean?", "negation differs"},
+	}
+
+	for _, tt := range tests {
+		got := conflict(tt.question, tt.matched)
+		switch {
+		case tt.conflict == "" && got != "":
+			t.Errorf("conflict(%q, %q) = %q, want none", tt.question, tt.matched, got)
+		case tt.conflict != "" && !strings.Contains(got, tt.conflict):
+			t.Errorf("conflict(%q, %q) = %q, want it to mention %q", tt.question, tt.matched, got, tt.conflict)
+		}
+	}
+}
+
+func TestConflictCalibrationPairs(t *testing.T) {
+	// The guard may let wrong matches through, but never block a paraphrase
+	pairs, err := loadCalibrationPairs("calibration.example.jsonl")
+	if err != nil {
+		t.Fatalf("loading calibration pairs: %v", err)
+	}
+	for _, pair := range pairs {
+		if reason := conflict(pair.Query, pair.Stored); pair.Match && reason != "" {
+			t.Errorf("guard rejects the paraphrase %q of %q: %s", pair.Query, pair.Stored, reason)
+		}
+	}
+}
+
+func TestRomanNumber(t *testing.T) {
+	tests := map[string]string{
+		"I": "1", "II": "2", "IV": "4", "VIII": "8", "IX": "9", "XIV": "14", "XXXIX": "39",
+		"IIII": "", "VV": "", "IIV": "", "DC": "", "MD": "", "XL": "", "": "", "ii": "",
+	}
+	for word, want := range tests {
+		if got := romanNumber(word); got != want {
+			t.Errorf("romanNumber(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Prefixes used for members of the source index sets. Exact-match entries
+// are stored by their Redis key (see getCacheKey), semantic entries by
+// their LangCache entry ID.
+const (
+	exactMemberPrefix    = "exact:"
+	semanticMemberPrefix = "semantic:"
+)
+
+// minSourceIndexTTL is the shortest expiration of an index set. Sets live
+// at least as long as the longest-lived entry added to them, and this long
+// for entries that keep the backend's default expiration or never expire.
+const minSourceIndexTTL = 30 * 24 * time.Hour
+
+// addToSourceIndexScript adds ARGV[1] to the source sets in KEYS, except the
+// last key, which lists the member's source sets so they can all be found
+// when the entry goes away. Every set is extended to expire no sooner than
+// ARGV[2] milliseconds from now; a set is never shortened.
+var addToSourceIndexScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local sources = KEYS[#KEYS]
+for i, key in ipairs(KEYS) do
+	if i < #KEYS then
+		redis.call('SADD', key, ARGV[1])
+		redis.call('SADD', sources, key)
+	end
+	if redis.call('PTTL', key) < ttl then
+		redis.call('PEXPIRE', key, ttl)
+	end
+end
+return 1
+`)
+
+// SourceIndex maintains a reverse index from each cited source (URL and
+// title) to the cache entries whose answers cite it
+type SourceIndex struct {
+	Client *redis.Client
+}
+
+// NewSourceIndex creates a source index stored in the given Redis client
+func NewSourceIndex(client *redis.Client) *SourceIndex {
+	return &SourceIndex{Client: client}
+}
+
+// exactMember returns the index member for an exact-match cache key
+func exactMember(cacheKey string) string {
+	return exactMemberPrefix + cacheKey
+}
+
+// semanticMember returns the index member for a LangCache entry ID
+func semanticMember(entryID string) string {
+	return semanticMemberPrefix + entryID
+}
+
+// memberSourcesKey returns the Redis set key listing the source sets a
+// member was added to
+func memberSourcesKey(member string) string {
+	return "aishe:source:member:" + member
+}
+
+// entryCopiesKey returns the Redis set key listing the exact-match entries
+// promoted from a semantic entry
+func entryCopiesKey(entryID string) string {
+	return "aishe:source:copies:" + entryID
+}
+
+// sourceIndexKey returns the Redis set key for a source URL or title.
+// URLs are matched exactly, titles case-insensitively.
+func sourceIndexKey(source string) string {
+	source = strings.TrimSpace(source)
+	kind := "title"
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		kind = "url"
+	} else {
+		source = strings.ToLower(source)
+	}
+	hash := sha256.Sum256([]byte(source))
+	return fmt.Sprintf("aishe:source:%s:%s", kind, hex.EncodeToString(hash[:]))
+}
+
+// Add records that the cache entry identified by member cites the given
+// sources. ttl is the entry's expiration (0 when it has none or keeps the
+// backend's default); the index sets outlive it. A nil index records
+// nothing.
+func (s *SourceIndex) Add(ctx context.Context, member string, sources []Source, ttl time.Duration) error {
+	if s == nil {
+		return nil
+	}
+
+	var keys []string
+	for _, source := range sources {
+		if source.URL != "" {
+			keys = append(keys, sourceIndexKey(source.URL))
+		}
+		if source.Title != "" {
+			keys = append(keys, sourceIndexKey(source.Title))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	keys = append(keys, memberSourcesKey(member))
+
+	if ttl < minSourceIndexTTL {
+		ttl = minSourceIndexTTL
+	}
+
+	return addToSourceIndexScript.Run(ctx, s.Client, keys, member, ttl.Milliseconds()).Err()
+}
+
+// AddCopy records that the exact-match entry under cacheKey is a copy of
+// the semantic entry entryID, so deleting the semantic entry can delete the
+// copy too. The copy is listed like a source of it, which Forget clears. A
+// nil index records nothing.
+func (s *SourceIndex) AddCopy(ctx context.Context, entryID, cacheKey string, ttl time.Duration) error {
+	if s == nil || entryID == "" {
+		return nil
+	}
+	if ttl < minSourceIndexTTL {
+		ttl = minSourceIndexTTL
+	}
+	member := exactMember(cacheKey)
+	keys := []string{entryCopiesKey(entryID), memberSourcesKey(member)}
+	return addToSourceIndexScript.Run(ctx, s.Client, keys, member, ttl.Milliseconds()).Err()
+}
+
+// Copies returns the exact-match cache keys recorded as copies of the
+// semantic entry entryID. A nil index has none.
+func (s *SourceIndex) Copies(ctx context.Context, entryID string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	members, err := s.Client.SMembers(ctx, entryCopiesKey(entryID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		keys = append(keys, strings.TrimPrefix(member, exactMemberPrefix))
+	}
+	return keys, nil
+}
+
+// Members returns all cache entries citing the given source URL or title
+func (s *SourceIndex) Members(ctx context.Context, source string) ([]string, error) {
+	return s.Client.SMembers(ctx, sourceIndexKey(source)).Result()
+}
+
+// Remove drops members from the index set of the given source
+func (s *SourceIndex) Remove(ctx context.Context, source string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(members))
+	for i, member := range members {
+		args[i] = member
+	}
+	return s.Client.SRem(ctx, sourceIndexKey(source), args...).Err()
+}
+
+// Forget drops members from every source set they were added to, for
+// entries that were deleted, along with the copies recorded for semantic
+// members. A nil index forgets nothing.
+func (s *SourceIndex) Forget(ctx context.Context, members ...string) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, member := range members {
+		keys, err := s.Client.SMembers(ctx, memberSourcesKey(member)).Result()
+		if err != nil {
+			return err
+		}
+
+		pipe := s.Client.Pipeline()
+		for _, key := range keys {
+			pipe.SRem(ctx, key, member)
+		}
+		pipe.Del(ctx, memberSourcesKey(member))
+		if strings.HasPrefix(member, semanticMemberPrefix) {
+			pipe.Del(ctx, entryCopiesKey(strings.TrimPrefix(member, semanticMemberPrefix)))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateSource purges every exact and semantic cache entry citing the
+// source and returns the number of entries removed
+func invalidateSource(ctx context.Context, rdb *redis.Client, cache SemanticCache, index *SourceIndex, source string) (int, error) {
+	members, err := index.Members(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+
+	var purged []string
+	var failures []string
+	for _, member := range members {
+		var err error
+		switch {
+		case strings.HasPrefix(member, exactMemberPrefix):
+			err = rdb.Del(ctx, strings.TrimPrefix(member, exactMemberPrefix)).Err()
+		case strings.HasPrefix(member, semanticMemberPrefix):
+			err = deleteFromCache(ctx, cache, strings.TrimPrefix(member, semanticMemberPrefix))
+		default:
+			err = fmt.Errorf("unknown index member")
+		}
+
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", member, err))
+			continue
+		}
+		fmt.Printf("  ✓ Purged %s\n", member)
+		purged = append(purged, member)
+	}
+
+	// Only drop the entries that were actually purged so a retry can finish
+	// the job. Forget also clears the other sources they cite; entries
+	// indexed before member sets existed are at least dropped from this one.
+	if err := index.Forget(ctx, purged...); err != nil {
+		return len(purged), err
+	}
+	if err := index.Remove(ctx, source, purged...); err != nil {
+		return len(purged), err
+	}
+	if len(failures) > 0 {
+		return len(purged), fmt.Errorf("failed to purge %d entries:\n  %s", len(failures), strings.Join(failures, "\n  "))
+	}
+
+	return len(purged), nil
+}
+
+// runInvalidate implements the "invalidate --source <url|title>" command
+func runInvalidate(args []string) {
+	fs := flag.NewFlagSet("invalidate", flag.ExitOnError)
+	source := fs.String("source", "", "URL or title of the cited article")
+	fs.Parse(args)
+
+	if *source == "" {
+		fmt.Println("Usage: go run . invalidate --source <url|title>")
+		fmt.Println("Example: go run . invalidate --source https://en.wikipedia.org/wiki/Paris")
+		os.Exit(1)
+	}
+
+	rdb := newRedisClient()
+	if rdb == nil {
+		fmt.Println("Error: Could not connect to Redis (set REDIS_ADDR)")
+		os.Exit(1)
+	}
+	defer rdb.Close()
+
+	semanticCache := loadSemanticCache()
+	defer closeSemanticCache(semanticCache)
+
+	fmt.Printf("Invalidating cached answers citing: %s\n", *source)
+	count, err := invalidateSource(context.Background(), rdb, semanticCache, NewSourceIndex(rdb), *source)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\n%d cached answers invalidated\n", count)
+}
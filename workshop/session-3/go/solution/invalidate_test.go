@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sortedMembers returns the index members citing a source, sorted
+func sortedMembers(t *testing.T, index *SourceIndex, source string) []string {
+	t.Helper()
+	members, err := index.Members(context.Background(), source)
+	if err != nil {
+		t.Fatalf("Members(%s): %v", source, err)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func TestSourceIndex(t *testing.T) {
+	rdb := newTestRedis(t)
+	index := NewSourceIndex(rdb)
+	ctx := context.Background()
+	id := testID(t)
+	url, title := "https://example.com/"+id, "Article "+id
+	other := "https://example.com/other/" + id
+
+	sources := []Source{{Number: 1, Title: title, URL: url}}
+	if err := index.Add(ctx, exactMember("key-"+id), sources, time.Hour); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := index.Add(ctx, semanticMember(id), append(sources, Source{Number: 2, URL: other}), 0); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := index.Add(ctx, semanticMember("uncited-"+id), nil, 0); err != nil {
+		t.Fatalf("Add without sources: %v", err)
+	}
+
+	// Titles match case-insensitively, URLs exactly
+	want := []string{exactMember("key-" + id), semanticMember(id)}
+	sort.Strings(want)
+	for _, source := range []string{url, title, strings.ToUpper(title), " " + title + " "} {
+		if got := sortedMembers(t, index, source); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Members(%q) = %q, want %q", source, got, want)
+		}
+	}
+	if got := sortedMembers(t, index, strings.ToUpper(url)); len(got) != 0 {
+		t.Errorf("Members of the upper-cased URL = %q, want none", got)
+	}
+
+	// Sets outlive the entries, whatever their TTL
+	if ttl := rdb.PTTL(ctx, sourceIndexKey(url)).Val(); ttl < minSourceIndexTTL-time.Minute {
+		t.Errorf("source set expires in %s, want at least %s", ttl, minSourceIndexTTL)
+	}
+
+	// Remove drops members from one source, Forget from all of them
+	if err := index.Remove(ctx, title, exactMember("key-"+id)); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := sortedMembers(t, index, title); len(got) != 1 || got[0] != semanticMember(id) {
+		t.Errorf("Members(title) after Remove = %q", got)
+	}
+	if got := sortedMembers(t, index, url); len(got) != 2 {
+		t.Errorf("Remove from the title also removed from the URL: %q", got)
+	}
+	if err := index.Forget(ctx, semanticMember(id)); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+	for _, source := range []string{url, title, other} {
+		for _, member := range sortedMembers(t, index, source) {
+			if member == semanticMember(id) {
+				t.Errorf("forgotten member still cites %s", source)
+			}
+		}
+	}
+	if rdb.Exists(ctx, memberSourcesKey(semanticMember(id))).Val() != 0 {
+		t.Error("Forget kept the member's list of sources")
+	}
+
+	// A nil index records and forgets nothing
+	var none *SourceIndex
+	if err := none.Add(ctx, semanticMember(id), sources, 0); err != nil {
+		t.Errorf("nil Add: %v", err)
+	}
+	if err := none.Forget(ctx, semanticMember(id)); err != nil {
+		t.Errorf("nil Forget: %v", err)
+	}
+}
+
+func TestInvalidateSource(t *testing.T) {
+	rdb := newTestRedis(t)
+	index := NewSourceIndex(rdb)
+	exact := &ExactCache{Client: rdb, TTL: time.Hour}
+	ctx := context.Background()
+	id := testID(t)
+	cache := &stubSemanticCache{prefix: id + "/"}
+	failing := id + "/entry-2"
+	url, other := "https://example.com/"+id, "https://example.com/other/"+id
+	response := &Response{Answer: "Paris", Sources: []Source{{Number: 1, URL: url}, {Number: 2, URL: other}}}
+
+	question := "What is the capital of France? " + id
+	if err := exact.Set(ctx, index, question, nil, response); err != nil {
+		t.Fatalf("exact Set: %v", err)
+	}
+	for _, q := range []string{question, "Which city is the capital of France? " + id} {
+		if err := saveToCache(ctx, cache, index, q, response, nil, 0); err != nil {
+			t.Fatalf("saveToCache: %v", err)
+		}
+	}
+
+	// One semantic delete fails: the others are purged and forgotten, the
+	// failed one stays indexed so a retry can finish the job
+	cache.failDelete = map[string]bool{failing: true}
+	count, err := invalidateSource(ctx, rdb, cache, index, url)
+	if err == nil || !strings.Contains(err.Error(), semanticMember(failing)) {
+		t.Errorf("invalidateSource with a failing delete: err = %v, want it to name entry-2", err)
+	}
+	if count != 2 {
+		t.Errorf("invalidateSource purged %d entries, want 2", count)
+	}
+	if rdb.Exists(ctx, exactCacheKey(question, nil)).Val() != 0 {
+		t.Error("the exact entry survived")
+	}
+	if len(cache.entries) != 1 || cache.entries[0].ID != failing {
+		t.Errorf("semantic entries left: %+v, want entry-2", cache.entries)
+	}
+	for _, source := range []string{url, other} {
+		if got := sortedMembers(t, index, source); len(got) != 1 || got[0] != semanticMember(failing) {
+			t.Errorf("Members(%s) = %q, want only the entry that failed", source, got)
+		}
+	}
+
+	cache.failDelete = nil
+	if count, err := invalidateSource(ctx, rdb, cache, index, url); err != nil || count != 1 {
+		t.Errorf("retry = %d, %v; want the remaining entry purged", count, err)
+	}
+	if len(cache.entries) != 0 || len(sortedMembers(t, index, url)) != 0 || len(sortedMembers(t, index, other)) != 0 {
+		t.Errorf("entries or index members left after the retry: %+v", cache.entries)
+	}
+}
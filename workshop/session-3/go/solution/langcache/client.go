@@ -0,0 +1,331 @@
+// Package langcache is a Go client for the Redis LangCache semantic caching
+// service. It covers storing, searching, fetching and deleting cache entries
+// as well as flushing a whole cache.
+//
+// A Client is safe for concurrent use by multiple goroutines.
+package langcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the HTTP timeout used when no http.Client is configured
+const DefaultTimeout = 30 * time.Second
+
+// Retries of rate-limited (429) requests used unless configured otherwise
+const (
+	DefaultRateLimitRetries = 3
+	DefaultMaxRetryWait     = 30 * time.Second
+)
+
+// Client is a LangCache API client. Its configuration is fixed at
+// construction time, so it can be shared between goroutines.
+type Client struct {
+	serverURL  string
+	cacheID    string
+	apiKey     string
+	httpClient *http.Client
+	timeout    time.Duration // Of the default http.Client
+
+	rateLimitRetries int
+	maxRetryWait     time.Duration
+	retryBackoff     time.Duration // First wait without Retry-After, doubled per retry
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for all requests. The client is
+// used as is: WithTimeout does not change it.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout sets the timeout of the default http.Client. It has no
+// effect when combined with WithHTTPClient, in either order.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRateLimitRetries sets how often a request rejected with 429 Too Many
+// Requests is retried, and the longest wait before a retry. The client
+// waits as long as the Retry-After header asks, or backs off exponentially
+// from half a second without one. A Retry-After longer than maxWait is
+// returned as an error right away. Zero retries disables retrying.
+func WithRateLimitRetries(retries int, maxWait time.Duration) Option {
+	return func(c *Client) {
+		c.rateLimitRetries = retries
+		c.maxRetryWait = maxWait
+	}
+}
+
+// New creates a LangCache client. serverURL may omit the scheme,
+// in which case https:// is assumed.
+func New(serverURL, cacheID, apiKey string, opts ...Option) *Client {
+	if !strings.HasPrefix(serverURL, "http") {
+		serverURL = "https://" + serverURL
+	}
+
+	c := &Client{
+		serverURL: strings.TrimRight(serverURL, "/"),
+		cacheID:   cacheID,
+		apiKey:    apiKey,
+		timeout:   DefaultTimeout,
+
+		rateLimitRetries: DefaultRateLimitRetries,
+		maxRetryWait:     DefaultMaxRetryWait,
+		retryBackoff:     500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: c.timeout}
+	}
+
+	return c
+}
+
+// ServerURL returns the base URL of the LangCache server
+func (c *Client) ServerURL() string {
+	return c.serverURL
+}
+
+// CacheID returns the ID of the cache this client operates on
+func (c *Client) CacheID() string {
+	return c.cacheID
+}
+
+// Entry is a single cache entry
+type Entry struct {
+	ID         string            `json:"id,omitempty"`
+	Prompt     string            `json:"prompt"`
+	Response   string            `json:"response"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Similarity *float64          `json:"similarity,omitempty"` // Only set on search results
+}
+
+// SearchRequest is the payload of a search call
+type SearchRequest struct {
+	Prompt              string            `json:"prompt"`
+	SimilarityThreshold *float64          `json:"similarity_threshold,omitempty"`
+	Attributes          map[string]string `json:"attributes,omitempty"`
+}
+
+// SearchResponse is the result of a search call, most similar entry first
+type SearchResponse struct {
+	Data []Entry `json:"data"`
+}
+
+// SetRequest is the payload of a set call
+type SetRequest struct {
+	Prompt     string            `json:"prompt"`
+	Response   string            `json:"response"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	TTLMillis  int64             `json:"ttlMillis,omitempty"`
+}
+
+// SetResponse is the result of a set call
+type SetResponse struct {
+	EntryID string `json:"entryId"`
+}
+
+// DeleteQueryRequest is the payload of a delete-by-attributes call
+type DeleteQueryRequest struct {
+	Attributes map[string]string `json:"attributes"`
+}
+
+// DeleteQueryResponse reports how many entries a delete-by-attributes call removed
+type DeleteQueryResponse struct {
+	DeletedEntriesCount int `json:"deletedEntriesCount"`
+}
+
+// SearchOption configures a search call
+type SearchOption func(*SearchRequest)
+
+// WithSimilarityThreshold only returns entries at least this similar (0.0 to 1.0)
+func WithSimilarityThreshold(threshold float64) SearchOption {
+	return func(r *SearchRequest) {
+		r.SimilarityThreshold = &threshold
+	}
+}
+
+// WithSearchAttributes only returns entries carrying all of these attributes
+func WithSearchAttributes(attributes map[string]string) SearchOption {
+	return func(r *SearchRequest) {
+		r.Attributes = attributes
+	}
+}
+
+// SetOption configures a set call
+type SetOption func(*SetRequest)
+
+// WithAttributes stores these attributes with the entry
+func WithAttributes(attributes map[string]string) SetOption {
+	return func(r *SetRequest) {
+		r.Attributes = attributes
+	}
+}
+
+// WithTTL expires the entry after the given duration
+func WithTTL(ttl time.Duration) SetOption {
+	return func(r *SetRequest) {
+		r.TTLMillis = ttl.Milliseconds()
+	}
+}
+
+// Search finds entries semantically similar to prompt
+func (c *Client) Search(ctx context.Context, prompt string, opts ...SearchOption) (*SearchResponse, error) {
+	req := SearchRequest{Prompt: prompt}
+	for _, opt := range opts {
+		opt(&req)
+	}
+
+	var resp SearchResponse
+	if err := c.do(ctx, "search", http.MethodPost, c.entriesPath("search"), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Set stores a prompt/response pair and returns the new entry ID
+func (c *Client) Set(ctx context.Context, prompt, response string, opts ...SetOption) (string, error) {
+	req := SetRequest{Prompt: prompt, Response: response}
+	for _, opt := range opts {
+		opt(&req)
+	}
+
+	var resp SetResponse
+	if err := c.do(ctx, "set", http.MethodPost, c.entriesPath(), req, &resp); err != nil {
+		return "", err
+	}
+	return resp.EntryID, nil
+}
+
+// GetEntry fetches a single entry by ID
+func (c *Client) GetEntry(ctx context.Context, entryID string) (*Entry, error) {
+	var entry Entry
+	if err := c.do(ctx, "get entry", http.MethodGet, c.entriesPath(entryID), nil, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// DeleteEntry deletes a single entry by ID
+func (c *Client) DeleteEntry(ctx context.Context, entryID string) error {
+	return c.do(ctx, "delete entry", http.MethodDelete, c.entriesPath(entryID), nil, nil)
+}
+
+// DeleteByAttributes deletes every entry carrying all of the given attributes
+// and returns the number of deleted entries
+func (c *Client) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	if len(attributes) == 0 {
+		return 0, fmt.Errorf("langcache: delete by attributes requires at least one attribute (use Flush to delete everything)")
+	}
+
+	var resp DeleteQueryResponse
+	req := DeleteQueryRequest{Attributes: attributes}
+	if err := c.do(ctx, "delete by attributes", http.MethodDelete, c.entriesPath(), req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.DeletedEntriesCount, nil
+}
+
+// Flush deletes every entry in the cache
+func (c *Client) Flush(ctx context.Context) error {
+	return c.do(ctx, "flush", http.MethodPost, fmt.Sprintf("/v1/caches/%s/flush", url.PathEscape(c.cacheID)), nil, nil)
+}
+
+// entriesPath builds /v1/caches/{id}/entries[/elem...]
+func (c *Client) entriesPath(elem ...string) string {
+	path := fmt.Sprintf("/v1/caches/%s/entries", url.PathEscape(c.cacheID))
+	for _, e := range elem {
+		path += "/" + url.PathEscape(e)
+	}
+	return path
+}
+
+// do sends a JSON request and decodes the JSON response into out (if
+// non-nil). Rate-limited requests are retried as configured.
+func (c *Client) do(ctx context.Context, op, method, path string, in, out interface{}) error {
+	var jsonData []byte
+	if in != nil {
+		var err error
+		if jsonData, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, op, method, path, jsonData, out)
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || attempt >= c.rateLimitRetries {
+			return err
+		}
+
+		wait := apiErr.RetryAfter
+		if wait == 0 {
+			wait = c.retryBackoff << attempt
+		}
+		if wait > c.maxRetryWait {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes a single request with an optional JSON body
+func (c *Client) send(ctx context.Context, op, method, path string, jsonData []byte, out interface{}) error {
+	var body io.Reader
+	if jsonData != nil {
+		body = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.serverURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	if jsonData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return newAPIError(op, resp, respBody)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
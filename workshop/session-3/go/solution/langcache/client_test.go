@@ -0,0 +1,333 @@
+package langcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// recordedRequest is what the stub LangCache server saw of a request
+type recordedRequest struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   map[string]interface{}
+}
+
+// newStubLangCache starts a server answering every request with status and
+// body, recording the requests it received
+func newStubLangCache(t *testing.T, status int, body string) (*httptest.Server, *[]recordedRequest) {
+	t.Helper()
+
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded := recordedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Auth: r.Header.Get("Authorization")}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			json.Unmarshal(data, &recorded.Body)
+		}
+		requests = append(requests, recorded)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestNewOptions(t *testing.T) {
+	custom := &http.Client{Timeout: time.Minute}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		timeout time.Duration
+		client  *http.Client // The client expected to be used as is, if any
+	}{
+		{"defaults", nil, DefaultTimeout, nil},
+		{"timeout", []Option{WithTimeout(5 * time.Second)}, 5 * time.Second, nil},
+		{"http client", []Option{WithHTTPClient(custom)}, time.Minute, custom},
+		{"http client then timeout", []Option{WithHTTPClient(custom), WithTimeout(5 * time.Second)}, time.Minute, custom},
+		{"timeout then http client", []Option{WithTimeout(5 * time.Second), WithHTTPClient(custom)}, time.Minute, custom},
+	}
+
+	for _, tt := range tests {
+		c := New("langcache.example.com/", "cache", "key", tt.opts...)
+		if tt.client != nil && c.httpClient != tt.client {
+			t.Errorf("%s: the supplied http.Client is not used", tt.name)
+		}
+		if c.httpClient.Timeout != tt.timeout {
+			t.Errorf("%s: timeout = %s, want %s", tt.name, c.httpClient.Timeout, tt.timeout)
+		}
+	}
+	if custom.Timeout != time.Minute {
+		t.Errorf("WithTimeout changed the supplied http.Client to %s", custom.Timeout)
+	}
+
+	if c := New("langcache.example.com/", "cache", "key"); c.ServerURL() != "https://langcache.example.com" {
+		t.Errorf("ServerURL = %q, want https://langcache.example.com", c.ServerURL())
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	server, requests := newStubLangCache(t, http.StatusOK, `{}`)
+	c := New(server.URL, "my cache", "secret")
+	ctx := context.Background()
+
+	c.Search(ctx, "What is Redis?", WithSimilarityThreshold(0.9), WithSearchAttributes(map[string]string{"language": "en"}))
+	c.Set(ctx, "What is Redis?", "A database.", WithAttributes(map[string]string{"language": "en"}), WithTTL(time.Hour))
+	c.GetEntry(ctx, "a/b")
+	c.DeleteEntry(ctx, "entry-1")
+	c.DeleteByAttributes(ctx, map[string]string{"language": "en"})
+	c.Flush(ctx)
+
+	want := []struct {
+		method, path string
+		body         map[string]interface{}
+	}{
+		{http.MethodPost, "/v1/caches/my%20cache/entries/search", map[string]interface{}{
+			"prompt": "What is Redis?", "similarity_threshold": 0.9, "attributes": map[string]interface{}{"language": "en"},
+		}},
+		{http.MethodPost, "/v1/caches/my%20cache/entries", map[string]interface{}{
+			"prompt": "What is Redis?", "response": "A database.", "attributes": map[string]interface{}{"language": "en"}, "ttlMillis": 3600000.0,
+		}},
+		{http.MethodGet, "/v1/caches/my%20cache/entries/a%2Fb", nil},
+		{http.MethodDelete, "/v1/caches/my%20cache/entries/entry-1", nil},
+		{http.MethodDelete, "/v1/caches/my%20cache/entries", map[string]interface{}{
+			"attributes": map[string]interface{}{"language": "en"},
+		}},
+		{http.MethodPost, "/v1/caches/my%20cache/flush", nil},
+	}
+
+	if len(*requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(*requests), len(want))
+	}
+	for i, got := range *requests {
+		if got.Method != want[i].method || got.Path != want[i].path {
+			t.Errorf("request %d = %s %s, want %s %s", i, got.Method, got.Path, want[i].method, want[i].path)
+		}
+		if got.Auth != "Bearer secret" {
+			t.Errorf("request %d: Authorization = %q", i, got.Auth)
+		}
+		gotBody, _ := json.Marshal(got.Body)
+		wantBody, _ := json.Marshal(want[i].body)
+		if string(gotBody) != string(wantBody) {
+			t.Errorf("request %d body = %s, want %s", i, gotBody, wantBody)
+		}
+	}
+}
+
+func TestClientResponses(t *testing.T) {
+	server, _ := newStubLangCache(t, http.StatusOK, `{"entryId": "entry-1", "data": [{"id": "entry-1", "prompt": "p", "response": "r", "similarity": 0.93}]}`)
+	c := New(server.URL, "cache", "key")
+	ctx := context.Background()
+
+	id, err := c.Set(ctx, "p", "r")
+	if err != nil || id != "entry-1" {
+		t.Errorf("Set = %q, %v; want entry-1", id, err)
+	}
+
+	resp, err := c.Search(ctx, "p")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Similarity == nil || *resp.Data[0].Similarity != 0.93 {
+		t.Errorf("Search = %+v", resp.Data)
+	}
+
+	if _, err := c.DeleteByAttributes(ctx, nil); err == nil {
+		t.Error("DeleteByAttributes without attributes succeeded, want an error")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		kind    error
+		message string
+	}{
+		{http.StatusBadRequest, `{"title": "Bad Request", "detail": "prompt is required"}`, ErrBadRequest, "prompt is required"},
+		{http.StatusUnauthorized, `{"message": "invalid key"}`, ErrUnauthorized, "invalid key"},
+		{http.StatusForbidden, `{"error": "no access"}`, ErrForbidden, "no access"},
+		{http.StatusNotFound, `{"title": "Not Found"}`, ErrNotFound, "Not Found"},
+		{http.StatusBadGateway, "upstream\n  unavailable", ErrServer, "upstream unavailable"},
+	}
+
+	for _, tt := range tests {
+		server, _ := newStubLangCache(t, tt.status, tt.body)
+		_, err := New(server.URL, "cache", "key").GetEntry(context.Background(), "entry-1")
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%d: err = %v, want an *APIError", tt.status, err)
+			continue
+		}
+		if !errors.Is(err, tt.kind) || apiErr.StatusCode != tt.status || apiErr.Message != tt.message || apiErr.Op != "get entry" {
+			t.Errorf("%d: err = %+v, want kind %v and message %q", tt.status, apiErr, tt.kind, tt.message)
+		}
+		if IsNotFound(err) != (tt.status == http.StatusNotFound) {
+			t.Errorf("%d: IsNotFound = %v", tt.status, IsNotFound(err))
+		}
+	}
+}
+
+func TestErrorMessageTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"short", "upstream unavailable", "upstream unavailable"},
+		{"exactly 200 bytes", strings.Repeat("a", 200), strings.Repeat("a", 200)},
+		{"ASCII", strings.Repeat("a", 250), strings.Repeat("a", 200) + "..."},
+		{"character across the cut", strings.Repeat("a", 199) + "é" + strings.Repeat("b", 50), strings.Repeat("a", 199) + "..."},
+		{"character ending at the cut", strings.Repeat("a", 198) + "é" + strings.Repeat("b", 50), strings.Repeat("a", 198) + "é..."},
+		{"wide characters", strings.Repeat("日本", 50), strings.Repeat("日本", 33) + "..."},
+	}
+	for _, tt := range tests {
+		got := errorMessage([]byte(tt.body))
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("%s: errorMessage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"7", 7 * time.Second},
+		{" 2 ", 2 * time.Second},
+		{"-1", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// newRateLimitedStub starts a server rejecting the first failures requests
+// with 429 and retryAfter as the Retry-After header, and then answering
+// them. It returns the server and how many requests it received.
+func newRateLimitedStub(t *testing.T, failures int, retryAfter string) (*httptest.Server, *int) {
+	t.Helper()
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if requests <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"detail": "slow down"}`)
+			return
+		}
+		io.WriteString(w, `{"entryId": "entry-1"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	server, requests := newRateLimitedStub(t, 1, "1")
+	c := New(server.URL, "cache", "key")
+
+	start := time.Now()
+	id, err := c.Set(context.Background(), "p", "r")
+	if err != nil || id != "entry-1" {
+		t.Fatalf("Set = %q, %v; want entry-1", id, err)
+	}
+	if *requests != 2 {
+		t.Errorf("got %d requests, want 2", *requests)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the 1s Retry-After", elapsed)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	server, requests := newRateLimitedStub(t, 2, "")
+	c := New(server.URL, "cache", "key")
+	c.retryBackoff = 10 * time.Millisecond
+
+	// Without Retry-After the client waits 10ms, then 20ms
+	start := time.Now()
+	if _, err := c.Set(context.Background(), "p", "r"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("got %d requests, want 3", *requests)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("succeeded after %s, want at least 30ms of backoff", elapsed)
+	}
+
+	// It gives up once the retries are used up
+	server, requests = newRateLimitedStub(t, 10, "")
+	c = New(server.URL, "cache", "key", WithRateLimitRetries(2, time.Second))
+	c.retryBackoff = time.Millisecond
+	if _, err := c.Set(context.Background(), "p", "r"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Set = %v, want rate limited", err)
+	}
+	if *requests != 3 {
+		t.Errorf("got %d requests with 2 retries, want 3", *requests)
+	}
+}
+
+func TestRetryGivesUpAtMaxWait(t *testing.T) {
+	// A Retry-After longer than maxWait is returned without waiting
+	server, requests := newRateLimitedStub(t, 1, "60")
+	c := New(server.URL, "cache", "key")
+
+	start := time.Now()
+	_, err := c.Set(context.Background(), "p", "r")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrRateLimited) || apiErr.RetryAfter != time.Minute {
+		t.Fatalf("Set = %v, want rate limited with a 1m Retry-After", err)
+	}
+	if *requests != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d requests in %s, want 1 without waiting", *requests, time.Since(start))
+	}
+
+	// So is a backoff growing past maxWait: 10ms is waited, 20ms is not
+	server, requests = newRateLimitedStub(t, 10, "")
+	c = New(server.URL, "cache", "key", WithRateLimitRetries(5, 15*time.Millisecond))
+	c.retryBackoff = 10 * time.Millisecond
+	if _, err := c.Set(context.Background(), "p", "r"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Set = %v, want rate limited", err)
+	}
+	if *requests != 2 {
+		t.Errorf("got %d requests, want 2", *requests)
+	}
+
+	// Cancelling the context stops the wait
+	server, requests = newRateLimitedStub(t, 1, "5")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := New(server.URL, "cache", "key").Set(ctx, "p", "r"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Set = %v, want rate limited", err)
+	}
+	if *requests != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d requests in %s, want 1 and to stop at the deadline", *requests, time.Since(start))
+	}
+}
@@ -0,0 +1,118 @@
+package langcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Error kinds an APIError matches with errors.Is, by status code
+var (
+	ErrBadRequest   = errors.New("bad request")  // 400
+	ErrUnauthorized = errors.New("unauthorized") // 401
+	ErrForbidden    = errors.New("forbidden")    // 403
+	ErrNotFound     = errors.New("not found")    // 404
+	ErrRateLimited  = errors.New("rate limited") // 429
+	ErrServer       = errors.New("server error") // 5xx
+)
+
+// APIError is returned when LangCache responds with a non-2xx status
+type APIError struct {
+	Op         string
+	StatusCode int
+	Message    string        // The server's explanation, taken from the body
+	Body       string        // The raw response body
+	RetryAfter time.Duration // From the Retry-After header, 0 when absent
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("langcache: %s failed with status %d", e.Op, e.StatusCode)
+	}
+	return fmt.Sprintf("langcache: %s failed with status %d: %s", e.Op, e.StatusCode, e.Message)
+}
+
+// Unwrap returns the error kind of the status code, so callers can test
+// errors.Is(err, ErrUnauthorized) and the like
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrBadRequest
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServer
+	default:
+		return nil
+	}
+}
+
+// IsNotFound reports whether err is a 404 from LangCache
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// newAPIError builds an APIError from a failed response and its body
+func newAPIError(op string, resp *http.Response, body []byte) *APIError {
+	return &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Message:    errorMessage(body),
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// errorMessage extracts the server's message from an error body. LangCache
+// sends problem details ({"title", "status", "detail"}); other proxies send
+// message or error fields, or plain text.
+func errorMessage(body []byte) string {
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, key := range []string{"detail", "message", "error", "title"} {
+			if message, ok := fields[key].(string); ok && message != "" {
+				return message
+			}
+		}
+	}
+
+	message := strings.Join(strings.Fields(string(body)), " ")
+	if len(message) > 200 {
+		// Cut at most 200 bytes without splitting a character
+		cut := 200
+		for cut > 0 && !utf8.RuneStart(message[cut]) {
+			cut--
+		}
+		message = message[:cut] + "..."
+	}
+	return message
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date, returning 0 when it is absent or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+
+	"session3/langcache"
 )
 
 // Request represents the API request payload
@@ -33,197 +43,335 @@ type Response struct {
 	ProcessingTime float64  `json:"processing_time"`
 }
 
-// CachedResponse wraps a Response with optional similarity score
+// CachedResponse wraps a Response with the stored question it was
+// matched through, an optional similarity score and the format the
+// response was stored in (see decodeCachedResponse)
 type CachedResponse struct {
 	Response   *Response
+	EntryID    string
+	Prompt     string
 	Similarity *float64
+	Format     string
 }
 
-// LangCacheClient represents a client for LangCache semantic caching
-type LangCacheClient struct {
-	ServerURL  string
-	CacheID    string
-	APIKey     string
-	HTTPClient *http.Client
-}
-
-// LangCacheSearchRequest represents a search request to LangCache
-type LangCacheSearchRequest struct {
-	Prompt              string  `json:"prompt"`
-	SimilarityThreshold float64 `json:"similarity_threshold"`
+// getCacheKey generates a cache key from the question
+func getCacheKey(question string) string {
+	// Normalize the question (lowercase, strip whitespace)
+	normalized := normalizeQuestion(question)
+	// Create a hash for the cache key
+	hash := sha256.Sum256([]byte(normalized))
+	questionHash := hex.EncodeToString(hash[:])
+	return fmt.Sprintf("aishe:question:%s", questionHash)
 }
 
-// LangCacheSearchEntry represents a single search result entry
-type LangCacheSearchEntry struct {
-	Prompt     string   `json:"prompt"`
-	Response   string   `json:"response"`
-	Similarity *float64 `json:"similarity,omitempty"` // Optional similarity score
-}
-
-// LangCacheSearchResponse represents the search response from LangCache
-type LangCacheSearchResponse struct {
-	Data []LangCacheSearchEntry `json:"data"`
-}
-
-// LangCacheSetRequest represents a set request to LangCache
-type LangCacheSetRequest struct {
-	Prompt   string `json:"prompt"`
-	Response string `json:"response"`
-}
-
-// NewLangCacheClient creates a new LangCache client
-func NewLangCacheClient(serverURL, cacheID, apiKey string) *LangCacheClient {
-	return &LangCacheClient{
-		ServerURL:  serverURL,
-		CacheID:    cacheID,
-		APIKey:     apiKey,
-		HTTPClient: &http.Client{Timeout: 30 * time.Second},
-	}
-}
-
-// getFromCache searches for a cached response using semantic search
-func getFromCache(client *LangCacheClient, question string, threshold float64) (*CachedResponse, error) {
-	// Prepare search request
-	searchReq := LangCacheSearchRequest{
-		Prompt:              question,
-		SimilarityThreshold: threshold,
-	}
-
-	jsonData, err := json.Marshal(searchReq)
+// searchCache returns up to k cached responses similar to the question,
+// most similar first, only considering entries stored with the same attributes.
+// Entries whose response cannot be decoded are skipped with a warning.
+func searchCache(ctx context.Context, cache SemanticCache, question string, threshold float64, attributes map[string]string, k int) ([]*CachedResponse, error) {
+	// Search for entries similar to the question
+	entries, err := cache.Search(ctx, question, threshold, attributes)
 	if err != nil {
 		return nil, err
 	}
 
-	// Build the search URL
-	url := fmt.Sprintf("%s/v1/caches/%s/entries/search", client.ServerURL, client.CacheID)
+	var candidates []*CachedResponse
+	for _, entry := range entries {
+		// Parse the cached response, which may have been written by another client
+		cachedData, format, err := decodeCachedResponse(entry.Response)
+		if err != nil {
+			fmt.Printf("⚠ Skipping corrupt cache entry %s (%s): %v\n", entry.ID, entry.Prompt, err)
+			continue
+		}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
+		candidates = append(candidates, &CachedResponse{
+			Response:   cachedData,
+			EntryID:    entry.ID,
+			Prompt:     entry.Prompt,
+			Similarity: entry.Similarity,
+			Format:     format,
+		})
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+client.APIKey)
+	// Do not rely on the server's ordering; entries without a score go last
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].Similarity, candidates[j].Similarity
+		return a != nil && (b == nil || *a > *b)
+	})
 
-	// Send request
-	resp, err := client.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
+	if k > 0 && len(candidates) > k {
+		candidates = candidates[:k]
 	}
-	defer resp.Body.Close()
 
-	// Check for errors
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("search failed with status %d", resp.StatusCode)
-	}
+	return candidates, nil
+}
 
-	// Parse response
-	var searchResp LangCacheSearchResponse
-	if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+// getFromCache searches for the most similar cached response
+func getFromCache(cache SemanticCache, question string, threshold float64, attributes map[string]string) (*CachedResponse, error) {
+	candidates, err := searchCache(context.Background(), cache, question, threshold, attributes, 1)
+	if err != nil {
 		return nil, err
 	}
 
 	// Check if we got any results
-	if len(searchResp.Data) == 0 {
+	if len(candidates) == 0 {
 		return nil, nil // No cache hit
 	}
 
-	// Get the first (most similar) entry
-	entry := searchResp.Data[0]
+	return candidates[0], nil
+}
 
-	// Parse the cached response from JSON string
-	var cachedData Response
-	if err := json.Unmarshal([]byte(entry.Response), &cachedData); err != nil {
-		return nil, err
+// chooseCandidate lists the cache candidates and lets the user pick one.
+// It returns nil when the user asks for a fresh answer.
+func chooseCandidate(candidates []*CachedResponse, in io.Reader) *CachedResponse {
+	fmt.Println("Cached candidates:")
+	for i, candidate := range candidates {
+		score := "    n/a"
+		if candidate.Similarity != nil {
+			score = fmt.Sprintf("%.4f", *candidate.Similarity)
+		}
+		fmt.Printf("  [%d] %s  %s\n", i+1, score, candidate.Prompt)
 	}
+	fmt.Println("  [0] Ask AISHE for a fresh answer")
+
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Printf("Select [0-%d] (default 1): ", len(candidates))
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if err != nil {
+				fmt.Println()
+			}
+			return candidates[0]
+		}
 
-	// Return cached response with similarity score (if available)
-	return &CachedResponse{
-		Response:   &cachedData,
-		Similarity: entry.Similarity,
-	}, nil
+		choice, convErr := strconv.Atoi(line)
+		if convErr == nil && choice >= 0 && choice <= len(candidates) {
+			if choice == 0 {
+				return nil
+			}
+			return candidates[choice-1]
+		}
+		if err != nil {
+			return candidates[0]
+		}
+		fmt.Println("Invalid choice.")
+	}
 }
 
-// saveToCache saves response to semantic cache
-func saveToCache(client *LangCacheClient, question string, response *Response) error {
+// saveToCache saves response to semantic cache and records the new entry
+// in the source index so it can be invalidated by the articles it cites.
+// Saving is an upsert: entries stored earlier for the same normalized
+// question and attributes are replaced rather than piling up. Saves of the
+// same question are serialized within a process; saves from two processes
+// can still both search before either stores, leaving a duplicate for the
+// dedupe command. A ttl of 0 keeps the backend's default expiration.
+func saveToCache(ctx context.Context, cache SemanticCache, index *SourceIndex, question string, response *Response, attributes map[string]string, ttl time.Duration) error {
 	// Convert response to JSON string
-	responseJSON, err := json.Marshal(response)
+	responseJSON, err := encodeCachedResponse(response)
 	if err != nil {
 		return err
 	}
 
-	// Prepare set request
-	setReq := LangCacheSetRequest{
-		Prompt:   question,
-		Response: string(responseJSON),
+	// Find the entries this one replaces before writing it, so the search
+	// cannot return the new entry
+	key := idempotencyKey(question)
+	scope := formatAttributes(attributes)
+	defer saveLocks.Lock(key + "\x00" + scope)()
+	matches, err := cache.Search(ctx, question, upsertThreshold, attributes)
+	if err != nil {
+		return err
+	}
+	var replaced []string
+	for _, entry := range matches {
+		if entryIdempotencyKey(entry) == key && entryScope(entry) == scope {
+			replaced = append(replaced, entry.ID)
+		}
 	}
 
-	jsonData, err := json.Marshal(setReq)
+	// Store the entry tagged with its idempotency key, keeping its ID so it
+	// can be found from its sources later
+	stored := map[string]string{idempotencyAttribute: key}
+	for name, value := range attributes {
+		stored[name] = value
+	}
+	entryID, err := cache.Set(ctx, question, responseJSON, stored, ttl)
 	if err != nil {
 		return err
 	}
+	// A backend that upserts may hand back the ID of an entry it replaced
+	var forgotten []string
+	for _, id := range replaced {
+		if id == entryID {
+			continue
+		}
+		if err := deleteFromCache(ctx, cache, id); err != nil {
+			return fmt.Errorf("replacing entry %s: %w", id, err)
+		}
+		forgotten = append(forgotten, semanticMember(id))
+	}
+	if err := index.Forget(ctx, forgotten...); err != nil {
+		return fmt.Errorf("removing replaced entries from the source index: %w", err)
+	}
+	if entryID != "" {
+		return index.Add(ctx, semanticMember(entryID), response.Sources, ttl)
+	}
 
-	// Build the set URL
-	url := fmt.Sprintf("%s/v1/caches/%s/entries", client.ServerURL, client.CacheID)
+	return nil
+}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+// deleteFromCache deletes a single entry from the semantic cache.
+// An entry that is already gone counts as deleted.
+func deleteFromCache(ctx context.Context, cache SemanticCache, entryID string) error {
+	err := cache.Delete(ctx, entryID)
+	if isNotFound(err) {
+		return nil
 	}
+	return err
+}
 
+// aisheError is returned when the AISHE server answers with an error status
+type aisheError struct {
+	StatusCode  int
+	ContentType string
+	Body        string
+}
+
+func (e *aisheError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("server returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// aisheClient is shared by all asks so connections to AISHE are reused
+var aisheClient = &http.Client{Timeout: 120 * time.Second}
+
+// askAISHE sends the question to the AISHE API and returns its response.
+// Canceling ctx abandons the request.
+func askAISHE(ctx context.Context, aisheURL, question string) (*Response, error) {
+	url := aisheURL + "/api/v1/ask"
+
+	// Prepare request payload
+	payload := Request{Question: question}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+client.APIKey)
 
-	// Send request
-	resp, err := client.HTTPClient.Do(req)
+	// Send POST request to AISHE server
+	resp, err := aisheClient.Do(req)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("could not connect to AISHE server at %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 
-	// Check for errors
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	// Check for HTTP errors
+	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("set failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &aisheError{StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Body: string(body)}
 	}
 
-	return nil
+	// Parse response
+	data := &Response{}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		return nil, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	return data, nil
 }
 
-func main() {
-	// Start timing
-	startTime := time.Now()
+// newRedisClient connects to the Redis server used for auxiliary data
+// such as the audit log. It returns nil if Redis is not reachable.
+func newRedisClient() *redis.Client {
+	// Get Redis address from environment variable (default: localhost:6379)
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil
+	}
+
+	return rdb
+}
+
+func printUsage() {
+	fmt.Println("Usage: go run . [--scope model,language] [--attr key=value] [--candidates [--top-k 5]] [--verbose] [--no-cache | --refresh] [--stream] <your question>")
+	fmt.Println("       go run . audit tail")
+	fmt.Println("       go run . audit query [--since 1h] [--until 2006-01-02T15:04:05Z] [--outcome api]")
+	fmt.Println("       go run . invalidate --source <url|title>")
+	fmt.Println("       go run . calibrate --file pairs.jsonl")
+	fmt.Println("       go run . stats")
+	fmt.Println("       go run . flag --reason <why> [--by name] <question>")
+	fmt.Println("       go run . dedupe [--dry-run] [question...]")
+	fmt.Println("       go run . serve [--addr localhost:8080] [--scope ...] [--attr key=value] [--max-concurrent 4] [--max-queue 16] [--queue-timeout 30s]")
+	fmt.Println("Example: go run . 'What is the capital of France?'")
+}
 
+func main() {
 	// Load environment variables from .env file
 	if err := godotenv.Load(); err != nil {
 		fmt.Println("Warning: .env file not found, using environment variables")
 	}
 
-	// Check if question was provided
+	// Check if question or command was provided
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <your question>")
-		fmt.Println("Example: go run main.go 'What is the capital of France?'")
+		printUsage()
 		os.Exit(1)
 	}
 
-	// Get question from command line arguments
-	question := strings.Join(os.Args[1:], " ")
+	switch os.Args[1] {
+	case "audit":
+		runAudit(os.Args[2:])
+		return
+	case "invalidate":
+		runInvalidate(os.Args[2:])
+		return
+	case "calibrate":
+		runCalibrate(os.Args[2:])
+		return
+	case "stats":
+		runStats(os.Args[2:])
+		return
+	case "flag":
+		runFlag(os.Args[2:])
+		return
+	case "dedupe":
+		runDedupe(os.Args[2:])
+		return
+	case "serve":
+		runServe(os.Args[2:])
+		return
+	case "-h", "--help", "help":
+		printUsage()
+		return
+	}
+
+	runAsk(os.Args[1:])
+}
 
+// loadLangCacheClient builds a LangCache client from the environment,
+// exiting with a helpful message if credentials are missing
+func loadLangCacheClient() *langcache.Client {
 	// Get credentials from environment variables
 	apiKey := os.Getenv("API_KEY")
 	cacheID := os.Getenv("CACHE_ID")
 	serverURL := os.Getenv("SERVER_URL")
 
-	// Get similarity threshold from environment variable (default: 0.8)
-	threshold := 0.8
-	if thresholdStr := os.Getenv("SIMILARITY_THRESHOLD"); thresholdStr != "" {
-		if parsedThreshold, err := strconv.ParseFloat(thresholdStr, 64); err == nil {
-			threshold = parsedThreshold
-		}
-	}
-
 	// Validate required credentials
 	var missingFields []string
 	if apiKey == "" {
@@ -246,98 +394,237 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Ensure server_url has https:// prefix
-	if !strings.HasPrefix(serverURL, "http") {
-		serverURL = "https://" + serverURL
+	// Rate-limited requests are retried LANGCACHE_RETRIES times (default: 3, 0 disables)
+	retries := langcache.DefaultRateLimitRetries
+	if retriesStr := os.Getenv("LANGCACHE_RETRIES"); retriesStr != "" {
+		parsed, err := strconv.Atoi(retriesStr)
+		if err != nil || parsed < 0 {
+			fmt.Printf("Error: invalid LANGCACHE_RETRIES %q (expected a non-negative integer)\n", retriesStr)
+			os.Exit(1)
+		}
+		retries = parsed
+	}
+
+	// The client adds the https:// prefix when it is missing
+	return langcache.New(serverURL, cacheID, apiKey,
+		langcache.WithRateLimitRetries(retries, langcache.DefaultMaxRetryWait))
+}
+
+// parseSimilarityThreshold parses a similarity threshold, which must be a number between 0 and 1
+func parseSimilarityThreshold(value string) (float64, error) {
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid similarity threshold %q: must be a number between 0 and 1", value)
+	}
+	if math.IsNaN(threshold) || threshold < 0 || threshold > 1 {
+		return 0, fmt.Errorf("invalid similarity threshold %q: must be between 0 and 1", value)
+	}
+	return threshold, nil
+}
+
+// loadSimilarityThreshold reads SIMILARITY_THRESHOLD (default: 0.8)
+func loadSimilarityThreshold() (float64, error) {
+	thresholdStr := os.Getenv("SIMILARITY_THRESHOLD")
+	if thresholdStr == "" {
+		return 0.8, nil
+	}
+	threshold, err := parseSimilarityThreshold(thresholdStr)
+	if err != nil {
+		return 0, fmt.Errorf("SIMILARITY_THRESHOLD: %w", err)
+	}
+	return threshold, nil
+}
+
+// getAISHEURL returns the AISHE server URL (default: http://localhost:8000)
+func getAISHEURL() string {
+	aisheURL := os.Getenv("AISHE_URL")
+	if aisheURL == "" {
+		aisheURL = "http://localhost:8000"
+	}
+	return aisheURL
+}
+
+// runAsk answers a single question, using the semantic cache when possible
+func runAsk(args []string) {
+	// Start timing
+	startTime := time.Now()
+
+	// Parse cache scoping flags
+	fs := flag.NewFlagSet("ask", flag.ExitOnError)
+	scope := fs.String("scope", "", "comma-separated attributes that scope cache entries (default: CACHE_SCOPE)")
+	attrs := attributeFlag{}
+	fs.Var(attrs, "attr", "set a cache attribute as key=value (repeatable)")
+	showCandidates := fs.Bool("candidates", false, "list cached candidates and pick one or ask for a fresh answer")
+	topK := fs.Int("top-k", 5, "maximum number of candidates listed by --candidates")
+	verbose := fs.Bool("verbose", false, "explain cache decisions, such as why a semantic match was rejected")
+	noCache := fs.Bool("no-cache", false, "skip the cache entirely: neither look up nor save the answer")
+	refresh := fs.Bool("refresh", false, "skip the cache lookup, ask AISHE and overwrite the cached answer")
+	stream := fs.Bool("stream", false, "print the answer as it arrives, when the server streams answers")
+	fs.Parse(args)
+
+	// Get question from command line arguments
+	if fs.NArg() == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+	question := strings.Join(fs.Args(), " ")
+
+	// Get AISHE server URL from environment variable
+	aisheURL := getAISHEURL()
+
+	// Build the attributes that keep cache entries of different scopes apart
+	attributes, err := loadCacheAttributes(aisheURL, *scope, attrs)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Get similarity threshold from environment variable (default: 0.8)
+	threshold, err := loadSimilarityThreshold()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Initialize LangCache client
-	langCache := NewLangCacheClient(serverURL, cacheID, apiKey)
+	// Initialize the cache tiers and the audit log
+	tiered, audit, closeCaches := openTieredCache(*verbose)
+	defer closeCaches()
+	record := AuditEntry{
+		Timestamp: startTime,
+		Question:  question,
+		Key:       getCacheKey(question),
+	}
 
 	fmt.Printf("Asking: %s\n", question)
+	if len(attributes) > 0 {
+		fmt.Printf("Cache scope: %s\n", formatAttributes(attributes))
+	}
 
-	// Check cache first using semantic search
+	// Questions flagged too often bypass the cache like --no-cache
+	useCache := !*noCache
+	if useCache && tiered.Feedback.Blocked(question, attributes) {
+		fmt.Println("⚠ This question has been flagged as wrongly answered too often; bypassing the cache")
+		useCache = false
+	}
+
+	// Check the exact-match tier first, then fall back to semantic search
 	var data *Response
 	var fromCache bool
 	var similarity *float64
-
-	cachedResponse, err := getFromCache(langCache, question, threshold)
-	if err != nil {
-		fmt.Printf("⚠ Cache lookup error: %v\n", err)
+	var matchedPrompt string
+	var streamed bool // The answer was printed as it arrived
+
+	cacheStart := time.Now()
+	var cachedResponse *CachedResponse
+	var outcome string
+	if !useCache || *refresh {
+		// Go straight to AISHE
+	} else if *showCandidates {
+		// Listing candidates skips the exact tier so a fresh answer can always be chosen
+		candidates, err := tiered.Candidates(context.Background(), question, threshold, attributes, *topK)
+		record.CacheLatency = time.Since(cacheStart)
+		tiered.Metrics.ObserveLookup("semantic", semanticBackendLabel(), len(candidates) > 0, err, record.CacheLatency)
+		if err != nil {
+			fmt.Printf("⚠ Cache lookup error: %v\n", err)
+		} else if len(candidates) > 0 {
+			cachedResponse = chooseCandidate(candidates, os.Stdin)
+		}
+		if cachedResponse != nil {
+			outcome = OutcomeSemanticHit
+			tiered.Stats.Incr(statSemanticHit)
+			tiered.Metrics.ObserveSimilarity(semanticBackendLabel(), cachedResponse.Similarity)
+			tiered.Promote(question, attributes, cachedResponse)
+		} else if err == nil {
+			tiered.Stats.Incr(statMiss)
+		}
+	} else {
+		cachedResponse, outcome, err = tiered.Lookup(context.Background(), question, threshold, attributes)
+		record.CacheLatency = time.Since(cacheStart)
+		if err != nil {
+			fmt.Printf("⚠ Cache lookup error: %v\n", err)
+		}
 	}
-	if cachedResponse != nil {
+	if outcome == OutcomeExactHit {
+		fmt.Print("✓ Found in exact cache! (no API call needed)\n\n")
+		data = cachedResponse.Response
+		matchedPrompt = cachedResponse.Prompt
+		fromCache = true
+		record.Outcome = OutcomeExactHit
+	} else if cachedResponse != nil {
 		fmt.Println("✓ Found in semantic cache! (no API call needed)")
+		fmt.Printf("  Answered from cache for: %s\n", cachedResponse.Prompt)
 		if cachedResponse.Similarity != nil {
 			fmt.Printf("  Similarity score: %.4f\n", *cachedResponse.Similarity)
 		}
+		if cachedResponse.Format != FormatNative {
+			fmt.Printf("  Stored by another client (%s format)\n", cachedResponse.Format)
+		}
 		fmt.Println()
 		data = cachedResponse.Response
 		similarity = cachedResponse.Similarity
+		matchedPrompt = cachedResponse.Prompt
 		fromCache = true
+		record.Outcome = OutcomeSemanticHit
+		record.Similarity = similarity
 	} else {
-		fmt.Println("✗ Not in cache, calling AISHE API...")
-		fmt.Println("Waiting for response...\n")
-
-		// Get AISHE server URL from environment variable (default: http://localhost:8000)
-		aisheURL := os.Getenv("AISHE_URL")
-		if aisheURL == "" {
-			aisheURL = "http://localhost:8000"
-		}
-		url := aisheURL + "/api/v1/ask"
-
-		// Prepare request payload
-		payload := Request{Question: question}
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			fmt.Printf("Error marshaling request: %v\n", err)
-			os.Exit(1)
+		switch {
+		case *noCache:
+			fmt.Println("Cache disabled (--no-cache), calling AISHE API...")
+		case *refresh:
+			fmt.Println("Refreshing cached answer (--refresh), calling AISHE API...")
+		case !useCache:
+			fmt.Println("Calling AISHE API...")
+		default:
+			fmt.Println("✗ Not in cache, calling AISHE API...")
 		}
+		fmt.Print("Waiting for response...\n\n")
 
-		// Create HTTP client with timeout
-		client := &http.Client{
-			Timeout: 120 * time.Second,
+		apiStart := time.Now()
+		if *stream {
+			data, streamed, err = askStreaming(aisheURL, question)
+		} else {
+			data, err = askAISHE(context.Background(), aisheURL, question)
 		}
-
-		// Send POST request to AISHE server
-		resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		record.APILatency = time.Since(apiStart)
+		tiered.Metrics.ObserveUpstream(record.APILatency, err)
 		if err != nil {
-			fmt.Printf("Error: Could not connect to AISHE server at %s\n", url)
+			record.Outcome = OutcomeError
+			record.Error = err.Error()
+			record.TotalLatency = time.Since(startTime)
+			audit.Record(record)
+			closeCaches()
+
+			fmt.Printf("Error: %v\n", err)
 			fmt.Println("Make sure the server is running in Docker.")
 			os.Exit(1)
 		}
-		defer resp.Body.Close()
-
-		// Check for HTTP errors
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			fmt.Printf("Error: Server returned status %d\n", resp.StatusCode)
-			if len(body) > 0 {
-				fmt.Printf("Details: %s\n", string(body))
-			}
-			os.Exit(1)
-		}
 
-		// Parse response
-		data = &Response{}
-		if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
-			fmt.Printf("Error parsing response: %v\n", err)
-			os.Exit(1)
+		// Replace the answers cached for this question when refreshing
+		if *refresh && useCache {
+			if removed, err := tiered.Forget(context.Background(), question, threshold, attributes); err != nil {
+				fmt.Printf("Warning: Error removing cached answers: %v\n", err)
+			} else if removed > 0 {
+				fmt.Printf("✓ Replaced %d cached answer(s)\n", removed)
+			}
 		}
 
-		// Save to semantic cache for future use
-		if err := saveToCache(langCache, question, data); err != nil {
-			fmt.Printf("Warning: Error saving to cache: %v\n", err)
-		} else {
-			fmt.Println("✓ Response saved to semantic cache\n")
+		// Write through to both tiers for future use, in the background
+		// unless CACHE_WRITE_MODE=sync
+		if useCache {
+			tiered.Save(question, attributes, data)
+			if tiered.Writes == nil {
+				fmt.Println()
+			}
 		}
 		fromCache = false
+		record.Outcome = OutcomeAPI
 	}
 
-	// Print answer
-	fmt.Println(strings.Repeat("=", 70))
-	fmt.Println("ANSWER:")
-	fmt.Println(strings.Repeat("=", 70))
-	fmt.Println(data.Answer)
+	// Print answer, unless it was printed as it arrived
+	if !streamed {
+		printAnswerHeader()
+		fmt.Println(data.Answer)
+	}
 
 	// Print sources if available
 	if len(data.Sources) > 0 {
@@ -354,8 +641,12 @@ func main() {
 	// Print processing time or cache info
 	fmt.Println()
 	fmt.Println(strings.Repeat("=", 70))
-	if fromCache {
-		fmt.Println("Source: Semantic Cache (LangCache)")
+	if record.Outcome == OutcomeExactHit {
+		fmt.Println("Source: Exact Cache (Redis)")
+		fmt.Printf("Original processing time: %.2f seconds\n", data.ProcessingTime)
+	} else if fromCache {
+		fmt.Printf("Source: Semantic Cache (%s)\n", semanticCacheName())
+		fmt.Printf("Matched question: %s\n", matchedPrompt)
 		if similarity != nil {
 			fmt.Printf("Similarity score: %.4f\n", *similarity)
 		}
@@ -363,8 +654,21 @@ func main() {
 	} else {
 		fmt.Printf("Processing time: %.2f seconds\n", data.ProcessingTime)
 	}
+	if fromCache {
+		fmt.Printf("Wrong answer? go run . flag --reason \"...\" %q\n", question)
+	}
 	fmt.Println(strings.Repeat("=", 70))
 
+	// Record the outcome in the audit log
+	for _, source := range data.Sources {
+		record.Sources = append(record.Sources, source.Title)
+	}
+	record.TotalLatency = time.Since(startTime)
+	audit.Record(record)
+
+	// Wait for the cache writes queued while answering
+	tiered.Writes.Close()
+
 	// Print total execution time
 	executionTime := time.Since(startTime).Seconds()
 	fmt.Println()
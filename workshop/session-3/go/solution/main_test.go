@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"session3/langcache"
+)
+
+func TestParseSimilarityThreshold(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		err   string // Part of the error, or "" for a valid threshold
+	}{
+		{"0.8", 0.8, ""},
+		{" 0.85\n", 0.85, ""},
+		{"0", 0, ""},
+		{"1", 1, ""},
+		{"1e-1", 0.1, ""},
+		{"NaN", 0, "between 0 and 1"},
+		{"-0.1", 0, "between 0 and 1"},
+		{"1.01", 0, "between 0 and 1"},
+		{"+Inf", 0, "between 0 and 1"},
+		{"high", 0, "must be a number"},
+		{"", 0, "must be a number"},
+		{"0.8.1", 0, "must be a number"},
+	}
+	for _, tt := range tests {
+		got, err := parseSimilarityThreshold(tt.value)
+		if tt.err == "" {
+			if err != nil || got != tt.want {
+				t.Errorf("parseSimilarityThreshold(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseSimilarityThreshold(%q) = %v, %v; want an error saying %q", tt.value, got, err, tt.err)
+		}
+	}
+}
+
+func TestLoadSimilarityThreshold(t *testing.T) {
+	t.Setenv("SIMILARITY_THRESHOLD", "")
+	if got, err := loadSimilarityThreshold(); err != nil || got != 0.8 {
+		t.Errorf("default threshold = %v, %v; want 0.8", got, err)
+	}
+	t.Setenv("SIMILARITY_THRESHOLD", "2")
+	if _, err := loadSimilarityThreshold(); err == nil || !strings.HasPrefix(err.Error(), "SIMILARITY_THRESHOLD: ") {
+		t.Errorf("SIMILARITY_THRESHOLD=2: err = %v, want it to name the variable", err)
+	}
+}
+
+// fixedSearch is a semantic cache whose searches return results as they
+// are, in their order, or err
+type fixedSearch struct {
+	stubSemanticCache
+	results []langcache.Entry
+	err     error
+}
+
+func (c *fixedSearch) Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	return c.results, c.err
+}
+
+func TestSearchCache(t *testing.T) {
+	score := func(s float64) *float64 { return &s }
+	cache := &fixedSearch{results: []langcache.Entry{
+		{ID: "unscored", Prompt: "Q1", Response: `{"answer": "A1"}`},
+		{ID: "low", Prompt: "Q2", Response: `{"answer": "A2"}`, Similarity: score(0.81)},
+		{ID: "corrupt", Prompt: "Q3", Response: "null", Similarity: score(0.99)},
+		{ID: "high", Prompt: "Q4", Response: "Plain answer", Similarity: score(0.95)},
+		{ID: "middle", Prompt: "Q5", Response: `{"answer": "A5"}`, Similarity: score(0.9)},
+	}}
+
+	// Most similar first whatever the server's order, unscored last and
+	// corrupt entries skipped
+	tests := []struct {
+		k    int
+		want string
+	}{
+		{0, "high middle low unscored"},
+		{2, "high middle"},
+		{10, "high middle low unscored"},
+	}
+	for _, tt := range tests {
+		candidates, err := searchCache(context.Background(), cache, "Q", 0.8, nil, tt.k)
+		if err != nil {
+			t.Fatalf("searchCache: %v", err)
+		}
+		var ids []string
+		for _, candidate := range candidates {
+			ids = append(ids, candidate.EntryID)
+		}
+		if got := strings.Join(ids, " "); got != tt.want {
+			t.Errorf("k=%d: candidates %q, want %q", tt.k, got, tt.want)
+		}
+	}
+
+	candidates, _ := searchCache(context.Background(), cache, "Q", 0.8, nil, 1)
+	if got := candidates[0]; got.Prompt != "Q4" || got.Response.Answer != "Plain answer" || got.Format != FormatPlainText || *got.Similarity != 0.95 {
+		t.Errorf("best candidate = %+v, want the plain-text entry Q4", got)
+	}
+
+	cache.err = errors.New("search failed")
+	if _, err := searchCache(context.Background(), cache, "Q", 0.8, nil, 0); err != cache.err {
+		t.Errorf("searchCache with a failing search: err = %v", err)
+	}
+}
+
+func TestChooseCandidate(t *testing.T) {
+	score := 0.9
+	candidates := []*CachedResponse{
+		{EntryID: "first", Prompt: "Q1", Similarity: &score},
+		{EntryID: "second", Prompt: "Q2"},
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string // Entry ID, or "" for a fresh answer
+	}{
+		{"pick the second", "2\n", "second"},
+		{"fresh answer", "0\n", ""},
+		{"default", "\n", "first"},
+		{"padded choice", "  2  \n", "second"},
+		{"out of range, then valid", "3\n-1\n2\n", "second"},
+		{"not a number, then valid", "two\n0\n", ""},
+		{"EOF", "", "first"},
+		{"last line without newline", "2", "second"},
+		{"invalid last line", "5", "first"},
+		{"EOF after an invalid choice", "9\n", "first"},
+	}
+	for _, tt := range tests {
+		got := chooseCandidate(candidates, strings.NewReader(tt.input))
+		id := ""
+		if got != nil {
+			id = got.EntryID
+		}
+		if id != tt.want {
+			t.Errorf("%s: chooseCandidate picked %q, want %q", tt.name, id, tt.want)
+		}
+	}
+}
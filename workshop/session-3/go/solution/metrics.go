@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"session3/langcache"
+)
+
+// Buckets of the latency histograms, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Buckets of the similarity histogram, dense near typical thresholds
+var similarityBuckets = []float64{0.5, 0.6, 0.7, 0.75, 0.8, 0.85, 0.9, 0.925, 0.95, 0.975, 0.99, 1}
+
+// Metric kinds of the exposition format
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// metricFamily is one metric with all of its label combinations
+type metricFamily struct {
+	Name    string
+	Help    string
+	Kind    string
+	Labels  []string
+	Buckets []float64 // Histograms only
+
+	series map[string]*metricSeries
+}
+
+// metricSeries is a single label combination of a family
+type metricSeries struct {
+	Values []string // Label values, in the order of the family's labels
+	Value  float64  // Counters and gauges
+	Counts []uint64 // Histograms: observations per bucket, not cumulative
+	Sum    float64  // Histograms
+	Count  uint64   // Histograms
+}
+
+// Metrics collects Prometheus metrics for the CLI and the proxy and
+// renders them in the text exposition format. A nil Metrics records nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+
+	requests         *metricFamily
+	requestDuration  *metricFamily
+	inFlight         *metricFamily
+	clients          *metricFamily
+	upstreamInFlight *metricFamily
+	queueDepth       *metricFamily
+	queueWait        *metricFamily
+	shed             *metricFamily
+	upstream         *metricFamily
+	upstreamDuration *metricFamily
+	lookups          *metricFamily
+	lookupDuration   *metricFamily
+	similarity       *metricFamily
+	backendErrors    *metricFamily
+}
+
+// NewMetrics creates the metrics the CLI and the proxy record
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.requests = m.family("aishe_proxy_requests_total", "Requests served by the proxy.", kindCounter, nil, "path", "code")
+	m.requestDuration = m.family("aishe_proxy_request_duration_seconds", "Time to serve a proxy request.", kindHistogram, latencyBuckets, "path")
+	m.inFlight = m.family("aishe_proxy_requests_in_flight", "Proxy requests being served.", kindGauge, nil)
+	m.clients = m.family("aishe_proxy_client_requests_total", "Authenticated proxy requests per client by result (allowed, rate_limited).", kindCounter, nil, "client", "result")
+	m.upstreamInFlight = m.family("aishe_proxy_upstream_in_flight", "Asks the proxy is forwarding to AISHE.", kindGauge, nil)
+	m.queueDepth = m.family("aishe_proxy_queue_depth", "Asks waiting for an upstream slot.", kindGauge, nil)
+	m.queueWait = m.family("aishe_proxy_queue_wait_seconds", "Time asks waited for an upstream slot.", kindHistogram, latencyBuckets)
+	m.shed = m.family("aishe_proxy_shed_total", "Asks rejected without reaching AISHE by reason (queue_full, queue_timeout, client_gone).", kindCounter, nil, "reason")
+	m.upstream = m.family("aishe_upstream_requests_total", "Calls to the AISHE /api/v1/ask endpoint by result (ok, HTTP status or error).", kindCounter, nil, "result")
+	m.upstreamDuration = m.family("aishe_upstream_request_duration_seconds", "Duration of calls to the AISHE /api/v1/ask endpoint.", kindHistogram, latencyBuckets)
+	m.lookups = m.family("aishe_cache_lookups_total", "Cache lookups per tier and backend by result (hit, miss, error).", kindCounter, nil, "tier", "backend", "result")
+	m.lookupDuration = m.family("aishe_cache_lookup_duration_seconds", "Duration of cache lookups per tier and backend.", kindHistogram, latencyBuckets, "tier", "backend")
+	m.similarity = m.family("aishe_cache_similarity", "Similarity score of served semantic cache hits.", kindHistogram, similarityBuckets, "backend")
+	m.backendErrors = m.family("aishe_backend_errors_total", "Errors returned by Redis and the semantic cache backends per operation and kind.", kindCounter, nil, "backend", "operation", "kind")
+	return m
+}
+
+// family registers a metric family
+func (m *Metrics) family(name, help, kind string, buckets []float64, labels ...string) *metricFamily {
+	f := &metricFamily{Name: name, Help: help, Kind: kind, Labels: labels, Buckets: buckets, series: make(map[string]*metricSeries)}
+	m.families = append(m.families, f)
+	return f
+}
+
+// seriesLocked returns the series of a family for the given label values
+func (f *metricFamily) seriesLocked(values ...string) *metricSeries {
+	key := strings.Join(values, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{Values: values}
+		if f.Kind == kindHistogram {
+			s.Counts = make([]uint64, len(f.Buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter or gauge
+func (m *Metrics) add(f *metricFamily, delta float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f.seriesLocked(values...).Value += delta
+}
+
+// observe records a value in a histogram
+func (m *Metrics) observe(f *metricFamily, value float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := f.seriesLocked(values...)
+	for i, bound := range f.Buckets {
+		if value <= bound {
+			s.Counts[i]++
+			break
+		}
+	}
+	s.Sum += value
+	s.Count++
+}
+
+// ObserveRequest records a request served by the proxy
+func (m *Metrics) ObserveRequest(path string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.add(m.requests, 1, path, strconv.Itoa(code))
+	m.observe(m.requestDuration, duration.Seconds(), path)
+}
+
+// AddInFlight changes the number of proxy requests being served
+func (m *Metrics) AddInFlight(delta float64) {
+	if m == nil {
+		return
+	}
+	m.add(m.inFlight, delta)
+}
+
+// ObserveClient records an authenticated request and whether it was allowed
+func (m *Metrics) ObserveClient(client, result string) {
+	if m == nil {
+		return
+	}
+	m.add(m.clients, 1, client, result)
+}
+
+// AddUpstreamInFlight changes the number of asks being forwarded to AISHE
+func (m *Metrics) AddUpstreamInFlight(delta float64) {
+	if m == nil {
+		return
+	}
+	m.add(m.upstreamInFlight, delta)
+}
+
+// SetQueueDepth records the number of asks waiting for an upstream slot
+func (m *Metrics) SetQueueDepth(depth int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueDepth.seriesLocked().Value = float64(depth)
+}
+
+// ObserveQueueWait records how long an ask waited for an upstream slot
+func (m *Metrics) ObserveQueueWait(waited time.Duration) {
+	if m == nil {
+		return
+	}
+	m.observe(m.queueWait, waited.Seconds())
+}
+
+// ObserveShed counts an ask rejected by admission control
+func (m *Metrics) ObserveShed(err error) {
+	if m == nil {
+		return
+	}
+	reason := "client_gone"
+	switch {
+	case errors.Is(err, errQueueFull):
+		reason = "queue_full"
+	case errors.Is(err, errQueueTimeout):
+		reason = "queue_timeout"
+	}
+	m.add(m.shed, 1, reason)
+}
+
+// ObserveUpstream records a call to AISHE: "ok", the HTTP status of an
+// error response, or "error" when the server could not be reached
+func (m *Metrics) ObserveUpstream(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	var upstreamErr *aisheError
+	if errors.As(err, &upstreamErr) {
+		result = strconv.Itoa(upstreamErr.StatusCode)
+	} else if err != nil {
+		result = "error"
+	}
+	m.add(m.upstream, 1, result)
+	m.observe(m.upstreamDuration, duration.Seconds())
+}
+
+// ObserveLookup records a cache lookup in one tier. A lookup that failed is
+// also counted as a backend error.
+func (m *Metrics) ObserveLookup(tier, backend string, hit bool, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	switch {
+	case err != nil:
+		result = "error"
+		m.BackendError(backend, "lookup", err)
+	case hit:
+		result = "hit"
+	}
+	m.add(m.lookups, 1, tier, backend, result)
+	m.observe(m.lookupDuration, duration.Seconds(), tier, backend)
+}
+
+// ObserveSimilarity records the similarity score of a served semantic hit
+func (m *Metrics) ObserveSimilarity(backend string, similarity *float64) {
+	if m == nil || similarity == nil {
+		return
+	}
+	m.observe(m.similarity, *similarity, backend)
+}
+
+// BackendError counts a failed operation against Redis or a semantic cache
+// backend. Nil errors are ignored.
+func (m *Metrics) BackendError(backend, operation string, err error) {
+	if m == nil || err == nil {
+		return
+	}
+	m.add(m.backendErrors, 1, backend, operation, errorKind(err))
+}
+
+// errorKind classifies a backend error for the kind label
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	case errors.Is(err, langcache.ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, langcache.ErrUnauthorized), errors.Is(err, langcache.ErrForbidden):
+		return "unauthorized"
+	case isNotFound(err):
+		return "not_found"
+	case errors.Is(err, langcache.ErrServer):
+		return "server"
+	default:
+		return "other"
+	}
+}
+
+// semanticBackendLabel returns the backend label of the semantic tier
+// selected by CACHE_BACKEND
+func semanticBackendLabel() string {
+	if backend := os.Getenv("CACHE_BACKEND"); backend != "" {
+		return backend
+	}
+	return "langcache"
+}
+
+// formatFloat formats a sample value the way Prometheus does
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// labelEscaper escapes label values for the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders a label set, with extra pairs appended in order
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := bufio.NewWriter(w)
+	for _, f := range m.families {
+		fmt.Fprintf(out, "# HELP %s %s\n", f.Name, f.Help)
+		fmt.Fprintf(out, "# TYPE %s %s\n", f.Name, f.Kind)
+
+		// Gauges without labels are always present, even before the first change
+		if f.Kind == kindGauge && len(f.Labels) == 0 {
+			f.seriesLocked()
+		}
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.Kind != kindHistogram {
+				fmt.Fprintf(out, "%s%s %s\n", f.Name, formatLabels(f.Labels, s.Values), formatFloat(s.Value))
+				continue
+			}
+
+			var cumulative uint64
+			for i, bound := range f.Buckets {
+				cumulative += s.Counts[i]
+				fmt.Fprintf(out, "%s_bucket%s %d\n", f.Name, formatLabels(f.Labels, s.Values, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.Name, formatLabels(f.Labels, s.Values, "le", "+Inf"), s.Count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", f.Name, formatLabels(f.Labels, s.Values), formatFloat(s.Sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", f.Name, formatLabels(f.Labels, s.Values), s.Count)
+		}
+	}
+	return out.Flush()
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// parseSample splits a sample line into its metric name, labels and value
+func parseSample(line string) (string, map[string]string, float64, error) {
+	name, rest := line, ""
+	labels := make(map[string]string)
+	if i := strings.IndexAny(line, "{ "); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " ,")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, `="`)
+			if eq < 0 {
+				return "", nil, 0, fmt.Errorf("malformed labels in %q", line)
+			}
+			label := rest[:eq]
+			rest = rest[eq+2:]
+
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(rest); i++ {
+				c := rest[i]
+				if c == '\\' && i+1 < len(rest) {
+					i++
+					if rest[i] == 'n' {
+						value.WriteByte('\n')
+					} else {
+						value.WriteByte(rest[i])
+					}
+					continue
+				}
+				if c == '"' {
+					rest = rest[i+1:]
+					closed = true
+					break
+				}
+				value.WriteByte(c)
+			}
+			if !closed {
+				return "", nil, 0, fmt.Errorf("unterminated label value in %q", line)
+			}
+			labels[label] = value.String()
+		}
+	}
+
+	// A timestamp may follow the value
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("missing value in %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid value in %q", line)
+	}
+	return name, labels, value, nil
+}
+
+// readText loads counters and histograms previously written by WriteText.
+// Gauges, unknown metrics and histogram buckets that no longer exist are
+// skipped, since they cannot be carried over.
+func (m *Metrics) readText(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byName := make(map[string]*metricFamily, len(m.families))
+	for _, f := range m.families {
+		byName[f.Name] = f
+	}
+
+	// Buckets are cumulative in the file and per bucket in memory
+	cumulative := make(map[*metricSeries]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			return err
+		}
+
+		f, suffix := byName[name], ""
+		if f == nil {
+			for _, s := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(name, s); base != name && byName[base] != nil && byName[base].Kind == kindHistogram {
+					f, suffix = byName[base], s
+				}
+			}
+		}
+		if f == nil || f.Kind == kindGauge || (f.Kind == kindHistogram && suffix == "") {
+			continue
+		}
+
+		values := make([]string, len(f.Labels))
+		for i, label := range f.Labels {
+			values[i] = labels[label]
+		}
+		s := f.seriesLocked(values...)
+
+		switch suffix {
+		case "":
+			s.Value += value
+		case "_sum":
+			s.Sum += value
+		case "_count":
+			s.Count += uint64(value)
+		case "_bucket":
+			for i, bound := range f.Buckets {
+				if formatFloat(bound) == labels["le"] {
+					s.Counts[i] += uint64(value)
+					cumulative[s] = true
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for s := range cumulative {
+		for i := len(s.Counts) - 1; i > 0; i-- {
+			s.Counts[i] -= s.Counts[i-1]
+		}
+	}
+	return nil
+}
+
+// merge adds the counters and histograms of other into m
+func (m *Metrics) merge(other *Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	for i, f := range m.families {
+		if f.Kind == kindGauge {
+			continue
+		}
+		for _, s := range other.families[i].series {
+			into := f.seriesLocked(s.Values...)
+			into.Value += s.Value
+			into.Sum += s.Sum
+			into.Count += s.Count
+			for j := range s.Counts {
+				into.Counts[j] += s.Counts[j]
+			}
+		}
+	}
+}
+
+// WriteTextfile adds the metrics of this run to the ones already in path
+// and writes the total back atomically, for node_exporter's textfile
+// collector to pick up after batch runs that do not serve /metrics.
+// Concurrent runs writing the same file can lose each other's counts.
+func (m *Metrics) WriteTextfile(path string) error {
+	if m == nil {
+		return nil
+	}
+
+	total := NewMetrics()
+	existing, err := os.Open(path)
+	switch {
+	case err == nil:
+		err = total.readText(existing)
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	total.merge(m)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := total.WriteText(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
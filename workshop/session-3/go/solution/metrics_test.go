@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordSamples records one of each kind of observation, with label values
+// that need escaping. The values are exact in binary so sums add up exactly.
+func recordSamples(m *Metrics) {
+	m.ObserveRequest("/api/v1/ask", 200, 250*time.Millisecond)
+	m.ObserveRequest("/api/v1/ask", 200, 2*time.Second)
+	m.ObserveRequest("/health", 503, 500*time.Millisecond)
+	m.ObserveClient(`team "a"`, "allowed")
+	m.ObserveClient("back\\slash\nnewline", "rate_limited")
+	m.ObserveLookup("semantic", "local", true, nil, 125*time.Millisecond)
+	similarity := 0.875
+	m.ObserveSimilarity("local", &similarity)
+	m.ObserveQueueWait(time.Second)
+	m.AddInFlight(1)
+}
+
+// metricsText renders m in the exposition format
+func metricsText(t *testing.T, m *Metrics) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	return buf.String()
+}
+
+func TestMetricsRoundTrip(t *testing.T) {
+	run := NewMetrics()
+	recordSamples(run)
+	run.AddInFlight(-1) // Gauges are not carried over, so leave them at zero
+	written := metricsText(t, run)
+
+	read := NewMetrics()
+	if err := read.readText(strings.NewReader(written)); err != nil {
+		t.Fatalf("readText: %v", err)
+	}
+	if got := metricsText(t, read); got != written {
+		t.Errorf("WriteText after readText:\n%s\nwant:\n%s", got, written)
+	}
+
+	// Merging another run gives the same buckets as recording both runs
+	read.merge(run)
+	both := NewMetrics()
+	recordSamples(both)
+	recordSamples(both)
+	both.AddInFlight(-2)
+	if got, want := metricsText(t, read), metricsText(t, both); got != want {
+		t.Errorf("merged metrics:\n%s\nwant:\n%s", got, want)
+	}
+
+	merged := metricsText(t, read)
+	for _, line := range []string{
+		`aishe_proxy_request_duration_seconds_bucket{path="/api/v1/ask",le="0.25"} 2`,
+		`aishe_proxy_request_duration_seconds_bucket{path="/api/v1/ask",le="1"} 2`,
+		`aishe_proxy_request_duration_seconds_bucket{path="/api/v1/ask",le="2.5"} 4`,
+		`aishe_proxy_request_duration_seconds_bucket{path="/api/v1/ask",le="+Inf"} 4`,
+		`aishe_proxy_request_duration_seconds_sum{path="/api/v1/ask"} 4.5`,
+		`aishe_proxy_client_requests_total{client="team \"a\"",result="allowed"} 2`,
+		`aishe_proxy_client_requests_total{client="back\\slash\nnewline",result="rate_limited"} 2`,
+		`aishe_proxy_requests_in_flight 0`,
+	} {
+		if !strings.Contains(merged, line+"\n") {
+			t.Errorf("merged metrics lack %s", line)
+		}
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aishe.prom")
+	for i := 0; i < 2; i++ {
+		run := NewMetrics()
+		recordSamples(run)
+		if err := run.WriteTextfile(path); err != nil {
+			t.Fatalf("WriteTextfile: %v", err)
+		}
+	}
+
+	both := NewMetrics()
+	recordSamples(both)
+	recordSamples(both)
+	both.AddInFlight(-2)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading textfile: %v", err)
+	}
+	if want := metricsText(t, both); string(data) != want {
+		t.Errorf("textfile after two runs:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestParseSample(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"aishe_up 1", "aishe_up", map[string]string{}, 1},
+		{"aishe_up 1 1700000000000", "aishe_up", map[string]string{}, 1},
+		{`aishe_x{a="1",b="two words"} 2.5`, "aishe_x", map[string]string{"a": "1", "b": "two words"}, 2.5},
+		{`aishe_x{a="q\"uote",b="back\\slash",c="new\nline",} +Inf`, "aishe_x", map[string]string{"a": `q"uote`, "b": `back\slash`, "c": "new\nline"}, math.Inf(1)},
+		{`aishe_x{le="}"} 3`, "aishe_x", map[string]string{"le": "}"}, 3},
+	}
+	for _, tt := range tests {
+		name, labels, value, err := parseSample(tt.line)
+		if err != nil {
+			t.Errorf("parseSample(%q): %v", tt.line, err)
+			continue
+		}
+		if name != tt.name || value != tt.value || len(labels) != len(tt.labels) {
+			t.Errorf("parseSample(%q) = %s %v %v, want %s %v %v", tt.line, name, labels, value, tt.name, tt.labels, tt.value)
+			continue
+		}
+		for label, want := range tt.labels {
+			if labels[label] != want {
+				t.Errorf("parseSample(%q): label %s = %q, want %q", tt.line, label, labels[label], want)
+			}
+		}
+	}
+
+	for _, line := range []string{`aishe_x{a="open} 1`, `aishe_x{a} 1`, "aishe_x", "aishe_x one"} {
+		if _, _, _, err := parseSample(line); err == nil {
+			t.Errorf("parseSample(%q) succeeded, want an error", line)
+		}
+	}
+}
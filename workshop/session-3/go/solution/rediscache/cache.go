@@ -0,0 +1,492 @@
+// Package rediscache implements a semantic cache stored in Redis Stack.
+//
+// Each entry is a hash holding the prompt, the response, its attributes and
+// the prompt's embedding. A RediSearch index (FT.CREATE ... VECTOR) over the
+// hashes finds the nearest questions with KNN queries, and attributes are
+// indexed as TAG values so searches can be scoped exactly like LangCache
+// searches. Entry TTLs are plain key expirations.
+package rediscache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"session3/langcache"
+	"session3/semcache"
+)
+
+// ErrNotFound is returned when an entry does not exist or has expired
+var ErrNotFound = errors.New("rediscache: entry not found")
+
+// Defaults used by New
+const (
+	DefaultNamespace = "aishe:semantic"
+	DefaultK         = 10
+)
+
+// Hash fields of an entry
+const (
+	fieldPrompt     = "prompt"
+	fieldResponse   = "response"
+	fieldAttributes = "attributes"
+	fieldTags       = "tags"
+	fieldEmbedding  = "embedding"
+	fieldCreatedAt  = "created_at"
+	fieldDistance   = "distance"
+)
+
+// tagSeparator separates the name=value pairs of the tags field
+const tagSeparator = ","
+
+// Cache is a semantic cache backed by Redis Stack vector search. The
+// client must use RESP2 (redis.Options{Protocol: 2}) because go-redis only
+// decodes FT.SEARCH replies in RESP3 when UnstableResp3 is set. A Cache is
+// safe for concurrent use.
+type Cache struct {
+	rdb       *redis.Client
+	embedder  semcache.Embedder
+	namespace string
+	index     string
+	prefix    string
+	k         int
+
+	mu      sync.Mutex
+	created bool
+}
+
+// Option configures a Cache
+type Option func(*Cache)
+
+// WithNamespace sets the prefix of the index name and entry keys
+// (default: DefaultNamespace)
+func WithNamespace(namespace string) Option {
+	return func(c *Cache) {
+		if namespace != "" {
+			c.namespace = namespace
+		}
+	}
+}
+
+// WithK sets how many nearest neighbours a search first retrieves before
+// the similarity threshold is applied (default: DefaultK). Searches widen
+// from there while every neighbour passes the threshold.
+func WithK(k int) Option {
+	return func(c *Cache) {
+		if k > 0 {
+			c.k = k
+		}
+	}
+}
+
+// New creates a cache that embeds prompts with embedder and stores them in
+// rdb. The namespace is suffixed with the embedder name, so vectors from
+// different embedders never share an index.
+func New(rdb *redis.Client, embedder semcache.Embedder, opts ...Option) *Cache {
+	c := &Cache{rdb: rdb, embedder: embedder, namespace: DefaultNamespace, k: DefaultK}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	base := c.namespace + ":" + sanitizeName(embedder.Name())
+	c.index = base + ":idx"
+	c.prefix = base + ":entry:"
+	return c
+}
+
+// Close closes the Redis client the cache was created with
+func (c *Cache) Close() error {
+	return c.rdb.Close()
+}
+
+// Index returns the name of the RediSearch index
+func (c *Cache) Index() string {
+	return c.index
+}
+
+// sanitizeName keeps only characters that are safe in key and index names
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// ensureIndex creates the vector index for vectors of the given size,
+// unless it already exists
+func (c *Cache) ensureIndex(ctx context.Context, dim int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.created {
+		return nil
+	}
+
+	err := c.rdb.FTCreate(ctx, c.index,
+		&redis.FTCreateOptions{OnHash: true, Prefix: []interface{}{c.prefix}},
+		&redis.FieldSchema{FieldName: fieldTags, FieldType: redis.SearchFieldTypeTag, Separator: tagSeparator, CaseSensitive: true},
+		&redis.FieldSchema{FieldName: fieldEmbedding, FieldType: redis.SearchFieldTypeVector, VectorArgs: &redis.FTVectorArgs{
+			HNSWOptions: &redis.FTHNSWOptions{Type: "FLOAT32", Dim: dim, DistanceMetric: "COSINE"},
+		}},
+	).Err()
+	if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		return fmt.Errorf("rediscache: create index %s: %w", c.index, err)
+	}
+
+	c.created = true
+	return nil
+}
+
+// isMissingIndex reports whether err means the index has not been created yet
+func isMissingIndex(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such index") || strings.Contains(msg, "unknown index name")
+}
+
+// encodeVector converts a vector to the little-endian FLOAT32 blob Redis expects
+func encodeVector(vector []float32) string {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return string(buf)
+}
+
+// encodeTags renders attributes as name=value TAG values, sorted for stable output
+func encodeTags(attributes map[string]string) string {
+	tags := make([]string, 0, len(attributes))
+	for name, value := range attributes {
+		tags = append(tags, name+"="+value)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, tagSeparator)
+}
+
+// escapeTag escapes every character RediSearch treats as syntax in a TAG query
+func escapeTag(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r > 127) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// attributeFilter builds a query matching entries that carry all of the attributes
+func attributeFilter(attributes map[string]string) (string, error) {
+	if len(attributes) == 0 {
+		return "*", nil
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name, value := range attributes {
+		if strings.Contains(name+value, tagSeparator) {
+			return "", fmt.Errorf("rediscache: attribute %s=%s must not contain %q", name, value, tagSeparator)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clauses := make([]string, len(names))
+	for i, name := range names {
+		clauses[i] = fmt.Sprintf("@%s:{%s}", fieldTags, escapeTag(name+"="+attributes[name]))
+	}
+	return "(" + strings.Join(clauses, " ") + ")", nil
+}
+
+// embedOne embeds a single text
+func (c *Cache) embedOne(ctx context.Context, text string) ([]float32, error) {
+	vectors, err := c.embedder.Embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// Search returns entries at least threshold similar to prompt and
+// carrying all of the given attributes, most similar first. It asks for K
+// nearest neighbours and widens the query until one comes back below the
+// threshold, so every match is found however many there are.
+func (c *Cache) Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	filter, err := attributeFilter(attributes)
+	if err != nil {
+		return nil, err
+	}
+	query, err := c.embedOne(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	vector := encodeVector(query)
+
+	for k := c.k; ; k *= 4 {
+		result, err := c.rdb.FTSearchWithArgs(ctx, c.index,
+			fmt.Sprintf("%s=>[KNN $k @%s $vec AS %s]", filter, fieldEmbedding, fieldDistance),
+			&redis.FTSearchOptions{
+				Params: map[string]interface{}{"k": k, "vec": vector},
+				Return: []redis.FTSearchReturn{
+					{FieldName: fieldPrompt}, {FieldName: fieldResponse},
+					{FieldName: fieldAttributes}, {FieldName: fieldDistance},
+				},
+				SortBy:         []redis.FTSearchSortBy{{FieldName: fieldDistance, Asc: true}},
+				Limit:          k,
+				DialectVersion: 2,
+			},
+		).Result()
+		if err != nil {
+			if isMissingIndex(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("rediscache: search: %w", err)
+		}
+
+		var entries []langcache.Entry
+		exhausted := len(result.Docs) < k
+		for _, doc := range result.Docs {
+			distance, err := strconv.ParseFloat(doc.Fields[fieldDistance], 64)
+			if err != nil {
+				return nil, fmt.Errorf("rediscache: entry %s: invalid distance: %w", doc.ID, err)
+			}
+			// COSINE distance is 1 - cosine similarity
+			similarity := math.Max(0, math.Min(1, 1-distance))
+			if similarity < threshold {
+				exhausted = true
+				break
+			}
+
+			entry, err := c.docToEntry(doc.ID, doc.Fields)
+			if err != nil {
+				return nil, err
+			}
+			entry.Similarity = &similarity
+			entries = append(entries, entry)
+		}
+
+		if exhausted {
+			return entries, nil
+		}
+	}
+}
+
+// docToEntry converts the hash fields of an entry key to an Entry
+func (c *Cache) docToEntry(key string, fields map[string]string) (langcache.Entry, error) {
+	entry := langcache.Entry{
+		ID:       strings.TrimPrefix(key, c.prefix),
+		Prompt:   fields[fieldPrompt],
+		Response: fields[fieldResponse],
+	}
+	if raw := fields[fieldAttributes]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &entry.Attributes); err != nil {
+			return langcache.Entry{}, fmt.Errorf("rediscache: entry %s: invalid attributes: %w", entry.ID, err)
+		}
+	}
+	return entry, nil
+}
+
+// Set stores a prompt/response pair and returns the new entry ID.
+// A ttl of zero keeps the entry until it is deleted.
+func (c *Cache) Set(ctx context.Context, prompt, response string, attributes map[string]string, ttl time.Duration) (string, error) {
+	if _, err := attributeFilter(attributes); err != nil {
+		return "", err
+	}
+	vector, err := c.embedOne(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	if err := c.ensureIndex(ctx, len(vector)); err != nil {
+		return "", err
+	}
+
+	attributesJSON, err := json.Marshal(attributes)
+	if err != nil {
+		return "", err
+	}
+	id, err := newEntryID()
+	if err != nil {
+		return "", err
+	}
+
+	key := c.prefix + id
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, key,
+		fieldPrompt, prompt,
+		fieldResponse, response,
+		fieldAttributes, string(attributesJSON),
+		fieldTags, encodeTags(attributes),
+		fieldEmbedding, encodeVector(vector),
+		fieldCreatedAt, time.Now().UTC().Format(time.RFC3339),
+	)
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("rediscache: set: %w", err)
+	}
+
+	return id, nil
+}
+
+// Get returns a single entry by ID
+func (c *Cache) Get(ctx context.Context, entryID string) (*langcache.Entry, error) {
+	fields, err := c.rdb.HMGet(ctx, c.prefix+entryID, fieldPrompt, fieldResponse, fieldAttributes).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rediscache: get: %w", err)
+	}
+	if fields[0] == nil {
+		return nil, ErrNotFound
+	}
+
+	values := make(map[string]string, len(fields))
+	for i, name := range []string{fieldPrompt, fieldResponse, fieldAttributes} {
+		if s, ok := fields[i].(string); ok {
+			values[name] = s
+		}
+	}
+	entry, err := c.docToEntry(c.prefix+entryID, values)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Entries returns every entry, newest first. It scans the entry keys
+// rather than the index, so it also works before the first search.
+func (c *Cache) Entries(ctx context.Context) ([]langcache.Entry, error) {
+	type stored struct {
+		entry     langcache.Entry
+		createdAt string
+	}
+
+	var all []stored
+	iter := c.rdb.Scan(ctx, 0, c.prefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		fields, err := c.rdb.HMGet(ctx, key, fieldPrompt, fieldResponse, fieldAttributes, fieldCreatedAt).Result()
+		if err != nil {
+			return nil, fmt.Errorf("rediscache: entries: %w", err)
+		}
+		if fields[0] == nil {
+			continue // Expired since the scan found it
+		}
+
+		values := make(map[string]string, len(fields))
+		for i, name := range []string{fieldPrompt, fieldResponse, fieldAttributes, fieldCreatedAt} {
+			if s, ok := fields[i].(string); ok {
+				values[name] = s
+			}
+		}
+		entry, err := c.docToEntry(key, values)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, stored{entry: entry, createdAt: values[fieldCreatedAt]})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("rediscache: entries: %w", err)
+	}
+
+	// created_at is RFC 3339 in UTC, so it sorts chronologically as a string
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].createdAt > all[j].createdAt
+	})
+	entries := make([]langcache.Entry, len(all))
+	for i, s := range all {
+		entries[i] = s.entry
+	}
+	return entries, nil
+}
+
+// Delete removes a single entry by ID
+func (c *Cache) Delete(ctx context.Context, entryID string) error {
+	deleted, err := c.rdb.Del(ctx, c.prefix+entryID).Result()
+	if err != nil {
+		return fmt.Errorf("rediscache: delete: %w", err)
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteByAttributes removes every entry carrying all of the given
+// attributes and returns how many were removed. Like LangCache, it refuses
+// an empty attribute set; use Flush to remove everything.
+func (c *Cache) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	if len(attributes) == 0 {
+		return 0, errors.New("rediscache: delete by attributes requires at least one attribute")
+	}
+	filter, err := attributeFilter(attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		result, err := c.rdb.FTSearchWithArgs(ctx, c.index, filter, &redis.FTSearchOptions{
+			NoContent:      true,
+			Limit:          1000,
+			DialectVersion: 2,
+		}).Result()
+		if err != nil {
+			if isMissingIndex(err) {
+				return count, nil
+			}
+			return count, fmt.Errorf("rediscache: delete by attributes: %w", err)
+		}
+		if len(result.Docs) == 0 {
+			return count, nil
+		}
+
+		keys := make([]string, len(result.Docs))
+		for i, doc := range result.Docs {
+			keys[i] = doc.ID
+		}
+		deleted, err := c.rdb.Del(ctx, keys...).Result()
+		if err != nil {
+			return count, fmt.Errorf("rediscache: delete by attributes: %w", err)
+		}
+		count += int(deleted)
+		if deleted == 0 {
+			// The remaining documents expired before we got to them
+			return count, nil
+		}
+	}
+}
+
+// Flush drops the index together with every entry
+func (c *Cache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.rdb.FTDropIndexWithArgs(ctx, c.index, &redis.FTDropIndexOptions{DeleteDocs: true}).Err()
+	if err != nil && !isMissingIndex(err) {
+		return fmt.Errorf("rediscache: flush: %w", err)
+	}
+	c.created = false
+	return nil
+}
+
+// newEntryID returns a random 128-bit hex ID
+func newEntryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,189 @@
+package rediscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"session3/semcache"
+)
+
+// newTestCache connects to the Redis Stack at REDIS_STACK_ADDR (default:
+// localhost:6379) and returns a cache in a namespace of its own. The test
+// is skipped when no server with the search module is reachable, e.g.
+//
+//	docker run --rm -p 6379:6379 redis/redis-stack-server
+//
+// unless REDIS_STACK_REQUIRED is set, as in CI, where it fails instead.
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_STACK_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	unavailable := t.Skipf
+	if os.Getenv("REDIS_STACK_REQUIRED") != "" {
+		unavailable = t.Fatalf
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		unavailable("Redis Stack not available at %s: %v", addr, err)
+	}
+	if err := rdb.Do(ctx, "FT._LIST").Err(); err != nil {
+		rdb.Close()
+		unavailable("Redis at %s has no search module: %v", addr, err)
+	}
+
+	namespace := "aishe:test:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	cache := New(rdb, semcache.NewNGramEmbedder(256), WithNamespace(namespace))
+	t.Cleanup(func() {
+		cache.Flush(context.Background())
+		cache.Close()
+	})
+	return cache
+}
+
+func TestSearchAppliesThresholdAndAttributes(t *testing.T) {
+	cache := newTestCache(t)
+	ctx := context.Background()
+
+	english := map[string]string{"language": "en", "model": "llama3.2:3b"}
+	german := map[string]string{"language": "de", "model": "llama3.2:3b"}
+	if _, err := cache.Set(ctx, "What is the capital of France?", "Paris", english, 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := cache.Set(ctx, "What is the capital of France?", "Paris (de)", german, 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	entries, err := cache.Search(ctx, "what is the capital of france", 0.8, english)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Response != "Paris" {
+		t.Fatalf("Search = %+v, want only the English entry", entries)
+	}
+	if sim := *entries[0].Similarity; sim < 0.8 || sim > 1 {
+		t.Errorf("similarity = %f, want between 0.8 and 1", sim)
+	}
+	if entries[0].Attributes["model"] != "llama3.2:3b" {
+		t.Errorf("attributes = %v, want them round-tripped", entries[0].Attributes)
+	}
+
+	entries, err = cache.Search(ctx, "How do volcanoes form?", 0.8, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("unrelated question matched %+v", entries)
+	}
+}
+
+func TestSearchWidensBeyondK(t *testing.T) {
+	cache := newTestCache(t)
+	ctx := context.Background()
+
+	// More copies of one question than the first KNN query retrieves
+	count := 3*DefaultK + 1
+	for i := 0; i < count; i++ {
+		if _, err := cache.Set(ctx, "What is the capital of France?", "Paris "+strconv.Itoa(i), nil, 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if _, err := cache.Set(ctx, "How do volcanoes form?", "Magma", nil, 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	entries, err := cache.Search(ctx, "What is the capital of France?", 0.9, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(entries) != count {
+		t.Errorf("Search returned %d entries, want all %d copies", len(entries), count)
+	}
+}
+
+func TestEntriesExpireAfterTTL(t *testing.T) {
+	cache := newTestCache(t)
+	ctx := context.Background()
+
+	if _, err := cache.Set(ctx, "What is Redis?", "A database", nil, 200*time.Millisecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+
+	entries, err := cache.Search(ctx, "What is Redis?", 0.5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expired entry returned: %+v", entries)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cache := newTestCache(t)
+	ctx := context.Background()
+
+	id, err := cache.Set(ctx, "What is Go?", "A language", map[string]string{"run": "a"}, 0)
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for _, prompt := range []string{"What is Rust?", "What is Zig?"} {
+		if _, err := cache.Set(ctx, prompt, "A language", map[string]string{"run": "b"}, 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	if err := cache.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := cache.Delete(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete = %v, want ErrNotFound", err)
+	}
+
+	count, err := cache.DeleteByAttributes(ctx, map[string]string{"run": "b"})
+	if err != nil || count != 2 {
+		t.Errorf("DeleteByAttributes = %d, %v, want 2, nil", count, err)
+	}
+	if _, err := cache.DeleteByAttributes(ctx, nil); err == nil {
+		t.Error("DeleteByAttributes accepted an empty attribute set")
+	}
+}
+
+func TestAttributeFilter(t *testing.T) {
+	got, err := attributeFilter(map[string]string{"model": "llama3.2:3b", "tenant": "acme corp"})
+	if err != nil {
+		t.Fatalf("attributeFilter: %v", err)
+	}
+	want := `(@tags:{model\=llama3\.2\:3b} @tags:{tenant\=acme\ corp})`
+	if got != want {
+		t.Errorf("attributeFilter = %s, want %s", got, want)
+	}
+
+	if _, err := attributeFilter(map[string]string{"tenant": "a,b"}); err == nil {
+		t.Error("attributeFilter accepted a value containing the tag separator")
+	}
+}
+
+func TestCloseReleasesClient(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:0", Protocol: 2})
+	var cache io.Closer = New(rdb, semcache.NewNGramEmbedder(256))
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := rdb.Ping(context.Background()).Err(); !errors.Is(err, redis.ErrClosed) {
+		t.Errorf("Ping after Close = %v, want redis.ErrClosed", err)
+	}
+}
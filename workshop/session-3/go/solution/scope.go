@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// responseSchemaVersion is stored with every entry so answers written in an
+// older Response format are never served to a client expecting a newer one
+const responseSchemaVersion = "1"
+
+// defaultCacheScope lists the attributes attached to cache entries when
+// CACHE_SCOPE is not set
+var defaultCacheScope = []string{"aishe_server", "model", "language", "tenant", "schema_version"}
+
+// attributeFlag collects repeated --attr key=value flags
+type attributeFlag map[string]string
+
+func (a attributeFlag) String() string {
+	return formatAttributes(a)
+}
+
+func (a attributeFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	a[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	return nil
+}
+
+// parseScope splits a comma-separated list of attribute names
+func parseScope(value string) []string {
+	var scope []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			scope = append(scope, name)
+		}
+	}
+	return scope
+}
+
+// defaultAttributeValue returns the value of a built-in scope attribute
+func defaultAttributeValue(name, aisheURL string) (string, bool) {
+	switch name {
+	case "aishe_server":
+		if u, err := url.Parse(aisheURL); err == nil && u.Host != "" {
+			return u.Host, true
+		}
+		return aisheURL, true
+	case "model":
+		if model := os.Getenv("AISHE_MODEL"); model != "" {
+			return model, true
+		}
+		return "llama3.2:3b", true
+	case "language":
+		if language := os.Getenv("CACHE_LANGUAGE"); language != "" {
+			return language, true
+		}
+		return "en", true
+	case "tenant":
+		return os.Getenv("CACHE_TENANT"), true
+	case "schema_version":
+		return responseSchemaVersion, true
+	}
+	return "", false
+}
+
+// loadCacheAttributes builds the attributes used to scope cache entries.
+// The scope (CACHE_SCOPE or --scope) selects which attributes are used,
+// and --attr overrides or adds values. Attributes with empty values are
+// left out, so e.g. an unset tenant does not partition the cache.
+func loadCacheAttributes(aisheURL, scopeOverride string, overrides map[string]string) (map[string]string, error) {
+	scope := defaultCacheScope
+	if envScope, ok := os.LookupEnv("CACHE_SCOPE"); ok {
+		scope = parseScope(envScope)
+	}
+	if scopeOverride != "" {
+		scope = parseScope(scopeOverride)
+	}
+
+	attributes := make(map[string]string)
+	for _, name := range scope {
+		if value, ok := overrides[name]; ok {
+			attributes[name] = value
+			continue
+		}
+		value, ok := defaultAttributeValue(name, aisheURL)
+		if !ok {
+			return nil, fmt.Errorf("unknown scope attribute %q (set it with --attr %s=value)", name, name)
+		}
+		attributes[name] = value
+	}
+
+	// Explicit attributes are always included, even outside the scope
+	for name, value := range overrides {
+		attributes[name] = value
+	}
+
+	for name, value := range attributes {
+		if value == "" {
+			delete(attributes, name)
+		}
+	}
+
+	return attributes, nil
+}
+
+// formatAttributes renders attributes as sorted key=value pairs
+func formatAttributes(attributes map[string]string) string {
+	pairs := make([]string, 0, len(attributes))
+	for name, value := range attributes {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
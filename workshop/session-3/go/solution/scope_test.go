@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadCacheAttributes(t *testing.T) {
+	const aisheURL = "http://aishe.internal:8000"
+	tests := []struct {
+		name       string
+		cacheScope string
+		unsetScope bool // CACHE_SCOPE left out of the environment
+		scope      string
+		attrs      map[string]string
+		want       string // formatAttributes of the result, or the error
+	}{
+		{
+			name:       "default scope",
+			unsetScope: true,
+			want:       "aishe_server=aishe.internal:8000, language=en, model=llama3.2:3b, schema_version=1",
+		},
+		{
+			name:       "CACHE_SCOPE",
+			cacheScope: "model, language",
+			want:       "language=en, model=llama3.2:3b",
+		},
+		{
+			name:       "empty CACHE_SCOPE shares entries across everything",
+			cacheScope: "",
+			want:       "",
+		},
+		{
+			name:       "--scope wins over CACHE_SCOPE",
+			cacheScope: "model,language",
+			scope:      "schema_version",
+			want:       "schema_version=1",
+		},
+		{
+			name:       "--attr overrides a scope attribute",
+			cacheScope: "model,language",
+			attrs:      map[string]string{"language": "fr"},
+			want:       "language=fr, model=llama3.2:3b",
+		},
+		{
+			name:       "--attr outside the scope is added",
+			cacheScope: "model",
+			attrs:      map[string]string{"team": "search"},
+			want:       "model=llama3.2:3b, team=search",
+		},
+		{
+			name:       "--attr sets an attribute with no default",
+			cacheScope: "model,team",
+			attrs:      map[string]string{"team": "search"},
+			want:       "model=llama3.2:3b, team=search",
+		},
+		{
+			name:       "empty --attr drops a scope attribute",
+			cacheScope: "model,language",
+			attrs:      map[string]string{"language": ""},
+			want:       "model=llama3.2:3b",
+		},
+		{
+			name:       "empty default values are dropped",
+			cacheScope: "tenant,schema_version",
+			want:       "schema_version=1",
+		},
+		{
+			name:       "unknown attribute",
+			cacheScope: "model,team",
+			want:       `unknown scope attribute "team" (set it with --attr team=value)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("CACHE_SCOPE", tt.cacheScope)
+		if tt.unsetScope {
+			os.Unsetenv("CACHE_SCOPE")
+		}
+		t.Setenv("AISHE_MODEL", "")
+		t.Setenv("CACHE_LANGUAGE", "")
+		t.Setenv("CACHE_TENANT", "")
+
+		attributes, err := loadCacheAttributes(aisheURL, tt.scope, tt.attrs)
+		got := formatAttributes(attributes)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: loadCacheAttributes = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultAttributeValue(t *testing.T) {
+	t.Setenv("AISHE_MODEL", "qwen2.5:7b")
+	t.Setenv("CACHE_LANGUAGE", "de")
+	t.Setenv("CACHE_TENANT", "acme")
+
+	tests := []struct {
+		name, aisheURL, want string
+	}{
+		{"aishe_server", "http://localhost:8000/", "localhost:8000"},
+		{"aishe_server", "localhost:8000", "localhost:8000"},
+		{"model", "", "qwen2.5:7b"},
+		{"language", "", "de"},
+		{"tenant", "", "acme"},
+		{"schema_version", "", responseSchemaVersion},
+	}
+	for _, tt := range tests {
+		if got, ok := defaultAttributeValue(tt.name, tt.aisheURL); !ok || got != tt.want {
+			t.Errorf("defaultAttributeValue(%s, %q) = %q, %v; want %q", tt.name, tt.aisheURL, got, ok, tt.want)
+		}
+	}
+	if _, ok := defaultAttributeValue("team", ""); ok {
+		t.Error("defaultAttributeValue(team) has a default")
+	}
+}
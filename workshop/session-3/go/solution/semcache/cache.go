@@ -0,0 +1,579 @@
+package semcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"session3/langcache"
+)
+
+// ErrNotFound is returned when an entry does not exist or has expired
+var ErrNotFound = errors.New("semcache: entry not found")
+
+// entry is a cached question with its vector and response payload
+type entry struct {
+	ID         string            `json:"id"`
+	Prompt     string            `json:"prompt"`
+	Response   string            `json:"response"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+	Vector     []float32         `json:"vector"`
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+func (e *entry) matches(attributes map[string]string) bool {
+	for name, value := range attributes {
+		if e.Attributes[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *entry) toEntry(similarity *float64) langcache.Entry {
+	return langcache.Entry{
+		ID:         e.ID,
+		Prompt:     e.Prompt,
+		Response:   e.Response,
+		Attributes: e.Attributes,
+		Similarity: similarity,
+	}
+}
+
+// snapshot is the on-disk format of a cache
+type snapshot struct {
+	Embedder string          `json:"embedder"`
+	Fit      json.RawMessage `json:"fit,omitempty"`     // Weights of a Fitter embedder
+	FitSize  int             `json:"fitSize,omitempty"` // Questions the weights were fitted on
+	Entries  []*entry        `json:"entries"`
+}
+
+// journalRecord is a line of the journal kept next to a snapshot: an entry
+// stored or the ID of an entry deleted since the snapshot was written
+type journalRecord struct {
+	Set    *entry `json:"set,omitempty"`
+	Delete string `json:"delete,omitempty"`
+}
+
+// journalSuffix is appended to the snapshot path to name its journal
+const journalSuffix = ".log"
+
+// minCompaction is the journal length below which it is never folded into
+// the snapshot. Above it the snapshot is rewritten once the journal holds
+// more records than the cache holds entries, so each write costs O(1)
+// amortized instead of a full rewrite.
+const minCompaction = 64
+
+// refitGrowth is how many times larger the corpus must have grown since a
+// Fitter embedder was fitted before Open fits it again, so weights fitted
+// on the first few questions do not stick forever while refitting costs
+// only O(1) embeddings per entry over the life of a cache
+const refitGrowth = 2
+
+// searchBatch is the number of neighbors first requested from the index;
+// Search asks for more when all of them pass the threshold
+const searchBatch = 32
+
+// Cache is a local semantic cache. Entries are kept in memory and searched
+// through an Index. When a path is set, every change is appended to a
+// journal next to the snapshot at path, and the journal is folded into the
+// snapshot as it grows and on Open. A Cache is safe for concurrent use.
+type Cache struct {
+	embedder  Embedder
+	path      string
+	index     Index
+	indexFile string // Where the index is saved, see WithIndexFile
+	fitSize   int    // Questions a Fitter embedder was fitted on
+
+	mu          sync.RWMutex
+	entries     map[string]*entry
+	snapshotted bool // The snapshot at path exists
+	journaled   int  // Records in the journal
+}
+
+// Option configures a Cache
+type Option func(*Cache)
+
+// WithIndex sets the vector index used by Search (default: a FlatIndex).
+// The index may be restored from a snapshot: Open adds the entries it is
+// missing and removes the ones that no longer exist.
+func WithIndex(index Index) Option {
+	return func(c *Cache) {
+		c.index = index
+	}
+}
+
+// fileIndex is an Index that can be saved to a file, such as HNSW
+type fileIndex interface {
+	Index
+	SaveFile(path string) error
+}
+
+// WithIndexFile sets the file an index restored with WithIndex is saved
+// to. The index is saved there whenever the snapshot is rewritten, and the
+// file is removed before re-embedded vectors are saved, so after a crash
+// the file never holds vectors older than the snapshot.
+func WithIndexFile(path string) Option {
+	return func(c *Cache) {
+		c.indexFile = path
+	}
+}
+
+// Open loads the cache stored at path (empty for an in-memory cache) and
+// replays its journal. Stored vectors are reused when they were produced by
+// the same embedder; otherwise every entry is re-embedded. A Fitter
+// embedder gets the weights stored with the vectors, and is only fitted
+// again, re-embedding every entry, when they are missing or the corpus has
+// grown refitGrowth times. A journal left over is folded into the snapshot.
+func Open(ctx context.Context, path string, embedder Embedder, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		embedder: embedder,
+		path:     path,
+		entries:  make(map[string]*entry),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.index == nil {
+		c.index = NewFlatIndex()
+	}
+	if path == "" {
+		c.index.Clear()
+		return c, nil
+	}
+
+	var snap snapshot
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, err
+		}
+		c.snapshotted = true
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	for _, e := range snap.Entries {
+		c.entries[e.ID] = e
+	}
+	replayed, err := c.replayJournal()
+	if err != nil {
+		return nil, err
+	}
+	if !c.snapshotted && replayed == 0 {
+		c.index.Clear()
+		return c, nil
+	}
+
+	now := time.Now()
+	prompts := make([]string, 0, len(c.entries))
+	for id, e := range c.entries {
+		if e.expired(now) {
+			delete(c.entries, id)
+			continue
+		}
+		prompts = append(prompts, e.Prompt)
+	}
+
+	sameEmbedder := snap.Embedder == embedder.Name()
+	reembed := !sameEmbedder
+	if fitter, ok := embedder.(Fitter); ok && len(prompts) > 0 {
+		restored := false
+		if sameEmbedder && len(snap.Fit) > 0 && len(prompts) < refitGrowth*snap.FitSize {
+			// Weights that cannot be restored are simply fitted again
+			restored = fitter.SetFitState(snap.Fit) == nil
+		}
+		if restored {
+			c.fitSize = snap.FitSize
+		} else {
+			fitter.Fit(prompts)
+			c.fitSize = len(prompts)
+			reembed = true
+		}
+	}
+	if reembed {
+		if err := c.reembed(ctx); err != nil {
+			return nil, err
+		}
+		c.index.Clear()
+		if c.indexFile != "" {
+			if err := os.Remove(c.indexFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	c.syncIndex()
+
+	if reembed || replayed > 0 {
+		if err := c.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// replayJournal applies the journal to the loaded entries and returns the
+// number of records applied. Replaying is idempotent, so a journal that
+// outlived its snapshot's rewrite does no harm. A partial last line, left
+// by a crash while appending, ends the journal.
+func (c *Cache) replayJournal() (int, error) {
+	file, err := os.Open(c.path + journalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	replayed := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// Without its newline the last record may be cut short
+			if errors.Is(err, io.EOF) {
+				return replayed, nil
+			}
+			return replayed, err
+		}
+		var record journalRecord
+		if json.Unmarshal(line, &record) != nil {
+			return replayed, nil
+		}
+		switch {
+		case record.Set != nil:
+			c.entries[record.Set.ID] = record.Set
+		case record.Delete != "":
+			delete(c.entries, record.Delete)
+		}
+		replayed++
+	}
+}
+
+// syncIndex makes the index hold exactly the vectors of the loaded entries
+func (c *Cache) syncIndex() {
+	indexed := make(map[string]bool, c.index.Len())
+	for _, id := range c.index.IDs() {
+		if _, ok := c.entries[id]; ok {
+			indexed[id] = true
+		} else {
+			c.index.Remove(id)
+		}
+	}
+	for id, e := range c.entries {
+		if !indexed[id] {
+			c.index.Add(id, e.Vector)
+		}
+	}
+}
+
+// reembed recomputes the vector of every entry
+func (c *Cache) reembed(ctx context.Context) error {
+	entries := make([]*entry, 0, len(c.entries))
+	prompts := make([]string, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+		prompts = append(prompts, e.Prompt)
+	}
+	if len(prompts) == 0 {
+		return nil
+	}
+
+	vectors, err := c.embedder.Embed(ctx, prompts)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		e.Vector = vectors[i]
+	}
+	return nil
+}
+
+// embedOne embeds a single text
+func (c *Cache) embedOne(ctx context.Context, text string) ([]float32, error) {
+	vectors, err := c.embedder.Embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// Search returns entries at least threshold similar to prompt and carrying
+// all of the given attributes, most similar first
+func (c *Cache) Search(ctx context.Context, prompt string, threshold float64, attributes map[string]string) ([]langcache.Entry, error) {
+	query, err := c.embedOne(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// Widen the search until the index runs out of neighbors above the threshold
+	for k := searchBatch; ; k *= 4 {
+		neighbors := c.index.Search(query, k)
+
+		var results []langcache.Entry
+		exhausted := len(neighbors) < k
+		for _, n := range neighbors {
+			if n.Similarity < threshold {
+				exhausted = true
+				break
+			}
+			e, ok := c.entries[n.ID]
+			if !ok || e.expired(now) || !e.matches(attributes) {
+				continue
+			}
+			similarity := n.Similarity
+			results = append(results, e.toEntry(&similarity))
+		}
+
+		if exhausted {
+			sort.SliceStable(results, func(i, j int) bool {
+				return *results[i].Similarity > *results[j].Similarity
+			})
+			return results, nil
+		}
+	}
+}
+
+// Set stores a prompt/response pair and returns the new entry ID.
+// A ttl of zero keeps the entry until it is deleted.
+func (c *Cache) Set(ctx context.Context, prompt, response string, attributes map[string]string, ttl time.Duration) (string, error) {
+	vector, err := c.embedOne(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	id, err := newEntryID()
+	if err != nil {
+		return "", err
+	}
+
+	e := &entry{
+		ID:         id,
+		Prompt:     prompt,
+		Response:   response,
+		Attributes: attributes,
+		CreatedAt:  time.Now().UTC(),
+		Vector:     vector,
+	}
+	if ttl > 0 {
+		expiresAt := e.CreatedAt.Add(ttl)
+		e.ExpiresAt = &expiresAt
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[id] = e
+	c.index.Add(id, vector)
+	return id, c.appendLocked(journalRecord{Set: e})
+}
+
+// Get returns a single entry by ID
+func (c *Cache) Get(ctx context.Context, entryID string) (*langcache.Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.entries[entryID]
+	if !ok || e.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	result := e.toEntry(nil)
+	return &result, nil
+}
+
+// Entries returns every entry that has not expired, newest first
+func (c *Cache) Entries(ctx context.Context) ([]langcache.Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	live := make([]*entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if !e.expired(now) {
+			live = append(live, e)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].CreatedAt.After(live[j].CreatedAt)
+	})
+
+	results := make([]langcache.Entry, len(live))
+	for i, e := range live {
+		results[i] = e.toEntry(nil)
+	}
+	return results, nil
+}
+
+// Delete removes a single entry by ID
+func (c *Cache) Delete(ctx context.Context, entryID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[entryID]; !ok {
+		return ErrNotFound
+	}
+	delete(c.entries, entryID)
+	c.index.Remove(entryID)
+	return c.appendLocked(journalRecord{Delete: entryID})
+}
+
+// DeleteByAttributes removes every entry carrying all of the given
+// attributes and returns how many were removed
+func (c *Cache) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deleted []journalRecord
+	for id, e := range c.entries {
+		if e.matches(attributes) {
+			delete(c.entries, id)
+			c.index.Remove(id)
+			deleted = append(deleted, journalRecord{Delete: id})
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	return len(deleted), c.appendLocked(deleted...)
+}
+
+// Flush removes every entry
+func (c *Cache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*entry)
+	c.index.Clear()
+	return c.saveLocked()
+}
+
+// Len returns the number of stored entries, including expired ones not yet purged
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// appendLocked records changes in the journal, or rewrites the snapshot
+// when there is none yet or the journal has grown past the cache. Callers
+// must hold c.mu.
+func (c *Cache) appendLocked(records ...journalRecord) error {
+	if c.path == "" {
+		return nil
+	}
+	if !c.snapshotted || c.journaled+len(records) > max(len(c.entries), minCompaction) {
+		return c.saveLocked()
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(c.path+journalSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	c.journaled += len(records)
+	return nil
+}
+
+// saveLocked writes the whole cache to the snapshot atomically and then
+// drops the journal it now includes. Callers must hold c.mu (or have
+// exclusive access during Open).
+func (c *Cache) saveLocked() error {
+	if c.path == "" {
+		return nil
+	}
+
+	snap := snapshot{Embedder: c.embedder.Name()}
+	if fitter, ok := c.embedder.(Fitter); ok {
+		state, err := fitter.FitState()
+		if err != nil {
+			return err
+		}
+		snap.Fit, snap.FitSize = state, c.fitSize
+	}
+	now := time.Now()
+	for _, e := range c.entries {
+		if !e.expired(now) {
+			snap.Entries = append(snap.Entries, e)
+		}
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return err
+	}
+	c.snapshotted = true
+
+	if err := os.Remove(c.path + journalSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	c.journaled = 0
+
+	if index, ok := c.index.(fileIndex); ok && c.indexFile != "" {
+		return index.SaveFile(c.indexFile)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// newEntryID returns a random 128-bit hex ID
+func newEntryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,162 @@
+package semcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingEmbedder is an NGramEmbedder counting fits and embedded texts
+type countingEmbedder struct {
+	*NGramEmbedder
+	fits     int
+	embedded int
+}
+
+func newCountingEmbedder(dimensions int) *countingEmbedder {
+	return &countingEmbedder{NGramEmbedder: NewNGramEmbedder(dimensions)}
+}
+
+func (e *countingEmbedder) Fit(corpus []string) {
+	e.fits++
+	e.NGramEmbedder.Fit(corpus)
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.embedded += len(texts)
+	return e.NGramEmbedder.Embed(ctx, texts)
+}
+
+// fillCache stores questions numbered from..to-1
+func fillCache(t *testing.T, cache *Cache, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, err := cache.Set(context.Background(), fmt.Sprintf("What is the population of city number %d?", i), "{}", nil, 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+}
+
+func TestOpenKeepsFittedWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	ctx := context.Background()
+
+	reopen := func(dimensions int) (*Cache, *countingEmbedder) {
+		t.Helper()
+		embedder := newCountingEmbedder(dimensions)
+		cache, err := Open(ctx, path, embedder)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return cache, embedder
+	}
+
+	cache, _ := reopen(0)
+	fillCache(t, cache, 0, 4)
+
+	// The first open with entries fits the embedder and re-embeds them
+	cache, embedder := reopen(0)
+	if embedder.fits != 1 || embedder.embedded != 4 {
+		t.Errorf("first refit: %d fits, %d texts embedded; want 1 and 4", embedder.fits, embedder.embedded)
+	}
+	before, _ := cache.Search(ctx, "population of city number 2", 0.1, nil)
+
+	// Later opens restore the weights instead
+	cache, embedder = reopen(0)
+	if embedder.fits != 0 || embedder.embedded != 0 {
+		t.Errorf("reopen: %d fits, %d texts embedded; want none", embedder.fits, embedder.embedded)
+	}
+	after, _ := cache.Search(ctx, "population of city number 2", 0.1, nil)
+	if len(before) == 0 || len(after) != len(before) || *after[0].Similarity != *before[0].Similarity {
+		t.Errorf("search after reopen = %+v, want %+v", after, before)
+	}
+
+	// Entries added since are kept until the corpus has doubled
+	fillCache(t, cache, 4, 7)
+	if _, embedder = reopen(0); embedder.fits != 0 {
+		t.Errorf("reopen with 7 entries fitted on 4: %d fits, want 0", embedder.fits)
+	}
+	cache, _ = reopen(0)
+	fillCache(t, cache, 7, 8)
+	if _, embedder = reopen(0); embedder.fits != 1 || embedder.embedded != 8 {
+		t.Errorf("reopen with 8 entries fitted on 4: %d fits, %d texts embedded; want 1 and 8", embedder.fits, embedder.embedded)
+	}
+
+	// A different embedder configuration refits
+	if _, embedder = reopen(512); embedder.fits != 1 || embedder.embedded != 8 {
+		t.Errorf("reopen with another embedder: %d fits, %d texts embedded; want 1 and 8", embedder.fits, embedder.embedded)
+	}
+}
+
+// journalLines returns the number of records in the journal at path
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path + journalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("reading journal: %v", err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	ctx := context.Background()
+	open := func() *Cache {
+		t.Helper()
+		cache, err := Open(ctx, path, NewNGramEmbedder(256))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return cache
+	}
+
+	// The first write creates the snapshot, later ones only append
+	cache := open()
+	fillCache(t, cache, 0, 3)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no snapshot after the first write: %v", err)
+	}
+	entries, _ := cache.Entries(ctx)
+	if err := cache.Delete(ctx, entries[0].ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if lines := journalLines(t, path); lines != 3 {
+		t.Errorf("journal holds %d records after 2 sets and a delete, want 3", lines)
+	}
+
+	// A crash can cut the last record short; reopening replays the rest
+	// and folds the journal into the snapshot
+	file, err := os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("opening journal: %v", err)
+	}
+	file.WriteString(`{"set":{"id":"cut`)
+	file.Close()
+
+	cache = open()
+	if cache.Len() != 2 {
+		t.Errorf("reopened cache holds %d entries, want 2", cache.Len())
+	}
+	if _, err := cache.Get(ctx, entries[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted entry came back: %v", err)
+	}
+	if _, err := os.Stat(path + journalSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal left after reopening: %v", err)
+	}
+
+	// The journal never grows past the cache for long
+	fillCache(t, cache, 3, 3+3*minCompaction)
+	if lines := journalLines(t, path); lines > cache.Len() {
+		t.Errorf("journal holds %d records for %d entries", lines, cache.Len())
+	}
+	if cache = open(); cache.Len() != 2+3*minCompaction {
+		t.Errorf("reopened cache holds %d entries, want %d", cache.Len(), 2+3*minCompaction)
+	}
+}
@@ -0,0 +1,65 @@
+// Package semcache is a self-hosted semantic cache. Questions are turned into
+// vectors by a pluggable Embedder and matched by cosine similarity, using the
+// same threshold semantics as LangCache: scores range from 0 to 1 and an
+// entry is a hit when its score is at least the threshold.
+package semcache
+
+import (
+	"context"
+	"math"
+)
+
+// Embedder turns texts into vectors. Vectors returned by one Embedder
+// must all have the same length and be comparable with each other.
+type Embedder interface {
+	// Name identifies the embedding model and its configuration. Vectors
+	// produced under different names must never be compared.
+	Name() string
+
+	// Embed returns one vector per text, in the same order
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Fitter is implemented by embedders whose weights are derived from the
+// corpus, such as TF-IDF. The cache fits them on all stored questions and
+// keeps the fitted weights in its snapshot, refitting and re-embedding
+// every entry only when the weights are missing or the corpus has grown
+// a lot since.
+type Fitter interface {
+	Fit(corpus []string)
+
+	// FitState returns the fitted weights, or nil before Fit
+	FitState() ([]byte, error)
+
+	// SetFitState restores weights returned by FitState
+	SetFitState(state []byte) error
+}
+
+// Normalize scales v to unit length in place and returns it
+func Normalize(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return v
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+	return v
+}
+
+// Cosine returns the cosine similarity of two unit-length vectors,
+// clamped to [0, 1] so it can be compared against a similarity threshold
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return math.Max(0, math.Min(1, dot))
+}
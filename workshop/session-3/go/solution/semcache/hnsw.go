@@ -0,0 +1,576 @@
+package semcache
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+)
+
+// HNSWConfig holds the parameters of an HNSW index
+type HNSWConfig struct {
+	// M is the number of links per node on the upper layers; layer 0 keeps
+	// up to 2*M. Higher values improve recall at the cost of memory.
+	M int
+	// EfConstruction is the candidate list size used while inserting.
+	// Higher values build a better graph more slowly.
+	EfConstruction int
+	// EfSearch is the candidate list size used while searching (at least k).
+	// Higher values improve recall at the cost of latency.
+	EfSearch int
+	// Seed makes level assignment, and therefore the graph, reproducible
+	Seed int64
+}
+
+// DefaultHNSWConfig returns parameters that work well for up to a few
+// hundred thousand questions
+func DefaultHNSWConfig() HNSWConfig {
+	return HNSWConfig{M: 16, EfConstruction: 200, EfSearch: 64, Seed: 1}
+}
+
+// hnswNode is a vector in the graph. Links[l] holds its neighbors on layer
+// l, so the node's level is len(Links)-1. in[l] holds the nodes linking to
+// it on layer l; it is rebuilt from the links when a snapshot is loaded.
+type hnswNode struct {
+	ID     string
+	Vector []float32
+	Links  [][]int32
+
+	in [][]int32
+}
+
+// HNSW is an approximate nearest neighbour index based on Hierarchical
+// Navigable Small World graphs (Malkov & Yashunin, 2016). Removing a node
+// reconnects its former neighbours, so the graph stays navigable without
+// tombstones; reverse links keep that proportional to the node's degree
+// rather than the size of the graph. It is safe for concurrent use.
+type HNSW struct {
+	mu       sync.RWMutex
+	cfg      HNSWConfig
+	levelMul float64
+	rng      *rand.Rand
+	nodes    []*hnswNode // nil for removed nodes
+	free     []int32     // Slots of removed nodes, reused by Add
+	ids      map[string]int32
+	entry    int32 // -1 when empty
+	maxLevel int
+}
+
+// NewHNSW creates an empty HNSW index. Zero config fields take their
+// DefaultHNSWConfig values.
+func NewHNSW(cfg HNSWConfig) *HNSW {
+	defaults := DefaultHNSWConfig()
+	if cfg.M <= 1 {
+		cfg.M = defaults.M
+	}
+	if cfg.EfConstruction <= 0 {
+		cfg.EfConstruction = defaults.EfConstruction
+	}
+	if cfg.EfSearch <= 0 {
+		cfg.EfSearch = defaults.EfSearch
+	}
+
+	return &HNSW{
+		cfg:      cfg,
+		levelMul: 1 / math.Log(float64(cfg.M)),
+		rng:      rand.New(rand.NewSource(cfg.Seed)),
+		ids:      make(map[string]int32),
+		entry:    -1,
+	}
+}
+
+// Config returns the parameters of the index
+func (h *HNSW) Config() HNSWConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+// SetEfSearch changes the candidate list size used by Search
+func (h *HNSW) SetEfSearch(ef int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ef > 0 {
+		h.cfg.EfSearch = ef
+	}
+}
+
+// Len implements Index
+func (h *HNSW) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.ids)
+}
+
+// Clear implements Index
+func (h *HNSW) Clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes = nil
+	h.free = nil
+	h.ids = make(map[string]int32)
+	h.entry = -1
+	h.maxLevel = 0
+}
+
+// maxLinks is the maximum number of links a node keeps on a layer
+func (h *HNSW) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * h.cfg.M
+	}
+	return h.cfg.M
+}
+
+// distance is the cosine distance of two unit-length vectors
+func distance(a, b []float32) float32 {
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot
+}
+
+// Add implements Index
+func (h *HNSW) Add(id string, vector []float32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.ids[id]; ok {
+		h.removeLocked(id)
+	}
+
+	level := int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelMul))
+	node := &hnswNode{ID: id, Vector: vector, Links: make([][]int32, level+1), in: make([][]int32, level+1)}
+
+	var idx int32
+	if n := len(h.free); n > 0 {
+		idx = h.free[n-1]
+		h.free = h.free[:n-1]
+		h.nodes[idx] = node
+	} else {
+		idx = int32(len(h.nodes))
+		h.nodes = append(h.nodes, node)
+	}
+	h.ids[id] = idx
+
+	if h.entry == -1 {
+		h.entry = idx
+		h.maxLevel = level
+		return
+	}
+
+	// Descend greedily through the layers above the new node's level
+	entryPoints := []int32{h.entry}
+	for layer := h.maxLevel; layer > level; layer-- {
+		entryPoints = []int32{h.searchLayer(vector, entryPoints, 1, layer)[0].idx}
+	}
+
+	// Connect the node on each of its layers
+	for layer := min(level, h.maxLevel); layer >= 0; layer-- {
+		candidates := h.searchLayer(vector, entryPoints, h.cfg.EfConstruction, layer)
+		h.setLinks(idx, layer, h.selectNeighbors(candidates, h.cfg.M))
+
+		for _, neighbor := range node.Links[layer] {
+			h.link(neighbor, idx, layer)
+		}
+
+		entryPoints = entryPoints[:0]
+		for _, c := range candidates {
+			entryPoints = append(entryPoints, c.idx)
+		}
+	}
+
+	if level > h.maxLevel {
+		h.entry = idx
+		h.maxLevel = level
+	}
+}
+
+// link adds a link from one node to another, pruning the node's links
+// when it has too many
+func (h *HNSW) link(from, to int32, layer int) {
+	node := h.nodes[from]
+	links := append(node.Links[layer][:len(node.Links[layer]):len(node.Links[layer])], to)
+	if len(links) > h.maxLinks(layer) {
+		links = h.selectNeighbors(h.candidatesFor(node.Vector, links), h.maxLinks(layer))
+	}
+	h.setLinks(from, layer, links)
+}
+
+// setLinks replaces the links of a node on a layer, updating the reverse
+// links of the nodes gained and lost
+func (h *HNSW) setLinks(from int32, layer int, links []int32) {
+	node := h.nodes[from]
+	kept := make(map[int32]bool, len(links))
+	for _, link := range links {
+		kept[link] = true
+	}
+	for _, old := range node.Links[layer] {
+		if kept[old] {
+			delete(kept, old) // Already linked, so its reverse link exists
+		} else {
+			h.unlinkReverse(old, from, layer)
+		}
+	}
+	for _, link := range links {
+		if kept[link] {
+			kept[link] = false
+			target := h.nodes[link]
+			target.in[layer] = append(target.in[layer], from)
+		}
+	}
+	node.Links[layer] = links
+}
+
+// unlinkReverse drops from from the nodes linking to node on a layer
+func (h *HNSW) unlinkReverse(node, from int32, layer int) {
+	in := h.nodes[node].in[layer]
+	for i, idx := range in {
+		if idx == from {
+			in[i] = in[len(in)-1]
+			h.nodes[node].in[layer] = in[:len(in)-1]
+			return
+		}
+	}
+}
+
+// candidatesFor computes the distance from base to each node, sorted nearest first
+func (h *HNSW) candidatesFor(base []float32, idxs []int32) []candidate {
+	candidates := make([]candidate, 0, len(idxs))
+	for _, idx := range idxs {
+		candidates = append(candidates, candidate{idx: idx, dist: distance(base, h.nodes[idx].Vector)})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+	return candidates
+}
+
+// selectNeighbors picks up to m of the candidates (sorted nearest first)
+// using the paper's heuristic: a candidate is preferred when it is closer
+// to the base than to any neighbor already selected, which keeps links
+// spread out in different directions. Remaining slots are filled with the
+// nearest skipped candidates.
+func (h *HNSW) selectNeighbors(candidates []candidate, m int) []int32 {
+	selected := make([]int32, 0, m)
+	var skipped []int32
+	for _, c := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		good := true
+		for _, s := range selected {
+			if distance(h.nodes[c.idx].Vector, h.nodes[s].Vector) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c.idx)
+		} else {
+			skipped = append(skipped, c.idx)
+		}
+	}
+	for _, idx := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, idx)
+	}
+	return selected
+}
+
+// searchLayer runs a best-first search on one layer and returns up to ef
+// candidates, nearest first
+func (h *HNSW) searchLayer(query []float32, entryPoints []int32, ef, layer int) []candidate {
+	visited := make(map[int32]bool, ef*4)
+	toVisit := &candidateHeap{}
+	results := &candidateHeap{farthestFirst: true}
+
+	for _, ep := range entryPoints {
+		if visited[ep] {
+			continue
+		}
+		visited[ep] = true
+		c := candidate{idx: ep, dist: distance(query, h.nodes[ep].Vector)}
+		heap.Push(toVisit, c)
+		heap.Push(results, c)
+		if results.Len() > ef {
+			heap.Pop(results)
+		}
+	}
+
+	for toVisit.Len() > 0 {
+		current := heap.Pop(toVisit).(candidate)
+		if results.Len() >= ef && current.dist > results.items[0].dist {
+			break
+		}
+
+		node := h.nodes[current.idx]
+		if layer >= len(node.Links) {
+			continue
+		}
+		for _, neighbor := range node.Links[layer] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+
+			d := distance(query, h.nodes[neighbor].Vector)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(toVisit, candidate{idx: neighbor, dist: d})
+				heap.Push(results, candidate{idx: neighbor, dist: d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sorted := results.items
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].dist < sorted[j].dist })
+	return sorted
+}
+
+// Search implements Index
+func (h *HNSW) Search(query []float32, k int) []Neighbor {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.entry == -1 || k <= 0 {
+		return nil
+	}
+
+	entryPoints := []int32{h.entry}
+	for layer := h.maxLevel; layer > 0; layer-- {
+		entryPoints = []int32{h.searchLayer(query, entryPoints, 1, layer)[0].idx}
+	}
+
+	candidates := h.searchLayer(query, entryPoints, max(h.cfg.EfSearch, k), 0)
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	neighbors := make([]Neighbor, len(candidates))
+	for i, c := range candidates {
+		neighbors[i] = Neighbor{
+			ID:         h.nodes[c.idx].ID,
+			Similarity: math.Max(0, math.Min(1, float64(1-c.dist))),
+		}
+	}
+	return neighbors
+}
+
+// Remove implements Index
+func (h *HNSW) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(id)
+}
+
+// removeLocked unlinks a node and reconnects every node that pointed to
+// it using the removed node's own neighbors as replacement candidates
+func (h *HNSW) removeLocked(id string) {
+	idx, ok := h.ids[id]
+	if !ok {
+		return
+	}
+	removed := h.nodes[idx]
+	delete(h.ids, id)
+
+	for layer := range removed.Links {
+		for _, link := range removed.Links[layer] {
+			h.unlinkReverse(link, idx, layer)
+		}
+
+		for _, from := range append([]int32(nil), removed.in[layer]...) {
+			// Merge the remaining links with the removed node's links and re-select
+			node := h.nodes[from]
+			merged := make([]int32, 0, len(node.Links[layer])+len(removed.Links[layer]))
+			seen := map[int32]bool{from: true, idx: true}
+			for _, links := range [][]int32{node.Links[layer], removed.Links[layer]} {
+				for _, link := range links {
+					if !seen[link] {
+						seen[link] = true
+						merged = append(merged, link)
+					}
+				}
+			}
+			h.setLinks(from, layer, h.selectNeighbors(h.candidatesFor(node.Vector, merged), h.maxLinks(layer)))
+		}
+	}
+	h.nodes[idx] = nil
+	h.free = append(h.free, idx)
+
+	if h.entry == idx {
+		// A neighbor on the top layer is just as high; only scan for the
+		// highest node when the removed one was alone up there
+		if top := removed.Links[len(removed.Links)-1]; len(top) > 0 {
+			h.entry = top[0]
+			return
+		}
+		h.entry = -1
+		h.maxLevel = 0
+		for i, node := range h.nodes {
+			if node != nil && (h.entry == -1 || len(node.Links)-1 > h.maxLevel) {
+				h.entry = int32(i)
+				h.maxLevel = len(node.Links) - 1
+			}
+		}
+	}
+}
+
+// IDs implements Index
+func (h *HNSW) IDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := make([]string, 0, len(h.ids))
+	for id := range h.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// hnswSnapshot is the serialized form of an HNSW index, with removed
+// nodes compacted away
+type hnswSnapshot struct {
+	Config   HNSWConfig
+	Nodes    []hnswNode
+	Entry    int32
+	MaxLevel int
+}
+
+// Save writes a snapshot of the index to w
+func (h *HNSW) Save(w io.Writer) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	remap := make(map[int32]int32, len(h.ids))
+	snap := hnswSnapshot{Config: h.cfg, Entry: -1, MaxLevel: h.maxLevel}
+	for i, node := range h.nodes {
+		if node != nil {
+			remap[int32(i)] = int32(len(snap.Nodes))
+			snap.Nodes = append(snap.Nodes, hnswNode{ID: node.ID, Vector: node.Vector})
+		}
+	}
+	for i, node := range h.nodes {
+		if node == nil {
+			continue
+		}
+		links := make([][]int32, len(node.Links))
+		for layer, layerLinks := range node.Links {
+			links[layer] = make([]int32, len(layerLinks))
+			for j, link := range layerLinks {
+				links[layer][j] = remap[link]
+			}
+		}
+		snap.Nodes[remap[int32(i)]].Links = links
+	}
+	if h.entry != -1 {
+		snap.Entry = remap[h.entry]
+	}
+
+	return gob.NewEncoder(w).Encode(snap)
+}
+
+// SaveFile writes a snapshot of the index to path atomically
+func (h *HNSW) SaveFile(path string) error {
+	var buf bytes.Buffer
+	if err := h.Save(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// LoadHNSWFile restores an index saved with SaveFile
+func LoadHNSWFile(path string) (*HNSW, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadHNSW(bufio.NewReader(f))
+}
+
+// LoadHNSW restores an index written by Save
+func LoadHNSW(r io.Reader) (*HNSW, error) {
+	var snap hnswSnapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	// Anything that would make Search index out of range is rejected here
+	errCorrupt := errors.New("semcache: corrupt HNSW snapshot")
+	if len(snap.Nodes) > 0 {
+		if snap.Entry < 0 || int(snap.Entry) >= len(snap.Nodes) || len(snap.Nodes[snap.Entry].Links) != snap.MaxLevel+1 {
+			return nil, errCorrupt
+		}
+	}
+
+	h := NewHNSW(snap.Config)
+	h.rng = rand.New(rand.NewSource(snap.Config.Seed + int64(len(snap.Nodes))))
+	h.nodes = make([]*hnswNode, len(snap.Nodes))
+	for i := range snap.Nodes {
+		node := snap.Nodes[i]
+		if len(node.Links) == 0 || len(node.Vector) != len(snap.Nodes[0].Vector) {
+			return nil, errCorrupt
+		}
+		if _, ok := h.ids[node.ID]; ok {
+			return nil, errCorrupt
+		}
+		node.in = make([][]int32, len(node.Links))
+		h.nodes[i] = &node
+		h.ids[node.ID] = int32(i)
+	}
+	for i, node := range h.nodes {
+		for layer, layerLinks := range node.Links {
+			for _, link := range layerLinks {
+				// A link on a layer must point to a node that has the layer
+				if link < 0 || int(link) >= len(h.nodes) || link == int32(i) || layer >= len(h.nodes[link].Links) {
+					return nil, errCorrupt
+				}
+				h.nodes[link].in[layer] = append(h.nodes[link].in[layer], int32(i))
+			}
+		}
+	}
+	if len(h.nodes) > 0 {
+		h.entry = snap.Entry
+		h.maxLevel = snap.MaxLevel
+	}
+
+	return h, nil
+}
+
+// candidate is a node with its distance to the current query
+type candidate struct {
+	idx  int32
+	dist float32
+}
+
+// candidateHeap is a binary heap of candidates, nearest first unless
+// farthestFirst is set
+type candidateHeap struct {
+	items         []candidate
+	farthestFirst bool
+}
+
+func (h *candidateHeap) Len() int { return len(h.items) }
+func (h *candidateHeap) Less(i, j int) bool {
+	if h.farthestFirst {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h *candidateHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x any)    { h.items = append(h.items, x.(candidate)) }
+func (h *candidateHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
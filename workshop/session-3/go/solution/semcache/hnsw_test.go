@@ -0,0 +1,353 @@
+package semcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// randomVectors returns n random unit vectors with the given dimensions
+func randomVectors(n, dims int, seed int64) [][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = float32(rng.NormFloat64())
+		}
+		vectors[i] = Normalize(vector)
+	}
+	return vectors
+}
+
+// clusteredVectors returns n unit vectors spread around a number of random
+// topics, which is closer to how question embeddings are distributed than
+// uniform noise
+func clusteredVectors(n, dims, topics int, seed int64) [][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	centers := randomVectors(topics, dims, seed+1)
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		center := centers[rng.Intn(topics)]
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = center[j] + 0.6*float32(rng.NormFloat64())/float32(math.Sqrt(float64(dims)))
+		}
+		vectors[i] = Normalize(vector)
+	}
+	return vectors
+}
+
+// buildIndexes adds the same vectors to a fresh HNSW and FlatIndex
+func buildIndexes(vectors [][]float32, cfg HNSWConfig) (*HNSW, *FlatIndex) {
+	hnsw := NewHNSW(cfg)
+	flat := NewFlatIndex()
+	for i, vector := range vectors {
+		id := fmt.Sprintf("q%d", i)
+		hnsw.Add(id, vector)
+		flat.Add(id, vector)
+	}
+	return hnsw, flat
+}
+
+// recall is the fraction of exact neighbors the approximate index found
+func recall(index Index, exact *FlatIndex, queries [][]float32, k int) float64 {
+	found, total := 0, 0
+	for _, query := range queries {
+		want := make(map[string]bool, k)
+		for _, n := range exact.Search(query, k) {
+			want[n.ID] = true
+		}
+		for _, n := range index.Search(query, k) {
+			if want[n.ID] {
+				found++
+			}
+		}
+		total += len(want)
+	}
+	return float64(found) / float64(total)
+}
+
+// checkReverseLinks fails unless every link has exactly one reverse link
+// and every reverse link a link
+func checkReverseLinks(t *testing.T, h *HNSW) {
+	t.Helper()
+
+	type edge struct {
+		from, to int32
+		layer    int
+	}
+	links := make(map[edge]int)
+	for i, node := range h.nodes {
+		if node == nil {
+			continue
+		}
+		for layer := range node.Links {
+			for _, link := range node.Links[layer] {
+				if h.nodes[link] == nil {
+					t.Fatalf("node %d links to removed node %d on layer %d", i, link, layer)
+				}
+				links[edge{int32(i), link, layer}]++
+			}
+			for _, from := range node.in[layer] {
+				links[edge{from, int32(i), layer}]--
+			}
+		}
+	}
+	for e, count := range links {
+		if count != 0 {
+			t.Fatalf("link %d -> %d on layer %d has %d more links than reverse links", e.from, e.to, e.layer, count)
+		}
+	}
+}
+
+func TestHNSWRecall(t *testing.T) {
+	hnsw, flat := buildIndexes(randomVectors(2000, 64, 1), DefaultHNSWConfig())
+	queries := randomVectors(100, 64, 2)
+
+	if got := recall(hnsw, flat, queries, 10); got < 0.9 {
+		t.Errorf("recall@10 = %.3f, want >= 0.9", got)
+	}
+}
+
+func TestHNSWRemove(t *testing.T) {
+	vectors := randomVectors(500, 32, 3)
+	hnsw, flat := buildIndexes(vectors, HNSWConfig{M: 8})
+
+	for i := 0; i < len(vectors); i += 2 {
+		id := fmt.Sprintf("q%d", i)
+		hnsw.Remove(id)
+		flat.Remove(id)
+	}
+	if hnsw.Len() != flat.Len() {
+		t.Fatalf("Len = %d, want %d", hnsw.Len(), flat.Len())
+	}
+	checkReverseLinks(t, hnsw)
+
+	for i := 1; i < len(vectors); i += 2 {
+		got := hnsw.Search(vectors[i], 1)
+		if len(got) != 1 || got[0].ID != fmt.Sprintf("q%d", i) {
+			t.Fatalf("Search(q%d) = %v, want the vector itself", i, got)
+		}
+	}
+	for i := 0; i < len(vectors); i += 2 {
+		for _, n := range hnsw.Search(vectors[i], 10) {
+			if n.ID == fmt.Sprintf("q%d", i) {
+				t.Fatalf("removed vector q%d still returned", i)
+			}
+		}
+	}
+	if got := recall(hnsw, flat, randomVectors(50, 32, 4), 10); got < 0.9 {
+		t.Errorf("recall@10 after removals = %.3f, want >= 0.9", got)
+	}
+}
+
+func TestHNSWSnapshot(t *testing.T) {
+	vectors := randomVectors(300, 32, 5)
+	hnsw, _ := buildIndexes(vectors, HNSWConfig{M: 8, EfSearch: 32})
+	hnsw.Remove("q7")
+
+	path := filepath.Join(t.TempDir(), "index.hnsw")
+	if err := hnsw.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	restored, err := LoadHNSWFile(path)
+	if err != nil {
+		t.Fatalf("LoadHNSWFile: %v", err)
+	}
+
+	if restored.Len() != hnsw.Len() || restored.Config() != hnsw.Config() {
+		t.Fatalf("restored Len=%d Config=%+v, want Len=%d Config=%+v",
+			restored.Len(), restored.Config(), hnsw.Len(), hnsw.Config())
+	}
+	for _, query := range randomVectors(20, 32, 6) {
+		want, got := hnsw.Search(query, 5), restored.Search(query, 5)
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Fatalf("restored Search = %v, want %v", got, want)
+		}
+	}
+
+	checkReverseLinks(t, restored)
+
+	restored.Add("new", vectors[7])
+	if got := restored.Search(vectors[7], 1); len(got) != 1 || got[0].ID != "new" {
+		t.Errorf("Search after Add on restored index = %v, want new", got)
+	}
+	for i := 0; i < 100; i++ {
+		restored.Remove(fmt.Sprintf("q%d", i))
+	}
+	checkReverseLinks(t, restored)
+
+	if _, err := LoadHNSW(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("LoadHNSW accepted garbage")
+	}
+}
+
+func TestHNSWCorruptSnapshot(t *testing.T) {
+	vectors := randomVectors(50, 8, 8)
+	hnsw, _ := buildIndexes(vectors, HNSWConfig{M: 4})
+	var buf bytes.Buffer
+	if err := hnsw.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	tamper := map[string]func(snap *hnswSnapshot){
+		"entry out of range": func(snap *hnswSnapshot) { snap.Entry = int32(len(snap.Nodes)) },
+		"negative entry":     func(snap *hnswSnapshot) { snap.Entry = -1 },
+		"wrong max level":    func(snap *hnswSnapshot) { snap.MaxLevel++ },
+		"link out of range":  func(snap *hnswSnapshot) { snap.Nodes[3].Links[0][0] = 1000 },
+		"link to itself":     func(snap *hnswSnapshot) { snap.Nodes[3].Links[0][0] = 3 },
+		"short vector":       func(snap *hnswSnapshot) { snap.Nodes[5].Vector = snap.Nodes[5].Vector[:4] },
+		"duplicate id":       func(snap *hnswSnapshot) { snap.Nodes[5].ID = snap.Nodes[6].ID },
+		"link above target": func(snap *hnswSnapshot) {
+			top := snap.Nodes[snap.Entry].Links[snap.MaxLevel]
+			for i, node := range snap.Nodes {
+				if len(node.Links) == 1 && len(top) > 0 {
+					top[0] = int32(i)
+					return
+				}
+			}
+		},
+	}
+	for name, fn := range tamper {
+		var snap hnswSnapshot
+		if err := gob.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&snap); err != nil {
+			t.Fatalf("decoding snapshot: %v", err)
+		}
+		fn(&snap)
+
+		var tampered bytes.Buffer
+		gob.NewEncoder(&tampered).Encode(snap)
+		if _, err := LoadHNSW(&tampered); err == nil {
+			t.Errorf("%s: LoadHNSW accepted the snapshot", name)
+		}
+	}
+}
+
+// Sizes of the benchmark indexes. Building the largest takes several
+// minutes, so -short leaves it out.
+var benchmarkSizes = []int{5000, 100000}
+
+// benchmarkVectors returns n clustered 384-dimension vectors, the size of
+// common sentence embeddings, and 200 queries from the same distribution
+func benchmarkVectors(n int) ([][]float32, [][]float32) {
+	all := clusteredVectors(n+200, 384, 50, 7)
+	return all[:n], all[n:]
+}
+
+// builtIndexes keeps the indexes built for benchmarks, which run several
+// times with growing b.N, by kind and size
+var builtIndexes sync.Map
+
+// flatForBenchmark builds, once, an exact index of the vectors
+func flatForBenchmark(vectors [][]float32) *FlatIndex {
+	key := fmt.Sprintf("flat/%d", len(vectors))
+	if index, ok := builtIndexes.Load(key); ok {
+		return index.(*FlatIndex)
+	}
+	flat := NewFlatIndex()
+	for i, vector := range vectors {
+		flat.Add(fmt.Sprintf("q%d", i), vector)
+	}
+	builtIndexes.Store(key, flat)
+	return flat
+}
+
+// hnswForBenchmark builds, once, an HNSW index of the vectors
+func hnswForBenchmark(vectors [][]float32) *HNSW {
+	key := fmt.Sprintf("hnsw/%d", len(vectors))
+	if index, ok := builtIndexes.Load(key); ok {
+		return index.(*HNSW)
+	}
+	hnsw, _ := buildIndexes(vectors, DefaultHNSWConfig())
+	builtIndexes.Store(key, hnsw)
+	return hnsw
+}
+
+// forEachSize runs a benchmark on every benchmark size
+func forEachSize(b *testing.B, fn func(b *testing.B, vectors, queries [][]float32)) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			if testing.Short() && n > benchmarkSizes[0] {
+				b.Skip("skipping the large index in short mode")
+			}
+			vectors, queries := benchmarkVectors(n)
+			fn(b, vectors, queries)
+		})
+	}
+}
+
+// benchmarkSearch measures search latency and reports recall@10
+func benchmarkSearch(b *testing.B, index Index, vectors, queries [][]float32) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Search(queries[i%len(queries)], 10)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(recall(index, flatForBenchmark(vectors), queries, 10), "recall@10")
+}
+
+func BenchmarkFlatSearch(b *testing.B) {
+	forEachSize(b, func(b *testing.B, vectors, queries [][]float32) {
+		benchmarkSearch(b, flatForBenchmark(vectors), vectors, queries)
+	})
+}
+
+func BenchmarkHNSWSearch(b *testing.B) {
+	forEachSize(b, func(b *testing.B, vectors, queries [][]float32) {
+		// ef only applies to searches, so every value shares one graph
+		hnsw := hnswForBenchmark(vectors)
+		for _, ef := range []int{16, 64, 256} {
+			b.Run(fmt.Sprintf("ef=%d", ef), func(b *testing.B) {
+				hnsw.SetEfSearch(ef)
+				benchmarkSearch(b, hnsw, vectors, queries)
+			})
+		}
+	})
+}
+
+// BenchmarkHNSWLoad measures a restart, which restores the graph from its
+// snapshot instead of rebuilding it
+func BenchmarkHNSWLoad(b *testing.B) {
+	forEachSize(b, func(b *testing.B, vectors, queries [][]float32) {
+		var buf bytes.Buffer
+		if err := hnswForBenchmark(vectors).Save(&buf); err != nil {
+			b.Fatalf("Save: %v", err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := LoadHNSW(bytes.NewReader(buf.Bytes())); err != nil {
+				b.Fatalf("LoadHNSW: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkHNSWRemove measures deleting entries one by one
+func BenchmarkHNSWRemove(b *testing.B) {
+	forEachSize(b, func(b *testing.B, vectors, queries [][]float32) {
+		var buf bytes.Buffer
+		if err := hnswForBenchmark(vectors).Save(&buf); err != nil {
+			b.Fatalf("Save: %v", err)
+		}
+
+		var hnsw *HNSW
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// Start over from a full graph once every entry is gone
+			if i%len(vectors) == 0 {
+				b.StopTimer()
+				hnsw, _ = LoadHNSW(bytes.NewReader(buf.Bytes()))
+				b.StartTimer()
+			}
+			hnsw.Remove(fmt.Sprintf("q%d", i%len(vectors)))
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package semcache
+
+import (
+	"sort"
+	"sync"
+)
+
+// Neighbor is a search result of an Index
+type Neighbor struct {
+	ID         string
+	Similarity float64
+}
+
+// Index finds the stored vectors most similar to a query. Vectors are
+// expected to be unit length, so similarity is their dot product.
+type Index interface {
+	// Add stores a vector under id, replacing any previous vector with that id
+	Add(id string, vector []float32)
+	// Remove deletes the vector stored under id, if any
+	Remove(id string)
+	// Search returns up to k neighbors of query, most similar first
+	Search(query []float32, k int) []Neighbor
+	// Clear removes every vector
+	Clear()
+	// Len returns the number of stored vectors
+	Len() int
+	// IDs returns the IDs of all stored vectors
+	IDs() []string
+}
+
+// FlatIndex is an exact index that compares the query with every vector.
+// It is the reference the approximate HNSW index is measured against.
+type FlatIndex struct {
+	mu      sync.RWMutex
+	vectors map[string][]float32
+}
+
+// NewFlatIndex creates an empty exact index
+func NewFlatIndex() *FlatIndex {
+	return &FlatIndex{vectors: make(map[string][]float32)}
+}
+
+// Add implements Index
+func (f *FlatIndex) Add(id string, vector []float32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.vectors[id] = vector
+}
+
+// Remove implements Index
+func (f *FlatIndex) Remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.vectors, id)
+}
+
+// Search implements Index
+func (f *FlatIndex) Search(query []float32, k int) []Neighbor {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	neighbors := make([]Neighbor, 0, len(f.vectors))
+	for id, vector := range f.vectors {
+		neighbors = append(neighbors, Neighbor{ID: id, Similarity: Cosine(query, vector)})
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Similarity != neighbors[j].Similarity {
+			return neighbors[i].Similarity > neighbors[j].Similarity
+		}
+		return neighbors[i].ID < neighbors[j].ID
+	})
+
+	if k > 0 && len(neighbors) > k {
+		neighbors = neighbors[:k]
+	}
+	return neighbors
+}
+
+// Clear implements Index
+func (f *FlatIndex) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.vectors = make(map[string][]float32)
+}
+
+// Len implements Index
+func (f *FlatIndex) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.vectors)
+}
+
+// IDs implements Index
+func (f *FlatIndex) IDs() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	ids := make([]string, 0, len(f.vectors))
+	for id := range f.vectors {
+		ids = append(ids, id)
+	}
+	return ids
+}
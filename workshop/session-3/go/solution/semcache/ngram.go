@@ -0,0 +1,171 @@
+package semcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DefaultNGramDimensions is the vector size used by NewNGramEmbedder
+const DefaultNGramDimensions = 2048
+
+// NGramEmbedder is a dependency-free embedder based on hashed character
+// n-grams weighted by TF-IDF. Every word contributes its character 3- to
+// 5-grams and the word itself; features are hashed into a fixed number of
+// signed buckets. Before Fit is called all features have an IDF of 1.
+//
+// It captures spelling overlap rather than meaning, so paraphrases with
+// different words score lower than with a real embedding model, but it is
+// fast, deterministic and works fully offline.
+type NGramEmbedder struct {
+	dimensions int
+
+	mu  sync.RWMutex
+	idf []float64 // Per-bucket inverse document frequency, nil until fitted
+}
+
+// NewNGramEmbedder creates an n-gram embedder producing vectors of the given
+// size (DefaultNGramDimensions if dimensions <= 0)
+func NewNGramEmbedder(dimensions int) *NGramEmbedder {
+	if dimensions <= 0 {
+		dimensions = DefaultNGramDimensions
+	}
+	return &NGramEmbedder{dimensions: dimensions}
+}
+
+// Name implements Embedder
+func (e *NGramEmbedder) Name() string {
+	return fmt.Sprintf("ngram-signed-tfidf-%d", e.dimensions)
+}
+
+// Fit computes inverse document frequencies from the corpus, so n-grams
+// shared by most questions (such as "what is the") weigh less than
+// distinctive ones
+func (e *NGramEmbedder) Fit(corpus []string) {
+	df := make([]float64, e.dimensions)
+	for _, text := range corpus {
+		seen := make(map[int]bool)
+		for _, feature := range ngramFeatures(text) {
+			bucket, _ := e.bucket(feature)
+			if !seen[bucket] {
+				seen[bucket] = true
+				df[bucket]++
+			}
+		}
+	}
+
+	n := float64(len(corpus))
+	idf := make([]float64, e.dimensions)
+	for i := range idf {
+		// Smoothed IDF, as in scikit-learn
+		idf[i] = math.Log((1+n)/(1+df[i])) + 1
+	}
+
+	e.mu.Lock()
+	e.idf = idf
+	e.mu.Unlock()
+}
+
+// FitState implements Fitter
+func (e *NGramEmbedder) FitState() ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.idf == nil {
+		return nil, nil
+	}
+	return json.Marshal(e.idf)
+}
+
+// SetFitState implements Fitter
+func (e *NGramEmbedder) SetFitState(state []byte) error {
+	var idf []float64
+	if err := json.Unmarshal(state, &idf); err != nil {
+		return err
+	}
+	if len(idf) != e.dimensions {
+		return fmt.Errorf("fitted weights have %d dimensions, want %d", len(idf), e.dimensions)
+	}
+
+	e.mu.Lock()
+	e.idf = idf
+	e.mu.Unlock()
+	return nil
+}
+
+// Embed implements Embedder
+func (e *NGramEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.mu.RLock()
+	idf := e.idf
+	e.mu.RUnlock()
+
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Features sharing a bucket add up with their own signs, so
+		// colliding features tend to cancel out rather than pile up
+		tf := make(map[int]float64)
+		for _, feature := range ngramFeatures(text) {
+			bucket, sign := e.bucket(feature)
+			tf[bucket] += sign
+		}
+
+		vector := make([]float32, e.dimensions)
+		for bucket, count := range tf {
+			if count == 0 {
+				continue
+			}
+			// Sublinear term frequency keeps repeated words from dominating
+			weight := 1 + math.Log(math.Abs(count))
+			if idf != nil {
+				weight *= idf[bucket]
+			}
+			vector[bucket] = float32(math.Copysign(weight, count))
+		}
+		vectors[i] = Normalize(vector)
+	}
+
+	return vectors, nil
+}
+
+// bucket hashes a feature to a bucket and a sign, which keeps hash
+// collisions from systematically inflating similarity
+func (e *NGramEmbedder) bucket(feature string) (int, float64) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+	sign := 1.0
+	if sum>>63 == 1 {
+		sign = -1
+	}
+	return int(sum % uint64(e.dimensions)), sign
+}
+
+// ngramFeatures lowercases text, splits it into words and returns each
+// word plus its padded character 3-, 4- and 5-grams
+func ngramFeatures(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var features []string
+	for _, word := range words {
+		features = append(features, "w:"+word)
+
+		padded := []rune(" " + word + " ")
+		for n := 3; n <= 5; n++ {
+			for i := 0; i+n <= len(padded); i++ {
+				features = append(features, "c:"+string(padded[i:i+n]))
+			}
+		}
+	}
+	return features
+}
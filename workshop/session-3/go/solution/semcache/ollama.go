@@ -0,0 +1,238 @@
+package semcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by NewOllamaEmbedder
+const (
+	DefaultOllamaURL            = "http://localhost:11434"
+	DefaultOllamaEmbeddingModel = "nomic-embed-text"
+	DefaultOllamaBatchSize      = 32
+	DefaultOllamaCacheSize      = 10000
+	DefaultOllamaTimeout        = 30 * time.Second
+)
+
+// OllamaEmbedder embeds texts with an Ollama embedding model through the
+// /api/embed endpoint. Texts are sent in batches, and embeddings are cached
+// in memory by normalized text so repeated questions are not re-embedded.
+// It is safe for concurrent use.
+type OllamaEmbedder struct {
+	baseURL    string
+	model      string
+	batchSize  int
+	cacheSize  int
+	timeout    time.Duration
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	cache map[string][]float32
+	order []string // Insertion order of cache keys, oldest first
+}
+
+// OllamaOption configures an OllamaEmbedder
+type OllamaOption func(*OllamaEmbedder)
+
+// WithOllamaHTTPClient sets the http.Client used for all requests
+func WithOllamaHTTPClient(httpClient *http.Client) OllamaOption {
+	return func(e *OllamaEmbedder) {
+		e.httpClient = httpClient
+	}
+}
+
+// WithBatchSize sets how many texts are sent per request
+func WithBatchSize(size int) OllamaOption {
+	return func(e *OllamaEmbedder) {
+		if size > 0 {
+			e.batchSize = size
+		}
+	}
+}
+
+// WithCacheSize sets how many embeddings are kept in memory (0 disables caching)
+func WithCacheSize(size int) OllamaOption {
+	return func(e *OllamaEmbedder) {
+		if size >= 0 {
+			e.cacheSize = size
+		}
+	}
+}
+
+// WithRequestTimeout sets the timeout of each request to Ollama
+func WithRequestTimeout(timeout time.Duration) OllamaOption {
+	return func(e *OllamaEmbedder) {
+		if timeout > 0 {
+			e.timeout = timeout
+		}
+	}
+}
+
+// NewOllamaEmbedder creates an embedder for the given Ollama server and
+// embedding model (DefaultOllamaURL and DefaultOllamaEmbeddingModel if empty)
+func NewOllamaEmbedder(baseURL, model string, opts ...OllamaOption) *OllamaEmbedder {
+	if baseURL == "" {
+		baseURL = DefaultOllamaURL
+	}
+	if model == "" {
+		model = DefaultOllamaEmbeddingModel
+	}
+
+	e := &OllamaEmbedder{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		model:      model,
+		batchSize:  DefaultOllamaBatchSize,
+		cacheSize:  DefaultOllamaCacheSize,
+		timeout:    DefaultOllamaTimeout,
+		httpClient: &http.Client{},
+		cache:      make(map[string][]float32),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// Name implements Embedder
+func (e *OllamaEmbedder) Name() string {
+	return "ollama:" + e.model
+}
+
+// ollamaEmbedRequest is the payload of POST /api/embed
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// ollamaEmbedResponse is the result of POST /api/embed
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// Embed implements Embedder
+func (e *OllamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+
+	// Serve what we can from the cache and collect the rest, once per distinct text
+	var missing []string
+	positions := make(map[string][]int)
+	for i, text := range texts {
+		key := normalizeText(text)
+		if vector, ok := e.cached(key); ok {
+			vectors[i] = vector
+			continue
+		}
+		if _, seen := positions[key]; !seen {
+			missing = append(missing, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+
+	for start := 0; start < len(missing); start += e.batchSize {
+		end := start + e.batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := missing[start:end]
+
+		embeddings, err := e.embedBatch(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, key := range batch {
+			vector := Normalize(embeddings[j])
+			e.store(key, vector)
+			for _, i := range positions[key] {
+				vectors[i] = vector
+			}
+		}
+	}
+
+	return vectors, nil
+}
+
+// embedBatch sends one /api/embed request
+func (e *OllamaEmbedder) embedBatch(ctx context.Context, batch []string) ([][]float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	jsonData, err := json.Marshal(ollamaEmbedRequest{Model: e.model, Input: batch})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+"/api/embed", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("ollama embed: timed out after %s", e.timeout)
+		}
+		return nil, fmt.Errorf("ollama embed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, fmt.Errorf("ollama embed failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var embedResp ollamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("ollama embed: timed out after %s", e.timeout)
+		}
+		return nil, fmt.Errorf("ollama embed: invalid response: %w", err)
+	}
+	if len(embedResp.Embeddings) != len(batch) {
+		return nil, fmt.Errorf("ollama embed: got %d embeddings for %d inputs", len(embedResp.Embeddings), len(batch))
+	}
+
+	return embedResp.Embeddings, nil
+}
+
+func (e *OllamaEmbedder) cached(key string) ([]float32, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vector, ok := e.cache[key]
+	return vector, ok
+}
+
+// store caches an embedding, evicting the oldest ones beyond the cache size
+func (e *OllamaEmbedder) store(key string, vector []float32) {
+	if e.cacheSize == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.cache[key]; ok {
+		return
+	}
+	e.cache[key] = vector
+	e.order = append(e.order, key)
+	for len(e.order) > e.cacheSize {
+		delete(e.cache, e.order[0])
+		e.order = e.order[1:]
+	}
+}
+
+// normalizeText lowercases text and collapses whitespace, so trivially
+// different spellings of a question share one embedding
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
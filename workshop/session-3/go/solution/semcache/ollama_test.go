@@ -0,0 +1,122 @@
+package semcache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStubOllama starts a server standing in for Ollama's /api/embed. Each
+// input is embedded as [len(input), 1] so results are easy to predict.
+func newStubOllama(t *testing.T, delay time.Duration) (*httptest.Server, *int32, *[][]string) {
+	t.Helper()
+
+	var requests int32
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+
+		var req ollamaEmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Model != "test-embed" {
+			http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		batches = append(batches, req.Input)
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		resp := ollamaEmbedResponse{}
+		for _, input := range req.Input {
+			resp.Embeddings = append(resp.Embeddings, []float32{float32(len(input)), 1})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests, &batches
+}
+
+func TestOllamaEmbedderBatchesRequests(t *testing.T) {
+	server, requests, batches := newStubOllama(t, 0)
+	embedder := NewOllamaEmbedder(server.URL, "test-embed", WithBatchSize(2))
+
+	texts := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(requests); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+	for _, batch := range *batches {
+		if len(batch) > 2 {
+			t.Errorf("batch of %d texts exceeds batch size 2", len(batch))
+		}
+	}
+	for i, vector := range vectors {
+		want := Normalize([]float32{float32(len(texts[i])), 1})
+		if vector[0] != want[0] || vector[1] != want[1] {
+			t.Errorf("vector %d = %v, want %v", i, vector, want)
+		}
+	}
+}
+
+func TestOllamaEmbedderCachesByNormalizedText(t *testing.T) {
+	server, requests, _ := newStubOllama(t, 0)
+	embedder := NewOllamaEmbedder(server.URL, "test-embed")
+
+	ctx := context.Background()
+	if _, err := embedder.Embed(ctx, []string{"What is Go?", "what   is go?"}); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if _, err := embedder.Embed(ctx, []string{"  WHAT IS GO?  "}); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("requests = %d, want 1 (normalized duplicates should be cached)", got)
+	}
+}
+
+func TestOllamaEmbedderTimesOut(t *testing.T) {
+	server, _, _ := newStubOllama(t, time.Second)
+	embedder := NewOllamaEmbedder(server.URL, "test-embed", WithRequestTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	_, err := embedder.Embed(context.Background(), []string{"slow question"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v, want timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Embed took %s, want it to give up after the 50ms timeout", elapsed)
+	}
+}
+
+func TestOllamaEmbedderReportsServerErrors(t *testing.T) {
+	server, _, _ := newStubOllama(t, 0)
+	embedder := NewOllamaEmbedder(server.URL, "missing-model")
+
+	_, err := embedder.Embed(context.Background(), []string{"question"})
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Fatalf("err = %v, want status 404 error", err)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Values of the X-Cache response header
+const (
+	cacheHit      = "HIT"
+	cacheSemantic = "SEMANTIC"
+	cacheMiss     = "MISS"
+	cacheBypass   = "BYPASS"
+)
+
+// proxyServer serves the AISHE API, answering from the cache tiers and
+// forwarding misses to the upstream AISHE server
+type proxyServer struct {
+	Tiered     *TieredCache
+	Audit      *AuditLog
+	Upstream   string
+	Threshold  float64
+	Attributes map[string]string
+	Metrics    *Metrics   // nil records nothing and serves no /metrics
+	Auth       *ProxyAuth // nil serves everyone without limits
+	Admission  *Admission // nil forwards every miss at once
+	AdminKey   string     // Key of the admin API; empty disables it
+
+	mu sync.RWMutex // Guards Threshold, which the admin API can change
+}
+
+// SimilarityThreshold returns the threshold semantic matches must reach
+func (p *proxyServer) SimilarityThreshold() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Threshold
+}
+
+// SetSimilarityThreshold changes the threshold for the following lookups
+func (p *proxyServer) SetSimilarityThreshold(threshold float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Threshold = threshold
+}
+
+// Handler routes the endpoints of the AISHE server, plus /metrics and the
+// admin API
+func (p *proxyServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/ask", p.instrument("/api/v1/ask", p.Auth.Wrap(http.HandlerFunc(p.handleAsk))))
+	mux.Handle("/api/v1/ask/stream", p.instrument("/api/v1/ask/stream", p.Auth.Wrap(http.HandlerFunc(p.handleAskStream))))
+	mux.Handle("/health", p.instrument("/health", http.HandlerFunc(p.handleHealth)))
+	if p.Metrics != nil {
+		mux.Handle("/metrics", p.Metrics)
+	}
+	if p.AdminKey != "" {
+		admin := &adminAPI{Proxy: p, Key: p.AdminKey}
+		mux.Handle("/admin/", p.instrument("/admin", admin.Handler()))
+	}
+	mux.Handle("/", p.instrument("/", http.HandlerFunc(p.handleRoot)))
+	return mux
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through so streamed answers reach the client
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrument counts the requests of a route and how long they take. The
+// route, not the request path, is the label so unknown paths cannot
+// create new series.
+func (p *proxyServer) instrument(route string, next http.Handler) http.Handler {
+	if p.Metrics == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.Metrics.AddInFlight(1)
+		defer p.Metrics.AddInFlight(-1)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		p.Metrics.ObserveRequest(route, recorder.status, time.Since(start))
+	})
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeDetail writes an error in the shape FastAPI uses for the AISHE server
+func writeDetail(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]string{"detail": detail})
+}
+
+func (p *proxyServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeDetail(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message":  "AISHE caching proxy",
+		"upstream": p.Upstream,
+		"cache":    semanticCacheName(),
+		"health":   "/health",
+		"metrics":  "/metrics",
+	})
+}
+
+// healthClient checks the upstream server, which must answer quickly to
+// count as healthy
+var healthClient = &http.Client{Timeout: 5 * time.Second}
+
+// handleHealth reports the upstream server's health, or 503 when it
+// cannot be reached
+func (p *proxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeDetail(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, p.Upstream+"/health", nil)
+	if err != nil {
+		writeDetail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":            "unhealthy",
+			"ollama_accessible": false,
+			"message":           fmt.Sprintf("AISHE server not reachable at %s: %v", p.Upstream, err),
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// handleAsk answers a question from the cache tiers or the upstream server.
+// A "Cache-Control: no-cache" request header skips the lookup and replaces
+// the cached answer; "no-store" bypasses the cache entirely. With
+// "only-if-cached" a miss is answered with 504 instead of asking AISHE, so
+// such requests never wait for an upstream slot.
+func (p *proxyServer) handleAsk(w http.ResponseWriter, r *http.Request) {
+	p.ask(w, r, nil)
+}
+
+// handleAskStream answers like handleAsk, but streams the answer as it
+// arrives from AISHE. Cached answers are replayed as a stream, and the
+// answer of an AISHE server that does not stream is sent in one go.
+func (p *proxyServer) handleAskStream(w http.ResponseWriter, r *http.Request) {
+	p.ask(w, r, newStreamWriter(w, r))
+}
+
+// ask answers a question, as a stream when stream is set
+func (p *proxyServer) ask(w http.ResponseWriter, r *http.Request, stream *streamWriter) {
+	if r.Method != http.MethodPost {
+		writeDetail(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	var request Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		writeDetail(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	question := strings.TrimSpace(request.Question)
+	if question == "" {
+		writeDetail(w, http.StatusUnprocessableEntity, "question must not be empty")
+		return
+	}
+
+	startTime := time.Now()
+	record := AuditEntry{
+		Timestamp: startTime,
+		Question:  question,
+		Key:       getCacheKey(question),
+		Client:    requestClient(r),
+	}
+
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	useCache := !strings.Contains(cacheControl, "no-store") && !p.Tiered.Feedback.Blocked(question, p.Attributes)
+	lookup := useCache && !strings.Contains(cacheControl, "no-cache")
+	onlyIfCached := strings.Contains(cacheControl, "only-if-cached")
+
+	if lookup {
+		cachedResponse, outcome, err := p.Tiered.Lookup(r.Context(), question, p.SimilarityThreshold(), p.Attributes)
+		record.CacheLatency = time.Since(startTime)
+		if err != nil {
+			log.Printf("cache lookup error: %v", err)
+		}
+		if cachedResponse != nil {
+			w.Header().Set("X-Cache", cacheSemantic)
+			if outcome == OutcomeExactHit {
+				w.Header().Set("X-Cache", cacheHit)
+			}
+			if cachedResponse.Similarity != nil {
+				w.Header().Set("X-Cache-Similarity", fmt.Sprintf("%.4f", *cachedResponse.Similarity))
+				record.Similarity = cachedResponse.Similarity
+			}
+			record.Outcome = outcome
+			if stream != nil {
+				stream.Replay(cachedResponse.Response.Answer)
+			}
+			p.respond(w, stream, record, startTime, cachedResponse.Response)
+			return
+		}
+	}
+
+	if onlyIfCached {
+		w.Header().Set("X-Cache", cacheMiss)
+		p.reject(w, record, startTime, http.StatusGatewayTimeout, "not in cache (only-if-cached)")
+		return
+	}
+
+	// Wait for an upstream slot, or shed the ask while AISHE is saturated
+	release, err := p.Admission.Acquire(r.Context())
+	if err != nil {
+		if r.Context().Err() != nil {
+			// The client went away while queued; there is no one to answer
+			p.reject(w, record, startTime, 0, "client went away while queued")
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(p.Admission.RetryAfter().Seconds())))
+		p.reject(w, record, startTime, http.StatusServiceUnavailable, fmt.Sprintf("AISHE is overloaded: %v", err))
+		return
+	}
+
+	// Streams start before the answer is complete, so say now where it comes from
+	if useCache {
+		w.Header().Set("X-Cache", cacheMiss)
+	} else {
+		w.Header().Set("X-Cache", cacheBypass)
+	}
+
+	apiStart := time.Now()
+	data, err := p.askUpstream(r.Context(), question, stream)
+	release()
+	record.APILatency = time.Since(apiStart)
+	p.Metrics.ObserveUpstream(record.APILatency, err)
+	if err != nil {
+		record.Outcome = OutcomeError
+		record.Error = err.Error()
+		record.TotalLatency = time.Since(startTime)
+		p.Audit.Record(record)
+		p.Auth.CountUsage(record.Client, record.Outcome)
+
+		// A stream that has begun can only end with an error event
+		if stream != nil && stream.Started() {
+			stream.Send(streamEvent{Type: eventError, Detail: err.Error()})
+			return
+		}
+
+		// Pass upstream errors through; anything else means it is unreachable
+		var upstreamErr *aisheError
+		if errors.As(err, &upstreamErr) {
+			if upstreamErr.ContentType != "" {
+				w.Header().Set("Content-Type", upstreamErr.ContentType)
+			}
+			w.WriteHeader(upstreamErr.StatusCode)
+			io.WriteString(w, upstreamErr.Body)
+			return
+		}
+		writeDetail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if useCache {
+		p.Tiered.Save(question, p.Attributes, data)
+	}
+	record.Outcome = OutcomeAPI
+	p.respond(w, stream, record, startTime, data)
+}
+
+// askUpstream asks AISHE. With a stream, the answer is relayed as it
+// arrives, or in one go when AISHE does not stream.
+func (p *proxyServer) askUpstream(ctx context.Context, question string, stream *streamWriter) (*Response, error) {
+	if stream == nil {
+		return askAISHE(ctx, p.Upstream, question)
+	}
+
+	data, err := askAISHEStream(ctx, p.Upstream, question, func(text string) {
+		stream.Send(streamEvent{Type: eventToken, Text: text})
+	})
+	if !errors.Is(err, errStreamUnsupported) {
+		return data, err
+	}
+	if data, err = askAISHE(ctx, p.Upstream, question); err != nil {
+		return nil, err
+	}
+	stream.Replay(data.Answer)
+	return data, nil
+}
+
+// reject records an ask that was not answered and writes the error, unless
+// status is 0
+func (p *proxyServer) reject(w http.ResponseWriter, record AuditEntry, startTime time.Time, status int, detail string) {
+	record.Outcome = OutcomeError
+	record.Error = detail
+	record.TotalLatency = time.Since(startTime)
+	p.Audit.Record(record)
+	p.Auth.CountUsage(record.Client, record.Outcome)
+	if status != 0 {
+		writeDetail(w, status, detail)
+	}
+}
+
+// respond writes an answer, or the final event of a streamed one, and
+// records the ask in the audit log
+func (p *proxyServer) respond(w http.ResponseWriter, stream *streamWriter, record AuditEntry, startTime time.Time, data *Response) {
+	if stream != nil {
+		stream.Done(data)
+	} else {
+		body, err := encodeCachedResponse(data)
+		if err != nil {
+			writeDetail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	}
+
+	for _, source := range data.Sources {
+		record.Sources = append(record.Sources, source.Title)
+	}
+	record.TotalLatency = time.Since(startTime)
+	p.Audit.Record(record)
+	p.Auth.CountUsage(record.Client, record.Outcome)
+}
+
+// runServe implements the "serve" command: an AISHE-compatible HTTP server
+// that answers from the cache and forwards misses to AISHE_URL
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", getEnvDefault("SERVE_ADDR", "localhost:8080"), "address to listen on")
+	scope := fs.String("scope", "", "comma-separated attributes that scope cache entries (default: CACHE_SCOPE)")
+	attrs := attributeFlag{}
+	fs.Var(attrs, "attr", "set a cache attribute as key=value (repeatable)")
+	verbose := fs.Bool("verbose", false, "log cache decisions, such as why a semantic match was rejected")
+	maxConcurrent, maxQueue, queueTimeout, err := loadAdmissionLimits()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fs.IntVar(&maxConcurrent, "max-concurrent", maxConcurrent, "asks forwarded to AISHE at once, 0 for no limit (env: PROXY_MAX_CONCURRENT)")
+	fs.IntVar(&maxQueue, "max-queue", maxQueue, "asks waiting for a slot before new ones are shed (env: PROXY_MAX_QUEUE)")
+	fs.DurationVar(&queueTimeout, "queue-timeout", queueTimeout, "how long an ask waits for a slot (env: PROXY_QUEUE_TIMEOUT)")
+	fs.Parse(args)
+
+	upstream := getAISHEURL()
+	attributes, err := loadCacheAttributes(upstream, *scope, attrs)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	threshold, err := loadSimilarityThreshold()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	tiered, audit, closeCaches := openTieredCache(*verbose)
+	defer closeCaches()
+	if tiered.Writes != nil {
+		tiered.Writes.Report = func(line string) { log.Print(line) }
+	}
+
+	// API keys from Redis, rate limit buckets and usage counters are shared
+	// by every proxy replica using the same Redis
+	rdb := newRedisClient()
+	if rdb != nil {
+		defer rdb.Close()
+	}
+	auth, err := loadProxyAuth(rdb, tiered.Metrics)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	proxy := &proxyServer{
+		Tiered:     tiered,
+		Audit:      audit,
+		Upstream:   upstream,
+		Threshold:  threshold,
+		Attributes: attributes,
+		Metrics:    tiered.Metrics,
+		Auth:       auth,
+		Admission:  NewAdmission(maxConcurrent, maxQueue, queueTimeout, tiered.Metrics),
+		AdminKey:   os.Getenv("PROXY_ADMIN_KEY"),
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           proxy.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Stop accepting requests on Ctrl+C and let the running ones finish
+	// before the deferred close flushes pending cache writes
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-stop
+		log.Print("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	log.Printf("AISHE caching proxy listening on http://%s (upstream %s, %s cache)", *addr, upstream, semanticCacheName())
+	if len(attributes) > 0 {
+		log.Printf("cache scope: %s", formatAttributes(attributes))
+	}
+	if proxy.Admission != nil {
+		log.Printf("forwarding up to %d asks at once, %d more waiting up to %s", maxConcurrent, maxQueue, queueTimeout)
+	}
+	if proxy.AdminKey != "" {
+		log.Print("admin API enabled at /admin/")
+	}
+	switch {
+	case auth == nil:
+		log.Print("authentication off: anyone who can reach the proxy can use it (set PROXY_AUTH)")
+	case auth.Limiter == nil:
+		log.Printf("API keys required (%s), no rate limit", os.Getenv("PROXY_AUTH"))
+	default:
+		log.Printf("API keys required (%s), rate limit %s per client", os.Getenv("PROXY_AUTH"), auth.Limit)
+	}
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// ListenAndServe returns as soon as Shutdown starts
+	<-done
+}
+
+// getEnvDefault returns the environment variable or a default value
+func getEnvDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Formats of a streamed answer, chosen with the Accept request header
+const (
+	streamSSE    = "text/event-stream"
+	streamNDJSON = "application/x-ndjson"
+)
+
+// Types of the events of a streamed answer
+const (
+	eventToken = "token" // The next piece of the answer text
+	eventDone  = "done"  // Sources and timing; the answer is complete
+	eventError = "error" // The answer failed midway
+)
+
+// errStreamUnsupported is returned when the server has no streaming endpoint
+var errStreamUnsupported = errors.New("server does not stream answers")
+
+// streamEvent is one event of a streamed answer. Over SSE the type is
+// also the event name; over NDJSON each event is one line.
+type streamEvent struct {
+	Type           string   `json:"type"`
+	Text           string   `json:"text,omitempty"`
+	Sources        []Source `json:"sources,omitempty"`
+	ProcessingTime *float64 `json:"processing_time,omitempty"`
+	Detail         string   `json:"detail,omitempty"`
+}
+
+// readStream calls fn for each event of a stream in the given format
+func readStream(body io.Reader, format string, fn func(streamEvent) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	decode := func(name string, data []byte) error {
+		var event streamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("invalid stream event %q: %w", data, err)
+		}
+		if event.Type == "" {
+			event.Type = name
+		}
+		return fn(event)
+	}
+
+	if format == streamNDJSON {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if err := decode("", line); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	// Server-Sent Events: fields until a blank line, which dispatches the event
+	var name string
+	var data [][]byte
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			if len(data) > 0 {
+				if err := decode(name, bytes.Join(data, []byte("\n"))); err != nil {
+					return err
+				}
+			}
+			name, data = "", nil
+			continue
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			name = string(value)
+		case "data":
+			data = append(data, append([]byte(nil), value...))
+		}
+	}
+	return scanner.Err()
+}
+
+// aisheStreamClient is shared by all streamed asks so connections to AISHE
+// are reused. It waits as long as askAISHE for the answer to start, but not
+// for it to end: askAISHEStream only gives up on an answer that stalls for
+// streamIdleTimeout.
+var aisheStreamClient = newStreamClient()
+
+// streamIdleTimeout is how long a streamed answer may go without data once
+// it has begun
+var streamIdleTimeout = 60 * time.Second
+
+// errStreamIdle is returned when a streamed answer stalls
+var errStreamIdle = errors.New("stream stalled")
+
+// idleReader restarts the idle timer whenever data arrives
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(streamIdleTimeout)
+	}
+	return n, err
+}
+
+func newStreamClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = aisheClient.Timeout
+	return &http.Client{Transport: transport}
+}
+
+// askAISHEStream asks the streaming endpoint of the AISHE API and calls
+// onToken with each piece of the answer as it arrives. It returns
+// errStreamUnsupported when the server has no streaming endpoint; a server
+// answering with plain JSON instead is accepted as a single piece.
+func askAISHEStream(ctx context.Context, aisheURL, question string, onToken func(string)) (*Response, error) {
+	url := aisheURL + "/api/v1/ask/stream"
+
+	jsonData, err := json.Marshal(Request{Question: question})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", streamSSE+", "+streamNDJSON+";q=0.9, application/json;q=0.5")
+
+	resp, err := aisheStreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to AISHE server at %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errStreamUnsupported
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &aisheError{StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Body: string(body)}
+	}
+
+	// The answer has begun: from now on only a stall abandons it
+	idle := time.AfterFunc(streamIdleTimeout, func() { cancel(errStreamIdle) })
+	defer idle.Stop()
+	body := idleReader{r: resp.Body, timer: idle}
+	stalled := func(err error) error {
+		if errors.Is(context.Cause(ctx), errStreamIdle) {
+			return fmt.Errorf("%w: no data from %s for %s", errStreamIdle, url, streamIdleTimeout)
+		}
+		return err
+	}
+
+	format, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch format {
+	case streamSSE, streamNDJSON:
+	case "application/json":
+		data := &Response{}
+		if err := json.NewDecoder(body).Decode(data); err != nil {
+			return nil, stalled(fmt.Errorf("error parsing response: %w", err))
+		}
+		onToken(data.Answer)
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unexpected content type %q from %s", format, url)
+	}
+
+	var answer strings.Builder
+	var data *Response
+	err = readStream(body, format, func(event streamEvent) error {
+		if data != nil {
+			return nil // Ignore anything after the answer is complete
+		}
+		switch event.Type {
+		case eventToken:
+			answer.WriteString(event.Text)
+			onToken(event.Text)
+		case eventDone:
+			data = &Response{Answer: answer.String(), Sources: event.Sources}
+			if event.ProcessingTime != nil {
+				data.ProcessingTime = *event.ProcessingTime
+			}
+		case eventError:
+			return fmt.Errorf("server failed while streaming: %s", event.Detail)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, stalled(err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("stream from %s ended before the answer was complete", url)
+	}
+	return data, nil
+}
+
+// streamWriter writes a streamed answer as Server-Sent Events, or as
+// NDJSON when the client prefers it
+type streamWriter struct {
+	w       http.ResponseWriter
+	format  string
+	started bool
+}
+
+// newStreamWriter picks the format the request accepts
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	format := streamSSE
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, streamNDJSON) && !strings.Contains(accept, streamSSE) {
+		format = streamNDJSON
+	}
+	return &streamWriter{w: w, format: format}
+}
+
+// Started reports whether the response has begun, after which errors can
+// only be sent as events
+func (s *streamWriter) Started() bool {
+	return s.started
+}
+
+// Send writes an event and flushes it to the client
+func (s *streamWriter) Send(event streamEvent) error {
+	if !s.started {
+		s.w.Header().Set("Content-Type", s.format)
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if s.format == streamSSE {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
+}
+
+// Done sends the final event of an answer
+func (s *streamWriter) Done(data *Response) error {
+	processingTime := data.ProcessingTime
+	return s.Send(streamEvent{Type: eventDone, Sources: data.Sources, ProcessingTime: &processingTime})
+}
+
+// Replay streams a complete answer text, such as a cached one, word by
+// word. The final event is left to Done.
+func (s *streamWriter) Replay(answer string) error {
+	for _, word := range strings.SplitAfter(answer, " ") {
+		if word == "" {
+			continue
+		}
+		if err := s.Send(streamEvent{Type: eventToken, Text: word}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printAnswerHeader prints the banner above the answer
+func printAnswerHeader() {
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Println("ANSWER:")
+	fmt.Println(strings.Repeat("=", 70))
+}
+
+// askStreaming asks AISHE for a streamed answer and prints it as it
+// arrives. It falls back to askAISHE when the server does not stream. The
+// returned flag tells whether anything was printed, even when the stream
+// then failed.
+func askStreaming(aisheURL, question string) (*Response, bool, error) {
+	printed := false
+	data, err := askAISHEStream(context.Background(), aisheURL, question, func(text string) {
+		if !printed {
+			printAnswerHeader()
+			printed = true
+		}
+		fmt.Print(text)
+	})
+	if errors.Is(err, errStreamUnsupported) {
+		fmt.Print("Server does not stream answers, waiting for the full answer...\n\n")
+		data, err = askAISHE(context.Background(), aisheURL, question)
+		return data, false, err
+	}
+	if printed {
+		fmt.Println()
+	}
+	return data, printed, err
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"session3/semcache"
+)
+
+// stubAnswer is what the stub AISHE servers answer
+var stubAnswer = &Response{
+	Answer:         "Paris is the capital of France.",
+	Sources:        []Source{{Number: 1, Title: "Paris", URL: "https://en.wikipedia.org/wiki/Paris"}},
+	ProcessingTime: 2.5,
+}
+
+// newStubAISHE starts an AISHE server answering /api/v1/ask with
+// stubAnswer and /api/v1/ask/stream with stream, if set
+func newStubAISHE(t *testing.T, stream http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/ask", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stubAnswer)
+	})
+	if stream != nil {
+		mux.HandleFunc("/api/v1/ask/stream", stream)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// streamStub streams the given events in the format the request accepts
+func streamStub(events ...streamEvent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := newStreamWriter(w, r)
+		for _, event := range events {
+			stream.Send(event)
+		}
+	}
+}
+
+// stubEvents streams stubAnswer in three pieces
+func stubEvents() []streamEvent {
+	processingTime := stubAnswer.ProcessingTime
+	return []streamEvent{
+		{Type: eventToken, Text: "Paris is "},
+		{Type: eventToken, Text: "the capital "},
+		{Type: eventToken, Text: "of France."},
+		{Type: eventDone, Sources: stubAnswer.Sources, ProcessingTime: &processingTime},
+	}
+}
+
+func TestAskAISHEStream(t *testing.T) {
+	server := newStubAISHE(t, streamStub(stubEvents()...))
+
+	var tokens []string
+	got, err := askAISHEStream(context.Background(), server.URL, "What is the capital of France?", func(text string) {
+		tokens = append(tokens, text)
+	})
+	if err != nil {
+		t.Fatalf("askAISHEStream: %v", err)
+	}
+	if want := []string{"Paris is ", "the capital ", "of France."}; strings.Join(tokens, "|") != strings.Join(want, "|") {
+		t.Errorf("tokens = %q, want %q", tokens, want)
+	}
+	if !sameResponse(got, stubAnswer) {
+		t.Errorf("response = %+v, want %+v", got, stubAnswer)
+	}
+}
+
+func TestReadStreamFormats(t *testing.T) {
+	for _, format := range []string{streamSSE, streamNDJSON} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/ask/stream", nil)
+		request.Header.Set("Accept", format)
+		streamStub(stubEvents()...)(recorder, request)
+
+		if got := recorder.Header().Get("Content-Type"); got != format {
+			t.Errorf("%s: Content-Type = %q", format, got)
+		}
+		var types []string
+		err := readStream(recorder.Body, format, func(event streamEvent) error {
+			types = append(types, event.Type)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: readStream: %v", format, err)
+		}
+		if got := strings.Join(types, ","); got != "token,token,token,done" {
+			t.Errorf("%s: events = %s", format, got)
+		}
+	}
+}
+
+func TestReadStreamSSEFields(t *testing.T) {
+	// Comments, unknown fields and data split over several lines
+	body := ": keep-alive\n\nevent: token\nid: 1\ndata: {\"text\":\ndata: \"Hi\"}\n\nevent: done\ndata: {}\n\n"
+	var events []streamEvent
+	err := readStream(strings.NewReader(body), streamSSE, func(event streamEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != eventToken || events[0].Text != "Hi" || events[1].Type != eventDone {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestAskAISHEStreamUnsupported(t *testing.T) {
+	server := newStubAISHE(t, nil)
+
+	_, err := askAISHEStream(context.Background(), server.URL, "What is the capital of France?", func(string) {})
+	if !errors.Is(err, errStreamUnsupported) {
+		t.Fatalf("err = %v, want errStreamUnsupported", err)
+	}
+
+	// The client falls back to the plain endpoint
+	got, streamed, err := askStreaming(server.URL, "What is the capital of France?")
+	if err != nil {
+		t.Fatalf("askStreaming: %v", err)
+	}
+	if streamed || !sameResponse(got, stubAnswer) {
+		t.Errorf("askStreaming = %+v, streamed %v; want %+v, not streamed", got, streamed, stubAnswer)
+	}
+}
+
+func TestAskAISHEStreamPlainJSON(t *testing.T) {
+	// A server that ignores Accept and answers the stream endpoint with JSON
+	server := newStubAISHE(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stubAnswer)
+	})
+
+	var tokens []string
+	got, err := askAISHEStream(context.Background(), server.URL, "What is the capital of France?", func(text string) {
+		tokens = append(tokens, text)
+	})
+	if err != nil {
+		t.Fatalf("askAISHEStream: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0] != stubAnswer.Answer || !sameResponse(got, stubAnswer) {
+		t.Errorf("tokens = %q, response = %+v", tokens, got)
+	}
+}
+
+func TestAskAISHEStreamFailures(t *testing.T) {
+	events := stubEvents()
+	tests := []struct {
+		name   string
+		stream http.HandlerFunc
+		want   string
+	}{
+		{"error event", streamStub(events[0], streamEvent{Type: eventError, Detail: "ollama crashed"}), "ollama crashed"},
+		{"no done event", streamStub(events[:3]...), "ended before the answer was complete"},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			writeDetail(w, http.StatusInternalServerError, "boom")
+		}, "status 500"},
+	}
+
+	for _, tt := range tests {
+		server := newStubAISHE(t, tt.stream)
+		_, err := askAISHEStream(context.Background(), server.URL, "What is the capital of France?", func(string) {})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAskAISHEStreamStalled(t *testing.T) {
+	defer func(timeout time.Duration) { streamIdleTimeout = timeout }(streamIdleTimeout)
+	streamIdleTimeout = 50 * time.Millisecond
+
+	// The server sends a token, then hangs until the client gives up
+	server := newStubAISHE(t, func(w http.ResponseWriter, r *http.Request) {
+		stream := newStreamWriter(w, r)
+		stream.Send(stubEvents()[0])
+		<-r.Context().Done()
+	})
+	var tokens []string
+	_, err := askAISHEStream(context.Background(), server.URL, "What is the capital of France?", func(text string) {
+		tokens = append(tokens, text)
+	})
+	if !errors.Is(err, errStreamIdle) || len(tokens) != 1 {
+		t.Errorf("askAISHEStream = %v after %q, want errStreamIdle after the first token", err, tokens)
+	}
+}
+
+// newTestProxyServer creates a proxy in front of upstream, caching in a
+// local semantic cache in a temporary directory
+func newTestProxyServer(t *testing.T, upstream string) *proxyServer {
+	t.Helper()
+
+	cache, err := semcache.Open(context.Background(), filepath.Join(t.TempDir(), "cache.json"), semcache.NewNGramEmbedder(0))
+	if err != nil {
+		t.Fatalf("opening cache: %v", err)
+	}
+	return &proxyServer{
+		Tiered:    &TieredCache{Semantic: cache},
+		Upstream:  upstream,
+		Threshold: 0.8,
+	}
+}
+
+// newTestProxy starts a proxy created by newTestProxyServer
+func newTestProxy(t *testing.T, upstream string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(newTestProxyServer(t, upstream).Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// askProxyStream asks the proxy's stream endpoint and returns the answer
+// and the X-Cache header
+func askProxyStream(t *testing.T, proxyURL, accept string) (string, string) {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodPost, proxyURL+"/api/v1/ask/stream",
+		strings.NewReader(`{"question": "What is the capital of France?"}`))
+	request.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("asking proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxy answered %s", resp.Status)
+	}
+
+	var answer strings.Builder
+	done := false
+	err = readStream(resp.Body, accept, func(event streamEvent) error {
+		switch event.Type {
+		case eventToken:
+			answer.WriteString(event.Text)
+		case eventDone:
+			done = true
+		default:
+			return fmt.Errorf("unexpected event %+v", event)
+		}
+		return nil
+	})
+	if err != nil || !done {
+		t.Fatalf("reading stream: %v (done: %v)", err, done)
+	}
+	return answer.String(), resp.Header.Get("X-Cache")
+}
+
+func TestProxyStream(t *testing.T) {
+	for _, upstream := range []struct {
+		name   string
+		stream http.HandlerFunc
+	}{
+		{"streaming upstream", streamStub(stubEvents()...)},
+		{"plain upstream", nil},
+	} {
+		proxy := newTestProxy(t, newStubAISHE(t, upstream.stream).URL)
+
+		// A miss streams the answer from AISHE, then the cached answer is replayed
+		for i, want := range []string{cacheMiss, cacheSemantic} {
+			answer, xCache := askProxyStream(t, proxy.URL, []string{streamSSE, streamNDJSON}[i])
+			if answer != stubAnswer.Answer || xCache != want {
+				t.Errorf("%s, ask %d: answer %q, X-Cache %s; want %q, %s", upstream.name, i+1, answer, xCache, stubAnswer.Answer, want)
+			}
+		}
+	}
+}
+
+func TestProxyStreamUpstreamError(t *testing.T) {
+	// Errors before the stream begins keep their status
+	upstream := newStubAISHE(t, func(w http.ResponseWriter, r *http.Request) {
+		writeDetail(w, http.StatusServiceUnavailable, "ollama is down")
+	})
+	proxy := newTestProxy(t, upstream.URL)
+
+	resp, err := http.Post(proxy.URL+"/api/v1/ask/stream", "application/json",
+		strings.NewReader(`{"question": "What is the capital of France?"}`))
+	if err != nil {
+		t.Fatalf("asking proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Detail string `json:"detail"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Detail != "ollama is down" {
+		t.Errorf("proxy answered %s %q, want 503 \"ollama is down\"", resp.Status, body.Detail)
+	}
+}
+
+func TestProxyUpstreamErrorContentType(t *testing.T) {
+	// An error page from a gateway in front of AISHE keeps its content type
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream connect error", http.StatusBadGateway)
+	}))
+	t.Cleanup(upstream.Close)
+	proxy := newTestProxy(t, upstream.URL)
+
+	resp, err := http.Post(proxy.URL+"/api/v1/ask", "application/json",
+		strings.NewReader(`{"question": "What is the capital of France?"}`))
+	if err != nil {
+		t.Fatalf("asking proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusBadGateway || !strings.HasPrefix(contentType, "text/plain") || strings.TrimSpace(string(body)) != "upstream connect error" {
+		t.Errorf("proxy answered %s, %s, %q; want the upstream 502 as text/plain", resp.Status, contentType, body)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Counters kept by TierStats, besides the audit outcomes of each ask
+const (
+	statExactHit    = OutcomeExactHit
+	statSemanticHit = OutcomeSemanticHit
+	statMiss        = "miss"
+	statPromotion   = "promotion"
+	statError       = "semantic_error"
+)
+
+// ExactCache is the cheap first cache tier: answers stored under a key
+// derived from the normalized question, as in session 2
+type ExactCache struct {
+	Client *redis.Client
+	TTL    time.Duration
+
+	mu sync.RWMutex // Guards TTL, which the admin API can change at runtime
+}
+
+// NewExactCache creates an exact-match tier using EXACT_CACHE_TTL from the
+// environment (default: 24h, the session 2 expiration; 0 keeps entries forever)
+func NewExactCache(client *redis.Client) (*ExactCache, error) {
+	ttl := 24 * time.Hour
+	if ttlStr := os.Getenv("EXACT_CACHE_TTL"); ttlStr != "" {
+		parsed, err := time.ParseDuration(ttlStr)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid EXACT_CACHE_TTL %q (expected a duration like 24h)", ttlStr)
+		}
+		ttl = parsed
+	}
+	return &ExactCache{Client: client, TTL: ttl}, nil
+}
+
+// exactCacheKey returns the exact-tier key for a question. Without
+// attributes it is the session 2 key from getCacheKey; otherwise the
+// attributes are hashed into the key so differently scoped answers never mix.
+func exactCacheKey(question string, attributes map[string]string) string {
+	key := getCacheKey(question)
+	if len(attributes) == 0 {
+		return key
+	}
+	hash := sha256.Sum256([]byte(formatAttributes(attributes)))
+	return key + ":" + hex.EncodeToString(hash[:8])
+}
+
+// Get returns the cached answer for the exact question, or nil on a miss.
+// A nil cache never hits.
+func (e *ExactCache) Get(ctx context.Context, question string, attributes map[string]string) (*Response, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	cachedData, err := e.Client.Get(ctx, exactCacheKey(question, attributes)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Other clients share these keys, so decode as tolerantly as semantic entries
+	response, _, err := decodeCachedResponse(cachedData)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt entry %s: %w", exactCacheKey(question, attributes), err)
+	}
+	return response, nil
+}
+
+// currentTTL returns the expiration of entries stored now
+func (e *ExactCache) currentTTL() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.TTL
+}
+
+// SetTTL changes the expiration of entries stored from now on
+func (e *ExactCache) SetTTL(ttl time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.TTL = ttl
+}
+
+// Set stores the answer under the exact question and records the key in
+// the source index. A nil cache stores nothing.
+func (e *ExactCache) Set(ctx context.Context, index *SourceIndex, question string, attributes map[string]string, response *Response) error {
+	if e == nil {
+		return nil
+	}
+
+	jsonData, err := encodeCachedResponse(response)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := exactCacheKey(question, attributes)
+	ttl := e.currentTTL()
+	if err := e.Client.Set(ctx, cacheKey, jsonData, ttl).Err(); err != nil {
+		return err
+	}
+	return index.Add(ctx, exactMember(cacheKey), response.Sources, ttl)
+}
+
+// TierStats counts hits per cache tier in a Redis hash
+type TierStats struct {
+	Client *redis.Client
+	Key    string
+}
+
+// NewTierStats creates tier counters stored under CACHE_STATS_KEY
+// (default: aishe:cache:tiers)
+func NewTierStats(client *redis.Client) *TierStats {
+	key := os.Getenv("CACHE_STATS_KEY")
+	if key == "" {
+		key = "aishe:cache:tiers"
+	}
+	return &TierStats{Client: client, Key: key}
+}
+
+// Incr adds one to a counter. Failures are reported as warnings because
+// metrics must never break an ask. Nil stats count nothing.
+func (s *TierStats) Incr(counter string) {
+	if s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Client.HIncrBy(ctx, s.Key, counter, 1).Err(); err != nil {
+		fmt.Printf("Warning: Error updating cache stats: %v\n", err)
+	}
+}
+
+// Load returns all counters
+func (s *TierStats) Load(ctx context.Context) (map[string]int64, error) {
+	values, err := s.Client.HGetAll(ctx, s.Key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int64, len(values))
+	for name, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter %s=%q", name, value)
+		}
+		counters[name] = n
+	}
+	return counters, nil
+}
+
+// TieredCache answers from the exact tier first, then the semantic tier
+type TieredCache struct {
+	Exact    *ExactCache // nil when Redis is unavailable
+	Semantic SemanticCache
+	Index    *SourceIndex
+	Stats    *TierStats
+	Guard    *HitGuard    // nil serves semantic matches unverified
+	Feedback *FeedbackLog // nil ignores flags
+	Writes   *WriteBack   // nil writes synchronously
+	Metrics  *Metrics     // nil records nothing
+
+	mu          sync.RWMutex
+	semanticTTL time.Duration // 0 keeps the backend's default
+}
+
+// SemanticTTL returns the expiration of semantic entries saved now, or 0
+// for the backend's default
+func (t *TieredCache) SemanticTTL() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.semanticTTL
+}
+
+// SetSemanticTTL changes the expiration of semantic entries saved from now on
+func (t *TieredCache) SetSemanticTTL(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.semanticTTL = ttl
+}
+
+// openTieredCache sets up the semantic cache (LangCache unless
+// CACHE_BACKEND says otherwise) and, when Redis is reachable, the audit log,
+// the exact-match tier, its stats, the feedback log and the source index
+// used by the invalidate command. The returned function flushes pending
+// writes, exports the metrics to METRICS_TEXTFILE when it is set and
+// closes everything. Configuration errors exit.
+func openTieredCache(verbose bool) (*TieredCache, *AuditLog, func()) {
+	semanticCache := loadSemanticCache()
+	tiered := &TieredCache{Semantic: semanticCache, Metrics: NewMetrics()}
+
+	var audit *AuditLog
+	rdb := newRedisClient()
+	if rdb != nil {
+		tiered.Index = NewSourceIndex(rdb)
+		tiered.Stats = NewTierStats(rdb)
+		tiered.Feedback = NewFeedbackLog(rdb)
+		var err error
+		if audit, err = NewAuditLog(rdb); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		tiered.Exact, err = NewExactCache(rdb)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	tiered.Guard = NewHitGuard(tiered.Stats, verbose)
+
+	var err error
+	tiered.Writes, err = NewWriteBack(tiered.Stats)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	return tiered, audit, func() {
+		tiered.Writes.Close()
+		if path := os.Getenv("METRICS_TEXTFILE"); path != "" {
+			if err := tiered.Metrics.WriteTextfile(path); err != nil {
+				fmt.Printf("Warning: Error writing metrics to %s: %v\n", path, err)
+			}
+		}
+		closeSemanticCache(semanticCache)
+		if rdb != nil {
+			rdb.Close()
+		}
+	}
+}
+
+// Candidates returns up to k semantic matches that pass the guard and
+// have not been flagged too often, most similar first
+func (t *TieredCache) Candidates(ctx context.Context, question string, threshold float64, attributes map[string]string, k int) ([]*CachedResponse, error) {
+	candidates, err := searchCache(ctx, t.Semantic, question, threshold, attributes, k)
+	if err != nil {
+		return nil, err
+	}
+	candidates = t.Feedback.Filter(candidates, attributes)
+	return t.Guard.Filter(question, candidates), nil
+}
+
+// Lookup checks the exact tier, then the semantic tier. A semantic hit is
+// promoted into the exact tier under the new phrasing so the next
+// identical question skips the similarity search. The returned outcome is
+// OutcomeExactHit, OutcomeSemanticHit or "" on a miss.
+func (t *TieredCache) Lookup(ctx context.Context, question string, threshold float64, attributes map[string]string) (*CachedResponse, string, error) {
+	exactStart := time.Now()
+	response, err := t.Exact.Get(ctx, question, attributes)
+	if t.Exact != nil {
+		t.Metrics.ObserveLookup("exact", "redis", response != nil, err, time.Since(exactStart))
+	}
+	if err != nil {
+		fmt.Printf("⚠ Exact cache lookup error: %v\n", err)
+	}
+	if response != nil {
+		t.Stats.Incr(statExactHit)
+		return &CachedResponse{Response: response, Prompt: question}, OutcomeExactHit, nil
+	}
+
+	// Look a little further than the best match in case it gets rejected
+	k := 1
+	if t.Guard != nil || t.Feedback != nil {
+		k = guardCandidates
+	}
+	semanticStart := time.Now()
+	candidates, err := t.Candidates(ctx, question, threshold, attributes, k)
+	t.Metrics.ObserveLookup("semantic", semanticBackendLabel(), len(candidates) > 0, err, time.Since(semanticStart))
+	if err != nil {
+		t.Stats.Incr(statError)
+		return nil, "", err
+	}
+	if len(candidates) == 0 {
+		t.Stats.Incr(statMiss)
+		return nil, "", nil
+	}
+	cachedResponse := candidates[0]
+
+	t.Stats.Incr(statSemanticHit)
+	t.Metrics.ObserveSimilarity(semanticBackendLabel(), cachedResponse.Similarity)
+	t.Promote(question, attributes, cachedResponse)
+	return cachedResponse, OutcomeSemanticHit, nil
+}
+
+// Promote queues a copy of a semantic hit into the exact tier under the
+// question as asked. The copy is recorded against the semantic entry so
+// DeleteEntry removes it with the entry.
+func (t *TieredCache) Promote(question string, attributes map[string]string, hit *CachedResponse) {
+	if t.Exact == nil {
+		return
+	}
+	t.Writes.Enqueue(cacheWrite{
+		Run: func(ctx context.Context) error {
+			err := t.Exact.Set(ctx, t.Index, question, attributes, hit.Response)
+			if err == nil {
+				err = t.Index.AddCopy(ctx, hit.EntryID, exactCacheKey(question, attributes), t.Exact.currentTTL())
+			}
+			if err != nil {
+				t.Metrics.BackendError("redis", "promote", err)
+				return err
+			}
+			t.Stats.Incr(statPromotion)
+			return nil
+		},
+		Fail: "promoting answer to exact cache",
+	})
+}
+
+// Save queues writing a fresh answer through to both tiers
+func (t *TieredCache) Save(question string, attributes map[string]string, response *Response) {
+	ttl := t.SemanticTTL()
+	t.Writes.Enqueue(cacheWrite{
+		Run: func(ctx context.Context) error {
+			err := saveToCache(ctx, t.Semantic, t.Index, question, response, attributes, ttl)
+			t.Metrics.BackendError(semanticBackendLabel(), "save", err)
+			return err
+		},
+		Done: "✓ Response saved to semantic cache",
+		Fail: "saving to semantic cache",
+	})
+	if t.Exact == nil {
+		return
+	}
+	t.Writes.Enqueue(cacheWrite{
+		Run: func(ctx context.Context) error {
+			err := t.Exact.Set(ctx, t.Index, question, attributes, response)
+			t.Metrics.BackendError("redis", "save", err)
+			return err
+		},
+		Done: "✓ Response saved to exact cache",
+		Fail: "saving to exact cache",
+	})
+}
+
+// DeleteExact deletes exact-match entries by cache key and drops them from
+// the source index. It returns how many entries existed.
+func (t *TieredCache) DeleteExact(ctx context.Context, keys ...string) (int, error) {
+	if t.Exact == nil || len(keys) == 0 {
+		return 0, nil
+	}
+
+	deleted, err := t.Exact.Client.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	members := make([]string, len(keys))
+	for i, key := range keys {
+		members[i] = exactMember(key)
+	}
+	return int(deleted), t.Index.Forget(ctx, members...)
+}
+
+// DeleteEntry deletes a semantic entry together with the exact-tier copies
+// of its answer: the one saved under its stored question and those
+// promoted under other phrasings. The former may hold a newer answer saved
+// for the same question, which only costs a miss. Everything deleted is
+// dropped from the source index. It returns how many exact copies existed.
+func (t *TieredCache) DeleteEntry(ctx context.Context, entryID string) (int, error) {
+	copies, err := t.Index.Copies(ctx, entryID)
+	if err != nil {
+		return 0, err
+	}
+	entry, err := t.Semantic.Get(ctx, entryID)
+	if err == nil {
+		copies = append(copies, exactCacheKey(entry.Prompt, entryAttributes(*entry)))
+	} else if !isNotFound(err) {
+		return 0, err
+	}
+
+	if err := deleteFromCache(ctx, t.Semantic, entryID); err != nil {
+		return 0, err
+	}
+	if err := t.Index.Forget(ctx, semanticMember(entryID)); err != nil {
+		return 0, err
+	}
+	return t.DeleteExact(ctx, copies...)
+}
+
+// DeleteByAttributes deletes the semantic entries carrying all of the
+// attributes, like DeleteEntry, and returns how many were removed. LangCache
+// cannot list its entries, so they are deleted in one call and stay in the
+// source index until invalidate finds them gone.
+func (t *TieredCache) DeleteByAttributes(ctx context.Context, attributes map[string]string) (int, error) {
+	lister, ok := t.Semantic.(entryListing)
+	if !ok {
+		return t.Semantic.DeleteByAttributes(ctx, attributes)
+	}
+	entries, err := lister.Entries(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !hasAttributes(entry.Attributes, attributes) {
+			continue
+		}
+		if _, err := t.DeleteEntry(ctx, entry.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// hasAttributes reports whether attributes include every filter attribute
+func hasAttributes(attributes, filter map[string]string) bool {
+	for name, value := range filter {
+		if attributes[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget removes the exact entry of the question and every semantic entry
+// stored for the same normalized question, with their exact copies, and
+// returns how many semantic entries were removed
+func (t *TieredCache) Forget(ctx context.Context, question string, threshold float64, attributes map[string]string) (int, error) {
+	if _, err := t.DeleteExact(ctx, exactCacheKey(question, attributes)); err != nil {
+		return 0, err
+	}
+
+	candidates, err := searchCache(ctx, t.Semantic, question, threshold, attributes, 0)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, candidate := range candidates {
+		if getCacheKey(candidate.Prompt) != getCacheKey(question) {
+			continue
+		}
+		if _, err := t.DeleteEntry(ctx, candidate.EntryID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// runStats implements the "stats" command
+func runStats(args []string) {
+	rdb := newRedisClient()
+	if rdb == nil {
+		fmt.Println("Error: Could not connect to Redis (set REDIS_ADDR)")
+		os.Exit(1)
+	}
+	defer rdb.Close()
+	stats := NewTierStats(rdb)
+
+	counters, err := stats.Load(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	exactHits, semanticHits, misses := counters[statExactHit], counters[statSemanticHit], counters[statMiss]
+	lookups := exactHits + semanticHits + misses
+	rate := func(n, of int64) string {
+		if of == 0 {
+			return "   n/a"
+		}
+		return fmt.Sprintf("%5.1f%%", 100*float64(n)/float64(of))
+	}
+
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("CACHE TIERS (%s)\n", stats.Key)
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("Lookups:           %d\n", lookups)
+	fmt.Printf("Exact hits:        %-8d %s of lookups\n", exactHits, rate(exactHits, lookups))
+	fmt.Printf("Semantic hits:     %-8d %s of lookups, %s of exact misses\n",
+		semanticHits, rate(semanticHits, lookups), rate(semanticHits, semanticHits+misses))
+	fmt.Printf("Misses (API):      %-8d %s of lookups\n", misses, rate(misses, lookups))
+	fmt.Printf("Promotions:        %d\n", counters[statPromotion])
+	fmt.Printf("Semantic errors:   %d\n", counters[statError])
+	fmt.Printf("Guard accepted:    %d\n", counters[statGuardAccepted])
+	fmt.Printf("Guard rejected:    %-8d %s of verified matches\n",
+		counters[statGuardRejected], rate(counters[statGuardRejected], counters[statGuardAccepted]+counters[statGuardRejected]))
+	fmt.Printf("Writes dropped:    %d (queue full), %d abandoned (flush deadline), %d failed\n",
+		counters[statWriteDropped], counters[statWriteAbandoned], counters[statWriteFailed])
+
+	// Show any other counters stored in the same hash
+	var others []string
+	for name := range counters {
+		switch name {
+		case statExactHit, statSemanticHit, statMiss, statPromotion, statError, statGuardAccepted, statGuardRejected,
+			statWriteDropped, statWriteAbandoned, statWriteFailed:
+		default:
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		fmt.Printf("%-18s %d\n", name+":", counters[name])
+	}
+	fmt.Println(strings.Repeat("=", 70))
+
+	// Proxy clients only show up once the proxy has authenticated someone
+	usage := &TierStats{Client: rdb, Key: getEnvDefault("PROXY_USAGE_KEY", "aishe:proxy:usage")}
+	usageCounters, err := usage.Load(context.Background())
+	if err != nil {
+		fmt.Printf("Warning: Error loading proxy usage: %v\n", err)
+		return
+	}
+	if len(usageCounters) > 0 {
+		fmt.Println()
+		printClientUsage(usage.Key, usageCounters)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDeleteEntry(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	id := testID(t)
+	url := "https://example.com/" + id
+	tiered := &TieredCache{
+		Exact:    &ExactCache{Client: rdb, TTL: time.Hour},
+		Semantic: &stubSemanticCache{prefix: id + "/"},
+		Index:    NewSourceIndex(rdb),
+	}
+	scope := map[string]string{"lang": "en"}
+	response := &Response{Answer: "Paris", Sources: []Source{{Number: 1, URL: url}}}
+
+	// Save writes both tiers under the stored question; a semantic hit for
+	// another phrasing promotes a copy under that phrasing
+	stored, asked := "What is the capital of France? "+id, "Which city is the capital of France? "+id
+	tiered.Save(stored, scope, response)
+	entries, _ := tiered.Semantic.Search(ctx, stored, 0.9, scope)
+	if len(entries) != 1 {
+		t.Fatalf("Save stored %d semantic entries, want 1", len(entries))
+	}
+	entryID := entries[0].ID
+	tiered.Promote(asked, scope, &CachedResponse{Response: response, EntryID: entryID, Prompt: stored})
+	if copies, err := tiered.Index.Copies(ctx, entryID); err != nil || len(copies) != 1 || copies[0] != exactCacheKey(asked, scope) {
+		t.Fatalf("Copies = %q, %v; want the promoted key", copies, err)
+	}
+
+	copies, err := tiered.DeleteEntry(ctx, entryID)
+	if err != nil || copies != 2 {
+		t.Fatalf("DeleteEntry = %d, %v; want both exact copies removed", copies, err)
+	}
+	for _, question := range []string{stored, asked} {
+		if hit, err := tiered.Exact.Get(ctx, question, scope); hit != nil || err != nil {
+			t.Errorf("exact copy of %q left: %v, %v", question, hit, err)
+		}
+	}
+	if _, err := tiered.Semantic.Get(ctx, entryID); !isNotFound(err) {
+		t.Errorf("semantic entry left: %v", err)
+	}
+	if members := sortedMembers(t, tiered.Index, url); len(members) != 0 {
+		t.Errorf("source index still lists %q", members)
+	}
+	if rdb.Exists(ctx, entryCopiesKey(entryID)).Val() != 0 {
+		t.Error("the list of copies outlived the entry")
+	}
+
+	// Deleting an entry that is already gone succeeds
+	if copies, err := tiered.DeleteEntry(ctx, entryID); err != nil || copies != 0 {
+		t.Errorf("second DeleteEntry = %d, %v; want 0, nil", copies, err)
+	}
+}
+
+// newTestTiered creates a tiered cache over a stub semantic tier, with
+// stats kept under a key of its own
+func newTestTiered(t *testing.T, rdb *redis.Client, semantic SemanticCache) *TieredCache {
+	t.Helper()
+	stats := &TierStats{Client: rdb, Key: "aishe:test:tiers:" + testID(t)}
+	t.Cleanup(func() { rdb.Del(context.Background(), stats.Key) })
+	return &TieredCache{
+		Exact:    &ExactCache{Client: rdb, TTL: 10 * time.Minute},
+		Semantic: semantic,
+		Index:    NewSourceIndex(rdb),
+		Stats:    stats,
+	}
+}
+
+// loadStats returns the tier counters, failing the test on errors
+func loadStats(t *testing.T, stats *TierStats) map[string]int64 {
+	t.Helper()
+	counters, err := stats.Load(context.Background())
+	if err != nil {
+		t.Fatalf("loading stats: %v", err)
+	}
+	return counters
+}
+
+func TestTieredLookup(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	id := testID(t)
+	semantic := &stubSemanticCache{prefix: id + "/"}
+	tiered := newTestTiered(t, rdb, semantic)
+	scope := map[string]string{"lang": "en"}
+	question := "What is the capital of France? " + id
+
+	// A miss in both tiers
+	hit, outcome, err := tiered.Lookup(ctx, question, 0.8, scope)
+	if hit != nil || outcome != "" || err != nil {
+		t.Fatalf("Lookup on empty tiers = %+v, %q, %v; want a miss", hit, outcome, err)
+	}
+
+	// Only the semantic tier has the answer: it is served and promoted
+	body, _ := encodeCachedResponse(&Response{Answer: "Paris"})
+	entryID, _ := semantic.Set(ctx, question, body, scope, 0)
+	t.Cleanup(func() { rdb.Del(context.Background(), exactCacheKey(question, scope), entryCopiesKey(entryID)) })
+	hit, outcome, err = tiered.Lookup(ctx, question, 0.8, scope)
+	if err != nil || outcome != OutcomeSemanticHit || hit.EntryID != entryID || hit.Response.Answer != "Paris" {
+		t.Fatalf("Lookup = %+v, %q, %v; want a semantic hit on %s", hit, outcome, err, entryID)
+	}
+	key := exactCacheKey(question, scope)
+	if ttl := rdb.PTTL(ctx, key).Val(); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("promoted copy expires in %s, want the exact tier's 10m", ttl)
+	}
+	if copies, err := tiered.Index.Copies(ctx, entryID); err != nil || len(copies) != 1 || copies[0] != key {
+		t.Errorf("Copies = %q, %v; want the promoted key", copies, err)
+	}
+
+	// The promoted copy now answers first, without a semantic search
+	searches := semantic.searches
+	hit, outcome, err = tiered.Lookup(ctx, question, 0.8, scope)
+	if err != nil || outcome != OutcomeExactHit || hit.Response.Answer != "Paris" || hit.Similarity != nil {
+		t.Errorf("Lookup after promotion = %+v, %q, %v; want an exact hit", hit, outcome, err)
+	}
+	if semantic.searches != searches {
+		t.Error("an exact hit still searched the semantic tier")
+	}
+
+	// Neither tier serves another scope
+	if hit, _, _ := tiered.Lookup(ctx, question, 0.8, map[string]string{"lang": "fr"}); hit != nil {
+		t.Errorf("Lookup in another scope = %+v, want a miss", hit)
+	}
+
+	counters := loadStats(t, tiered.Stats)
+	want := map[string]int64{statMiss: 2, statSemanticHit: 1, statPromotion: 1, statExactHit: 1}
+	for name, count := range want {
+		if counters[name] != count {
+			t.Errorf("stats %s = %d, want %d (all: %v)", name, counters[name], count, counters)
+		}
+	}
+}
+
+func TestTieredLookupSemanticError(t *testing.T) {
+	rdb := newTestRedis(t)
+	failure := errors.New("search failed")
+	tiered := newTestTiered(t, rdb, &fixedSearch{err: failure})
+
+	hit, outcome, err := tiered.Lookup(context.Background(), "What is the capital of France? "+testID(t), 0.8, nil)
+	if hit != nil || outcome != "" || !errors.Is(err, failure) {
+		t.Errorf("Lookup = %+v, %q, %v; want the search error", hit, outcome, err)
+	}
+	if counters := loadStats(t, tiered.Stats); counters[statError] != 1 || counters[statMiss] != 0 {
+		t.Errorf("stats = %v, want one semantic_error and no miss", counters)
+	}
+}
+
+func TestTierStats(t *testing.T) {
+	rdb := newTestRedis(t)
+	stats := &TierStats{Client: rdb, Key: "aishe:test:tiers:" + testID(t)}
+	t.Cleanup(func() { rdb.Del(context.Background(), stats.Key) })
+
+	for _, counter := range []string{statExactHit, statExactHit, statMiss} {
+		stats.Incr(counter)
+	}
+	if counters := loadStats(t, stats); len(counters) != 2 || counters[statExactHit] != 2 || counters[statMiss] != 1 {
+		t.Errorf("counters = %v, want 2 exact hits and 1 miss", counters)
+	}
+
+	rdb.HSet(context.Background(), stats.Key, "broken", "many")
+	if _, err := stats.Load(context.Background()); err == nil {
+		t.Error("Load accepted a counter that is not a number")
+	}
+
+	// Nil stats count nothing
+	var none *TierStats
+	none.Incr(statMiss)
+}
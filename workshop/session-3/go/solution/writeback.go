@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters kept by TierStats for background cache writes
+const (
+	statWriteDropped   = "write_dropped"   // The queue was full
+	statWriteAbandoned = "write_abandoned" // Still pending at the flush deadline
+	statWriteFailed    = "write_failed"
+)
+
+// cacheWrite is a queued cache write and what to report once it has run
+type cacheWrite struct {
+	Run  func(ctx context.Context) error
+	Done string // Printed when the write succeeds
+	Fail string // Describes the write in the warning printed when it fails
+}
+
+// WriteBack runs cache writes in the background so the answer can be
+// printed without waiting for the cache. Writes run one at a time in the
+// order they were queued; a write that finds the queue full is dropped.
+// Close waits for pending writes until the flush deadline; writes that
+// come after it run synchronously. A nil WriteBack runs every write
+// synchronously.
+type WriteBack struct {
+	Stats   *TierStats
+	Timeout time.Duration // How long Close waits for pending writes
+
+	// Report, when set, receives the report of each write as soon as it is
+	// known instead of Close printing them all, as long-running servers need
+	Report func(line string)
+
+	queue  chan cacheWrite
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	reports []string
+}
+
+// NewWriteBack creates a background writer using CACHE_WRITE_MODE,
+// CACHE_WRITE_QUEUE and CACHE_FLUSH_TIMEOUT from the environment
+// (defaults: async, 16 writes, 10s). It returns nil in sync mode.
+func NewWriteBack(stats *TierStats) (*WriteBack, error) {
+	switch mode := strings.ToLower(os.Getenv("CACHE_WRITE_MODE")); mode {
+	case "", "async":
+	case "sync":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid CACHE_WRITE_MODE %q (expected async or sync)", mode)
+	}
+
+	size := 16
+	if sizeStr := os.Getenv("CACHE_WRITE_QUEUE"); sizeStr != "" {
+		parsed, err := strconv.Atoi(sizeStr)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid CACHE_WRITE_QUEUE %q (expected a positive integer)", sizeStr)
+		}
+		size = parsed
+	}
+
+	timeout := 10 * time.Second
+	if timeoutStr := os.Getenv("CACHE_FLUSH_TIMEOUT"); timeoutStr != "" {
+		parsed, err := time.ParseDuration(timeoutStr)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid CACHE_FLUSH_TIMEOUT %q (expected a duration like 10s)", timeoutStr)
+		}
+		timeout = parsed
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WriteBack{
+		Stats:   stats,
+		Timeout: timeout,
+		queue:   make(chan cacheWrite, size),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Enqueue queues a write, or runs it right away on a nil or closed
+// WriteBack
+func (w *WriteBack) Enqueue(write cacheWrite) {
+	if w == nil {
+		if report := runCacheWrite(context.Background(), write, nil); report != "" {
+			fmt.Println(report)
+		}
+		return
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		w.runClosed(write)
+		return
+	}
+	select {
+	case w.queue <- write:
+		w.mu.Unlock()
+		return
+	default:
+	}
+	w.reportLocked(fmt.Sprintf("Warning: Cache write queue full, dropped: %s", write.Fail))
+	w.mu.Unlock()
+
+	// Counting takes a Redis round trip, which must not hold up other writers
+	w.Stats.Incr(statWriteDropped)
+}
+
+// runClosed runs a write that came after Close, within the flush timeout.
+// Close has already printed its reports, so this one is printed at once.
+func (w *WriteBack) runClosed(write cacheWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	report := runCacheWrite(ctx, write, w.Stats)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case report == "":
+	case w.Report != nil:
+		w.Report(report)
+	default:
+		fmt.Println(report)
+	}
+}
+
+// reportLocked passes a report to Report or keeps it for Close
+func (w *WriteBack) reportLocked(line string) {
+	if line == "" {
+		return
+	}
+	if w.Report != nil {
+		w.Report(line)
+		return
+	}
+	w.reports = append(w.reports, line)
+}
+
+// run executes queued writes until the queue is closed. Writes still
+// queued after the flush deadline are abandoned.
+func (w *WriteBack) run() {
+	defer close(w.done)
+	for write := range w.queue {
+		report := ""
+		if w.ctx.Err() != nil {
+			w.Stats.Incr(statWriteAbandoned)
+			report = fmt.Sprintf("Warning: Flush deadline passed, abandoned: %s", write.Fail)
+		} else {
+			report = runCacheWrite(w.ctx, write, w.Stats)
+		}
+
+		w.mu.Lock()
+		w.reportLocked(report)
+		w.mu.Unlock()
+	}
+}
+
+// runCacheWrite runs a single write and returns the line reporting its result
+func runCacheWrite(ctx context.Context, write cacheWrite, stats *TierStats) string {
+	err := write.Run(ctx)
+	switch {
+	case err == nil:
+		return write.Done
+	case ctx.Err() != nil:
+		stats.Incr(statWriteAbandoned)
+		return fmt.Sprintf("Warning: Flush deadline passed, abandoned: %s", write.Fail)
+	default:
+		stats.Incr(statWriteFailed)
+		return fmt.Sprintf("Warning: Error %s: %v", write.Fail, err)
+	}
+}
+
+// Close stops accepting writes, waits up to Timeout for the pending ones
+// and prints what happened to each. Writes still pending at the deadline
+// are canceled.
+func (w *WriteBack) Close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	timer := time.NewTimer(w.Timeout)
+	select {
+	case <-w.done:
+		timer.Stop()
+	case <-timer.C:
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.reports) > 0 {
+		fmt.Println()
+	}
+	for _, report := range w.reports {
+		fmt.Println(report)
+	}
+	w.reports = nil
+}
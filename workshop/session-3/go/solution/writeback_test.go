@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWriteBack creates an async writer from the given queue size and
+// flush timeout, collecting its reports
+func newTestWriteBack(t *testing.T, queue, timeout string) (*WriteBack, *[]string) {
+	t.Helper()
+	t.Setenv("CACHE_WRITE_MODE", "async")
+	t.Setenv("CACHE_WRITE_QUEUE", queue)
+	t.Setenv("CACHE_FLUSH_TIMEOUT", timeout)
+
+	w, err := NewWriteBack(nil)
+	if err != nil || w == nil {
+		t.Fatalf("NewWriteBack = %v, %v", w, err)
+	}
+	var reports []string
+	w.Report = func(line string) { reports = append(reports, line) }
+	return w, &reports
+}
+
+// blockingWrite is a write that signals when it starts and then waits for
+// release or the flush deadline
+func blockingWrite(name string, started, release chan struct{}) cacheWrite {
+	return cacheWrite{
+		Run: func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+		Done: name + " done",
+		Fail: name,
+	}
+}
+
+// noopWrite is a write that succeeds right away
+func noopWrite(name string) cacheWrite {
+	return cacheWrite{Run: func(ctx context.Context) error { return nil }, Done: name + " done", Fail: name}
+}
+
+func TestWriteBackDropsWhenFull(t *testing.T) {
+	w, reports := newTestWriteBack(t, "1", "5s")
+
+	started, release := make(chan struct{}), make(chan struct{})
+	w.Enqueue(blockingWrite("first", started, release))
+	<-started
+
+	// The writer is busy, so one write fits in the queue and the next is dropped
+	w.Enqueue(noopWrite("second"))
+	w.Enqueue(noopWrite("third"))
+	close(release)
+	w.Close()
+
+	want := []string{
+		"Warning: Cache write queue full, dropped: third",
+		"first done",
+		"second done",
+	}
+	if strings.Join(*reports, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reports = %q, want %q", *reports, want)
+	}
+
+	// Writes after Close run at once instead of being dropped
+	w.Enqueue(noopWrite("late"))
+	if last := (*reports)[len(*reports)-1]; last != "late done" {
+		t.Errorf("write after Close reported %q, want it run", last)
+	}
+}
+
+func TestWriteBackFlushDeadline(t *testing.T) {
+	w, reports := newTestWriteBack(t, "4", "50ms")
+
+	started := make(chan struct{})
+	w.Enqueue(blockingWrite("stuck", started, nil))
+	<-started
+	w.Enqueue(noopWrite("queued"))
+
+	start := time.Now()
+	w.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Close took %s, want about the 50ms flush timeout", elapsed)
+	}
+
+	want := []string{
+		"Warning: Flush deadline passed, abandoned: stuck",
+		"Warning: Flush deadline passed, abandoned: queued",
+	}
+	if strings.Join(*reports, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reports = %q, want %q", *reports, want)
+	}
+}
+
+func TestWriteBackSyncMode(t *testing.T) {
+	t.Setenv("CACHE_WRITE_MODE", "sync")
+	w, err := NewWriteBack(nil)
+	if err != nil || w != nil {
+		t.Fatalf("NewWriteBack in sync mode = %v, %v; want nil", w, err)
+	}
+
+	// A nil WriteBack runs the write before Enqueue returns
+	ran := false
+	w.Enqueue(cacheWrite{Run: func(ctx context.Context) error { ran = true; return nil }})
+	if !ran {
+		t.Error("Enqueue in sync mode did not run the write")
+	}
+	w.Close()
+
+	t.Setenv("CACHE_WRITE_MODE", "eventually")
+	if _, err := NewWriteBack(nil); err == nil {
+		t.Error("NewWriteBack accepted CACHE_WRITE_MODE=eventually")
+	}
+}